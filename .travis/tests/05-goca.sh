@@ -0,0 +1,37 @@
+# -------------------------------------------------------------------------- #
+# Copyright 2002-2019, OpenNebula Project, OpenNebula Systems                #
+#                                                                            #
+# Licensed under the Apache License, Version 2.0 (the "License"); you may    #
+# not use this file except in compliance with the License. You may obtain    #
+# a copy of the License at                                                   #
+#                                                                            #
+# http://www.apache.org/licenses/LICENSE-2.0                                 #
+#                                                                            #
+# Unless required by applicable law or agreed to in writing, software        #
+# distributed under the License is distributed on an "AS IS" BASIS,          #
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.   #
+# See the License for the specific language governing permissions and        #
+# limitations under the License.                                             #
+#--------------------------------------------------------------------------- #
+
+# run the goca tests against the oned started by 03-oned.sh, with the dummy
+# drivers, and record the calls in testdata/goca.json
+
+sudo sed -i -e 's/^#\(IM_MAD = \[ NAME="dummy"\)/\1/' \
+    -e '/^#VM_MAD = \[ NAME="dummy"/,/TYPE="xml" \]/s/^#//' /etc/one/oned.conf
+
+one restart
+
+timeout 60 sh -c 'until nc -z $0 $1; do sleep 1; done' localhost 2633
+
+eval "$(gimme 1.20)"
+
+export GOPATH=$(mktemp -d) GO111MODULE=off
+mkdir -p $GOPATH/src/github.com/OpenNebula
+ln -s $PWD $GOPATH/src/github.com/OpenNebula/one
+
+go get github.com/kolo/xmlrpc gopkg.in/xmlpath.v2 gopkg.in/check.v1
+
+rc=$?; if [[ $rc != 0 ]]; then exit $rc; fi
+
+cd $GOPATH/src/github.com/OpenNebula/one/src/oca/go/src/goca && make test-record
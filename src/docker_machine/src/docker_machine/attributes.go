@@ -0,0 +1,72 @@
+package opennebula
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+// attributes are the attributes of a vector of the template, in order
+type attributes [][2]string
+
+func (a attributes) get(name string) string {
+	for _, attr := range a {
+		if attr[0] == name {
+			return attr[1]
+		}
+	}
+	return ""
+}
+
+func (a *attributes) add(name, value string) {
+	*a = append(*a, [2]string{name, value})
+}
+
+// addTo adds the attributes to template, in the vector name. The values come
+// from the flags, their double quotes are escaped.
+func (a attributes) addTo(template *goca.TemplateBuilder, name string) {
+	vector := template.NewVector(name)
+	for _, attr := range a {
+		vector.AddValue(attr[0], escapeValue(attr[1]))
+	}
+}
+
+// parseItems parses the values of a flag listing items, e.g. networks or
+// disks: ITEM[,OPTION=VALUE...]. newItem returns the attributes of an item, and
+// options maps the options to attributes. The values of the environment
+// variables are split at the commas, so the options are joined back to their
+// item.
+func parseItems(flag, item string, values []string, options map[string]string,
+	newItem func(value string) attributes) ([]attributes, error) {
+
+	var items []attributes
+
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+
+			i := strings.Index(field, "=")
+			if i < 0 {
+				if field == "" {
+					return nil, fmt.Errorf("--%s: empty %s in %q", flag, item, value)
+				}
+				items = append(items, newItem(field))
+				continue
+			}
+
+			option, optionValue := field[:i], field[i+1:]
+			name, ok := options[option]
+			if !ok {
+				return nil, fmt.Errorf("--%s: unknown option %q in %q", flag, option, value)
+			}
+			if len(items) == 0 {
+				return nil, fmt.Errorf("--%s: option %q without %s", flag, option, item)
+			}
+
+			items[len(items)-1].add(name, optionValue)
+		}
+	}
+
+	return items, nil
+}
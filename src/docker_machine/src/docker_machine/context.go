@@ -0,0 +1,161 @@
+package opennebula
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+const (
+	defaultUserDataEncoding = "base64"
+
+	// extraScript runs the script of --opennebula-start-script, after the
+	// contextualization script
+	extraScript = `
+
+# Run the additional start script
+if [ -n "$DOCKER_START_SCRIPT_BASE64" ]; then
+	SCRIPT=$(mktemp)
+	echo "$DOCKER_START_SCRIPT_BASE64" | base64 -d > $SCRIPT
+	chmod +x $SCRIPT
+	$SCRIPT
+	STATUS=$?
+	rm -f $SCRIPT
+	exit $STATUS
+fi`
+)
+
+// reservedContext are the CONTEXT attributes set by the driver, which can't be
+// set with --opennebula-context
+var reservedContext = map[string]string{
+	"DOCKER_DATA_DISK":           "--opennebula-docker-data-disk",
+	"DOCKER_SSH_USER":            "--opennebula-ssh-user",
+	"DOCKER_SSH_PUBLIC_KEY":      "",
+	"DOCKER_START_SCRIPT_BASE64": "--opennebula-start-script",
+	"START_SCRIPT":               "--opennebula-start-script",
+	"START_SCRIPT_BASE64":        "--opennebula-start-script",
+	"USER_DATA":                  "--opennebula-user-data",
+	"USERDATA_ENCODING":          "--opennebula-user-data-encoding",
+}
+
+// parseContext parses the KEY=VALUE values of --opennebula-context
+func parseContext(values []string) ([][2]string, error) {
+	var attrs [][2]string
+
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("--opennebula-context: %q is not KEY=VALUE", value)
+		}
+
+		key := strings.ToUpper(strings.TrimSpace(value[:i]))
+		if flag, ok := reservedContext[key]; ok {
+			if flag != "" {
+				return nil, fmt.Errorf("--opennebula-context: %s is set by the driver, use %s", key, flag)
+			}
+			return nil, fmt.Errorf("--opennebula-context: %s is set by the driver", key)
+		}
+
+		attrs = append(attrs, [2]string{key, value[i+1:]})
+	}
+
+	return attrs, nil
+}
+
+// checkContext checks the options of the contextualization
+func (d *Driver) checkContext() error {
+	if _, err := parseContext(d.Context); err != nil {
+		return err
+	}
+
+	switch d.UserDataEncoding {
+	case "", "base64", "none":
+	default:
+		return fmt.Errorf("unknown encoding %q for --opennebula-user-data-encoding, use base64 or none", d.UserDataEncoding)
+	}
+
+	return nil
+}
+
+// contextAttributes returns the attributes of the CONTEXT of the VM, with the
+// public keys authorized for the SSH user. The values of --opennebula-context
+// replace the default ones.
+func (d *Driver) contextAttributes(authorizedKeys string) ([][2]string, error) {
+	attrs := [][2]string{
+		{"NETWORK", "YES"},
+		{"SSH_PUBLIC_KEY", "$USER[SSH_PUBLIC_KEY]"},
+	}
+
+	extra, err := parseContext(d.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attr := range extra {
+		replaced := false
+		for i := range attrs {
+			if attrs[i][0] == attr[0] {
+				attrs[i][1] = attr[1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			attrs = append(attrs, attr)
+		}
+	}
+
+	attrs = append(attrs,
+		[2]string{"DOCKER_SSH_USER", d.SSHUser},
+		[2]string{"DOCKER_SSH_PUBLIC_KEY", authorizedKeys})
+
+	script := contextScript
+	if d.DockerDataDisk {
+		attrs = append(attrs, [2]string{"DOCKER_DATA_DISK", "YES"})
+		script += dataDiskScript
+	}
+	if d.StartScript != "" {
+		content, err := ioutil.ReadFile(d.StartScript)
+		if err != nil {
+			return nil, fmt.Errorf("--opennebula-start-script: %s", err)
+		}
+		attrs = append(attrs, [2]string{"DOCKER_START_SCRIPT_BASE64", base64.StdEncoding.EncodeToString(content)})
+		script += extraScript
+	}
+	attrs = append(attrs, [2]string{"START_SCRIPT_BASE64", base64.StdEncoding.EncodeToString([]byte(script))})
+
+	if d.UserData != "" {
+		content, err := ioutil.ReadFile(d.UserData)
+		if err != nil {
+			return nil, fmt.Errorf("--opennebula-user-data: %s", err)
+		}
+
+		if d.UserDataEncoding == "none" {
+			attrs = append(attrs, [2]string{"USER_DATA", string(content)})
+		} else {
+			attrs = append(attrs,
+				[2]string{"USERDATA_ENCODING", "base64"},
+				[2]string{"USER_DATA", base64.StdEncoding.EncodeToString(content)})
+		}
+	}
+
+	return attrs, nil
+}
+
+// addContext adds the CONTEXT of the VM to template. The values are escaped,
+// most of them are provided by the user.
+func (d *Driver) addContext(template *goca.TemplateBuilder, authorizedKeys string) error {
+	attrs, err := d.contextAttributes(authorizedKeys)
+	if err != nil {
+		return err
+	}
+
+	vector := template.NewVector("CONTEXT")
+	for _, attr := range attrs {
+		vector.AddValue(attr[0], escapeValue(attr[1]))
+	}
+
+	return nil
+}
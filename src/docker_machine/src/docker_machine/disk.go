@@ -0,0 +1,149 @@
+package opennebula
+
+import (
+	"fmt"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+const (
+	// volatileDisk is the value of --opennebula-disk for a volatile disk
+	volatileDisk = "volatile"
+
+	// dataDiskScript formats the first blank disk and mounts it at
+	// /var/lib/docker, for --opennebula-docker-data-disk. The disk is found by
+	// its label at the next boots.
+	dataDiskScript = `
+
+# Mount the data disk of Docker
+if [ "$DOCKER_DATA_DISK" = "YES" ] && ! grep -qs ' /var/lib/docker ' /proc/mounts; then
+	DEVICE=$(blkid -L docker-data)
+	if [ -z "$DEVICE" ]; then
+		for DISK in $(lsblk -dnpo NAME,TYPE | awk '$2 == "disk" { print $1 }'); do
+			if [ $(lsblk -npo NAME $DISK | wc -l) -eq 1 ] && ! blkid $DISK > /dev/null; then
+				DEVICE=$DISK
+				break
+			fi
+		done
+		if [ -n "$DEVICE" ]; then
+			mkfs.ext4 -q -L docker-data $DEVICE
+		fi
+	fi
+
+	if [ -n "$DEVICE" ]; then
+		mkdir -p /var/lib/docker
+		if ! grep -qs '^LABEL=docker-data ' /etc/fstab; then
+			echo "LABEL=docker-data /var/lib/docker ext4 defaults 0 2" >> /etc/fstab
+		fi
+		mount /var/lib/docker
+	else
+		echo "No blank disk to mount at /var/lib/docker" >&2
+	fi
+fi`
+)
+
+// diskOptions maps the options of --opennebula-disk to the DISK attributes
+var diskOptions = map[string]string{
+	"owner":      "IMAGE_UNAME",
+	"size":       "SIZE",
+	"format":     "FORMAT",
+	"type":       "TYPE",
+	"dev-prefix": "DEV_PREFIX",
+	"cache":      "CACHE",
+	"driver":     "DRIVER",
+}
+
+// disk is a disk requested with --opennebula-disk
+type disk struct {
+	// attributes are the attributes of the disk, IMAGE or IMAGE_ID first for
+	// the image disks
+	attributes
+}
+
+func (d *disk) volatile() bool {
+	return d.get("IMAGE") == "" && d.get("IMAGE_ID") == ""
+}
+
+// parseDisks parses the values of --opennebula-disk: IMAGE[,OPTION=VALUE...]
+// for an image, by name or ID, or volatile,size=SIZE[,OPTION=VALUE...] for a
+// volatile disk
+func parseDisks(values []string) ([]disk, error) {
+	items, err := parseItems("opennebula-disk", "disk", values, diskOptions, func(image string) attributes {
+		switch {
+		case image == volatileDisk:
+			return attributes{}
+		case isID(image):
+			return attributes{{"IMAGE_ID", image}}
+		default:
+			return attributes{{"IMAGE", image}}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	disks := make([]disk, len(items))
+	for i := range items {
+		disks[i] = disk{items[i]}
+		if err := disks[i].check(); err != nil {
+			return nil, fmt.Errorf("--opennebula-disk: disk %d: %s", i, err)
+		}
+	}
+
+	return disks, nil
+}
+
+// check checks the options of a disk, and sets the defaults of the volatile
+// disks
+func (d *disk) check() error {
+	if !d.volatile() {
+		for _, option := range []string{"format", "type"} {
+			if d.get(diskOptions[option]) != "" {
+				return fmt.Errorf("option %q is only for the volatile disks", option)
+			}
+		}
+		if size := d.get("SIZE"); size != "" && !isID(size) {
+			return fmt.Errorf("size %q isn't a number of MB", size)
+		}
+		return nil
+	}
+
+	if d.get("IMAGE_UNAME") != "" {
+		return fmt.Errorf("option \"owner\" is only for the image disks")
+	}
+	if size := d.get("SIZE"); !isID(size) {
+		return fmt.Errorf("a volatile disk requires a size in MB, not %q", size)
+	}
+
+	switch d.get("TYPE") {
+	case "":
+		d.add("TYPE", "fs")
+	case "fs", "swap":
+	default:
+		return fmt.Errorf("unknown type %q, use fs or swap", d.get("TYPE"))
+	}
+	if d.get("FORMAT") == "" {
+		d.add("FORMAT", "raw")
+	}
+
+	return nil
+}
+
+// disks returns the disks requested with --opennebula-disk
+func (d *Driver) disks() ([]disk, error) {
+	return parseDisks(d.Disks)
+}
+
+// addDisks adds the disks requested with --opennebula-disk to template
+func (d *Driver) addDisks(template *goca.TemplateBuilder) error {
+	disks, err := d.disks()
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		disk.addTo(template, "DISK")
+	}
+
+	return nil
+}
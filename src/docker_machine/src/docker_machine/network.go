@@ -0,0 +1,115 @@
+package opennebula
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+// nicOptions maps the options of the network flags to the NIC attributes
+var nicOptions = map[string]string{
+	"owner":           "NETWORK_UNAME",
+	"security-groups": "SECURITY_GROUPS",
+	"model":           "MODEL",
+	"ip":              "IP",
+	"mac":             "MAC",
+}
+
+// parseNetworks parses the values of a network flag:
+// NETWORK[,OPTION=VALUE...], into the attributes of NICs. attr is the NETWORK
+// or NETWORK_ID attribute of the network.
+func parseNetworks(flag, attr string, values []string) ([]attributes, error) {
+	nics, err := parseItems(flag, "network", values, nicOptions, func(network string) attributes {
+		return attributes{{attr, network}}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The security groups are separated by colons in the flags
+	for _, n := range nics {
+		for i := range n {
+			if n[i][0] == "SECURITY_GROUPS" {
+				n[i][1] = strings.Replace(n[i][1], ":", ",", -1)
+			}
+		}
+	}
+
+	return nics, nil
+}
+
+// nics returns the NICs requested with the network flags: the ones of
+// --opennebula-network-name, then the ones of --opennebula-network-id
+func (d *Driver) nics() ([]attributes, error) {
+	byName, err := parseNetworks("opennebula-network-name", "NETWORK", d.Networks)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range byName {
+		if d.NetworkOwner != "" && byName[i].get("NETWORK_UNAME") == "" {
+			byName[i].add("NETWORK_UNAME", d.NetworkOwner)
+		}
+	}
+
+	byID, err := parseNetworks("opennebula-network-id", "NETWORK_ID", d.NetworkIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range byID {
+		if _, err := parseID("--opennebula-network-id", n.get("NETWORK_ID")); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(byName, byID...), nil
+}
+
+// addNICs adds the NICs requested with the network flags to template
+func (d *Driver) addNICs(template *goca.TemplateBuilder) error {
+	nics, err := d.nics()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nics {
+		n.addTo(template, "NIC")
+	}
+
+	return nil
+}
+
+// sshAddress returns the address docker-machine connects to: the one of the
+// first NIC on the network of --opennebula-ssh-network, or of the first NIC.
+// The IPv4 address is preferred unless --opennebula-ssh-ipv6 is set.
+func (d *Driver) sshAddress(vm *goca.VM) (string, error) {
+	for _, n := range vm.Template.NIC {
+		networkID, _ := n.Dynamic.GetContentByName("NETWORK_ID")
+		if d.SSHNetwork != "" && d.SSHNetwork != n.Network && d.SSHNetwork != networkID {
+			continue
+		}
+
+		ip6, _ := n.Dynamic.GetContentByName("IP6_GLOBAL")
+
+		switch {
+		case d.SSHIPv6 && ip6 != "":
+			return ip6, nil
+		case d.SSHIPv6:
+			return "", fmt.Errorf("NIC %d on network %s has no global IPv6 address", n.ID, n.Network)
+		case n.IP != "":
+			return n.IP, nil
+		case ip6 != "":
+			return ip6, nil
+		default:
+			return "", fmt.Errorf("NIC %d on network %s has no IP address", n.ID, n.Network)
+		}
+	}
+
+	if d.SSHNetwork != "" {
+		return "", fmt.Errorf("the VM has no NIC on the network %q of --opennebula-ssh-network", d.SSHNetwork)
+	}
+
+	return "", fmt.Errorf("IP address is not set")
+}
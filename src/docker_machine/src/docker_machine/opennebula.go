@@ -1,10 +1,12 @@
 package opennebula
 
 import (
-	"encoding/base64"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"strconv"
 	"time"
 
@@ -13,7 +15,6 @@ import (
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
-	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
 )
 
@@ -21,9 +22,11 @@ type Driver struct {
 	*drivers.BaseDriver
 	TemplateName   string
 	TemplateID     string
-	NetworkName    string
+	Networks       []string
 	NetworkOwner   string
-	NetworkID      string
+	NetworkIDs     []string
+	SSHNetwork     string
+	SSHIPv6        bool
 	ImageName      string
 	ImageOwner     string
 	ImageID        string
@@ -35,10 +38,50 @@ type Driver struct {
 	B2DSize        string
 	User           string
 	Password       string
+	Auth           string
+	AuthFile       string
+	Token          string
+	TargetUser     string
+	X509Cert       string
+	X509Key        string
 	Xmlrpcurl      string
 	Config         goca.OneConfig
 	DisableVNC     bool
 	StartRetries   string
+	KeepOnFailure  bool
+
+	// Contextualization
+	UserData         string
+	UserDataEncoding string
+	Context          []string
+	StartScript      string
+
+	// SSH keys
+	SSHKey            string
+	SSHAuthorizedKeys []string
+	NoContextKey      bool
+
+	// Disks
+	Disks          []string
+	DockerDataDisk bool
+
+	// Placement
+	SchedRequirements   string
+	SchedDSRequirements string
+	SchedRank           string
+	VMGroup             string
+	VMGroupRole         string
+	Cluster             string
+	Host                string
+	Datastore           string
+
+	// VMID is the ID of the VM, empty for the machines created by the
+	// versions of the driver which didn't store it
+	VMID string
+
+	// StoresVMID is set by Create: the machine has no VM without VMID, e.g.
+	// after a failed Create, and it's never looked up by name
+	StoresVMID bool
 }
 
 const (
@@ -48,6 +91,7 @@ const (
 	defaultVCPU         = "1"
 	defaultMemory       = "1024"
 	defaultStartRetries = "600"
+	defaultAuth         = "password"
 	// This is the contextualization script that will be executed by OpenNebula
 	contextScript = `#!/bin/sh
 
@@ -102,6 +146,39 @@ func NewDriver(hostName, storePath string) *Driver {
 
 func (d *Driver) buildConfig() {
 	d.Config = goca.NewConfig(d.User, d.Password, d.Xmlrpcurl)
+
+	switch d.Auth {
+	case "file":
+		d.Config.Auth = &goca.FileAuth{Path: d.AuthFile}
+	case "token":
+		d.Config.Auth = &goca.LoginTokenAuth{User: d.User, Token: d.Token}
+	case "server_cipher":
+		d.Config.Auth = &goca.ServerCipherAuth{
+			ServerUser:     d.User,
+			ServerPassword: d.Password,
+			TargetUser:     d.TargetUser,
+		}
+	case "x509":
+		d.Config.Auth = goca.AuthProviderFunc(d.x509Session)
+	}
+}
+
+// x509Session reads the certificate and the key at each call, so that they
+// can be renewed
+func (d *Driver) x509Session(ctx context.Context) (string, error) {
+	cert, err := ioutil.ReadFile(d.X509Cert)
+	if err != nil {
+		return "", fmt.Errorf("--opennebula-x509-cert: %s", err)
+	}
+
+	key, err := ioutil.ReadFile(d.X509Key)
+	if err != nil {
+		return "", fmt.Errorf("--opennebula-x509-key: %s", err)
+	}
+
+	auth := &goca.X509Auth{User: d.User, CertPEM: cert, KeyPEM: key}
+
+	return auth.Session(ctx)
 }
 
 func (d *Driver) setClient() {
@@ -115,19 +192,19 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 	return []mcnflag.Flag{
 		mcnflag.StringFlag{
 			Name:   "opennebula-cpu",
-			Usage:  fmt.Sprintf("CPU value for the VM. Default: %d", defaultCPU),
+			Usage:  fmt.Sprintf("CPU value for the VM. Default: %s. ONE_RESIZE_CPU resizes the VM on docker-machine start", defaultCPU),
 			EnvVar: "ONE_CPU",
 			Value:  "",
 		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-vcpu",
-			Usage:  fmt.Sprintf("VCPUs for the VM. Default: %d", defaultVCPU),
+			Usage:  fmt.Sprintf("VCPUs for the VM. Default: %s. ONE_RESIZE_VCPU resizes the VM on docker-machine start", defaultVCPU),
 			EnvVar: "ONE_VCPU",
 			Value:  "",
 		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-memory",
-			Usage:  fmt.Sprintf("Size of memory for VM in MB. Default: %d", defaultMemory),
+			Usage:  fmt.Sprintf("Size of memory for VM in MB. Default: %s. ONE_RESIZE_MEMORY resizes the VM on docker-machine start", defaultMemory),
 			EnvVar: "ONE_MEMORY",
 			Value:  "",
 		},
@@ -143,17 +220,17 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "ONE_TEMPLATE_ID",
 			Value:  "",
 		},
-		mcnflag.StringFlag{
-			Name:   "opennebula-network-name",
-			Usage:  "Network to connect the machine to",
+		mcnflag.StringSliceFlag{
+			Name: "opennebula-network-name",
+			Usage: "Network to connect the machine to, repeat it for several NICs. " +
+				"Options: NAME[,owner=USER][,security-groups=ID:ID][,model=MODEL][,ip=IP][,mac=MAC]",
 			EnvVar: "ONE_NETWORK_NAME",
-			Value:  "",
 		},
-		mcnflag.StringFlag{
-			Name:   "opennebula-network-id",
-			Usage:  "Network ID to connect the machine to",
+		mcnflag.StringSliceFlag{
+			Name: "opennebula-network-id",
+			Usage: "Network ID to connect the machine to, repeat it for several NICs. " +
+				"Same options as --opennebula-network-name",
 			EnvVar: "ONE_NETWORK_ID",
-			Value:  "",
 		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-network-owner",
@@ -161,6 +238,16 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "ONE_NETWORK_OWNER",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-network",
+			Usage:  "Name or ID of the network of the NIC used for SSH. Default: the first NIC",
+			EnvVar: "ONE_SSH_NETWORK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-ssh-ipv6",
+			Usage:  "Use the global IPv6 address of the NIC for SSH instead of the IPv4 one",
+			EnvVar: "ONE_SSH_IPV6",
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-image-name",
 			Usage:  "Image to use as the OS",
@@ -187,7 +274,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-disk-resize",
-			Usage:  "Size of disk for VM in MB",
+			Usage:  "Size of disk for VM in MB. ONE_RESIZE_DISK grows the OS disk on docker-machine start",
 			EnvVar: "ONE_DISK_SIZE",
 			Value:  "",
 		},
@@ -197,12 +284,101 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "ONE_B2D_DATA_SIZE",
 			Value:  "",
 		},
+		mcnflag.StringSliceFlag{
+			Name: "opennebula-disk",
+			Usage: "Extra disk of the machine, repeat it for several disks: an image, by name or ID, or a volatile disk. " +
+				"Options: IMAGE[,owner=USER][,size=MB] or volatile,size=MB[,format=raw|qcow2][,type=fs|swap], " +
+				"then [,dev-prefix=PREFIX][,cache=CACHE][,driver=DRIVER]",
+			EnvVar: "ONE_DISK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-docker-data-disk",
+			Usage:  "Format the first blank disk of the machine and mount it at /var/lib/docker",
+			EnvVar: "ONE_DOCKER_DATA_DISK",
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-ssh-user",
 			Usage:  "Set the name of the SSH user",
 			EnvVar: "ONE_SSH_USER",
 			Value:  defaultSSHUser,
 		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-key-path",
+			Usage:  "Path of an existing SSH private key to use instead of generating one, the public key is read from PATH.pub",
+			EnvVar: "ONE_SSH_KEY_PATH",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-ssh-authorized-keys",
+			Usage:  "Path of a file of public keys also authorized for the SSH user, repeat it for several files",
+			EnvVar: "ONE_SSH_AUTHORIZED_KEYS",
+		},
+		mcnflag.BoolFlag{
+			Name: "opennebula-ssh-no-context-key",
+			Usage: "Don't pass the key of the machine in the context, authorize the SSH_PUBLIC_KEY of the OpenNebula user instead. " +
+				"It requires --opennebula-ssh-key-path, whose key the SSH_PUBLIC_KEY must include: a generated key is only authorized through the context",
+			EnvVar: "ONE_SSH_NO_CONTEXT_KEY",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-user-data",
+			Usage:  "Path of a cloud-init user-data file passed in the context",
+			EnvVar: "ONE_USER_DATA",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-user-data-encoding",
+			Usage:  fmt.Sprintf("Encoding of the user-data in the context: base64 or none. Default: %s", defaultUserDataEncoding),
+			EnvVar: "ONE_USER_DATA_ENCODING",
+			Value:  defaultUserDataEncoding,
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-context",
+			Usage:  "Extra KEY=VALUE attribute of the context, repeat it for several attributes",
+			EnvVar: "ONE_CONTEXT",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-start-script",
+			Usage:  "Path of a script run at the start of the VM, after the one of the driver",
+			EnvVar: "ONE_START_SCRIPT",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-sched-requirements",
+			Usage:  "Scheduler requirements of the hosts of the VM, e.g. 'HYPERVISOR = \"kvm\"'. Replaces the ones of the template",
+			EnvVar: "ONE_SCHED_REQUIREMENTS",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-sched-ds-requirements",
+			Usage:  "Scheduler requirements of the system datastores of the VM. Replaces the ones of the template",
+			EnvVar: "ONE_SCHED_DS_REQUIREMENTS",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-sched-rank",
+			Usage:  "Scheduler rank of the hosts of the VM, e.g. FREE_CPU or -RUNNING_VMS",
+			EnvVar: "ONE_SCHED_RANK",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-vm-group",
+			Usage:  "Name or ID of the VM group of the VM, with --opennebula-vm-group-role",
+			EnvVar: "ONE_VM_GROUP",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-vm-group-role",
+			Usage:  "Role of the VM in the VM group of --opennebula-vm-group",
+			EnvVar: "ONE_VM_GROUP_ROLE",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-cluster",
+			Usage:  "Name or ID of the cluster to deploy the VM in",
+			EnvVar: "ONE_CLUSTER",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-host",
+			Usage:  "Name or ID of the host to deploy the VM on",
+			EnvVar: "ONE_HOST",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-datastore",
+			Usage:  "Name or ID of the system datastore to deploy the VM on",
+			EnvVar: "ONE_DATASTORE",
+		},
 		mcnflag.BoolFlag{
 			Name:   "opennebula-disable-vnc",
 			Usage:  "VNC is enabled by default. Disable it with this flag",
@@ -218,11 +394,47 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Set the password for authentication",
 			EnvVar: "ONE_PASSWORD",
 		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-auth",
+			Usage:  "Set the authentication method: password, file, token, server_cipher or x509",
+			EnvVar: "ONE_AUTH_METHOD",
+			Value:  defaultAuth,
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-auth-file",
+			Usage:  "Set the path of the authentication file for the file method. Default: $ONE_AUTH or ~/.one/one_auth",
+			EnvVar: "ONE_AUTH",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-token",
+			Usage:  "Set the login token for the token method",
+			EnvVar: "ONE_TOKEN",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-target-user",
+			Usage:  "Set the user the calls are performed for with the server_cipher method. Default: the server user",
+			EnvVar: "ONE_TARGET_USER",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-x509-cert",
+			Usage:  "Set the path of the PEM certificate for the x509 method",
+			EnvVar: "ONE_X509_CERT",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-x509-key",
+			Usage:  "Set the path of the PEM private key for the x509 method",
+			EnvVar: "ONE_X509_KEY",
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-xmlrpcurl",
 			Usage:  "Set the url for one xmlrpc server",
 			EnvVar: "ONE_XMLRPC",
 		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-keep-on-failure",
+			Usage:  "Keep the VM when the creation of the machine fails, to debug it",
+			EnvVar: "ONE_KEEP_ON_FAILURE",
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-start-retries",
 			Usage:  "Set the number of retries until de vm is running",
@@ -238,6 +450,12 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	// Authentication
 	d.User = flags.String("opennebula-user")
 	d.Password = flags.String("opennebula-password")
+	d.Auth = flags.String("opennebula-auth")
+	d.AuthFile = flags.String("opennebula-auth-file")
+	d.Token = flags.String("opennebula-token")
+	d.TargetUser = flags.String("opennebula-target-user")
+	d.X509Cert = flags.String("opennebula-x509-cert")
+	d.X509Key = flags.String("opennebula-x509-key")
 	d.Xmlrpcurl = flags.String("opennebula-xmlrpcurl")
 
 	// Capacity
@@ -250,9 +468,11 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.TemplateID = flags.String("opennebula-template-id")
 
 	// Network
-	d.NetworkName = flags.String("opennebula-network-name")
-	d.NetworkID = flags.String("opennebula-network-id")
+	d.Networks = flags.StringSlice("opennebula-network-name")
+	d.NetworkIDs = flags.StringSlice("opennebula-network-id")
 	d.NetworkOwner = flags.String("opennebula-network-owner")
+	d.SSHNetwork = flags.String("opennebula-ssh-network")
+	d.SSHIPv6 = flags.Bool("opennebula-ssh-ipv6")
 
 	// Storage
 	d.ImageID = flags.String("opennebula-image-id")
@@ -262,24 +482,65 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.ImageDevPrefix = flags.String("opennebula-dev-prefix")
 	d.DiskSize = flags.String("opennebula-disk-resize")
 	d.B2DSize = flags.String("opennebula-b2d-size")
+	d.Disks = flags.StringSlice("opennebula-disk")
+	d.DockerDataDisk = flags.Bool("opennebula-docker-data-disk")
 
 	// Provision
 	d.SSHUser = flags.String("opennebula-ssh-user")
+	d.SSHKey = flags.String("opennebula-ssh-key-path")
+	d.SSHAuthorizedKeys = flags.StringSlice("opennebula-ssh-authorized-keys")
+	d.NoContextKey = flags.Bool("opennebula-ssh-no-context-key")
+
+	// Context
+	d.UserData = flags.String("opennebula-user-data")
+	d.UserDataEncoding = flags.String("opennebula-user-data-encoding")
+	d.Context = flags.StringSlice("opennebula-context")
+	d.StartScript = flags.String("opennebula-start-script")
+
+	// Placement
+	d.SchedRequirements = flags.String("opennebula-sched-requirements")
+	d.SchedDSRequirements = flags.String("opennebula-sched-ds-requirements")
+	d.SchedRank = flags.String("opennebula-sched-rank")
+	d.VMGroup = flags.String("opennebula-vm-group")
+	d.VMGroupRole = flags.String("opennebula-vm-group-role")
+	d.Cluster = flags.String("opennebula-cluster")
+	d.Host = flags.String("opennebula-host")
+	d.Datastore = flags.String("opennebula-datastore")
 
 	// VNC
 	d.DisableVNC = flags.Bool("opennebula-disable-vnc")
 
 	// CONFIG
 	d.StartRetries = flags.String("opennebula-start-retries")
+	d.KeepOnFailure = flags.Bool("opennebula-keep-on-failure")
+
+	if err := d.checkAuth(); err != nil {
+		return err
+	}
+
+	if err := d.checkContext(); err != nil {
+		return err
+	}
+
+	if err := d.checkPlacement(); err != nil {
+		return err
+	}
+
+	if err := d.checkSSHKeys(); err != nil {
+		return err
+	}
 
 	// Either TemplateName or TemplateID
 	if d.TemplateName != "" && d.TemplateID != "" {
 		return errors.New("specify only one of: --opennebula-template-name or --opennebula-template-id, not both")
 	}
 
-	// Either NetworkName or NetworkID
-	if d.NetworkName != "" && d.NetworkID != "" {
-		return errors.New("specify only one of: --opennebula-network-name or --opennebula-network-id, not both")
+	if _, err := d.nics(); err != nil {
+		return err
+	}
+
+	if _, err := d.disks(); err != nil {
+		return err
 	}
 
 	// Either ImageName or ImageID
@@ -308,6 +569,10 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		if d.B2DSize != "" {
 			return errors.New("option: --opennebula-disk-resize is incompatible with --opennebula-template-*")
 		}
+		// Disks are incompatible, they would replace the ones of the template
+		if len(d.Disks) > 0 {
+			return errors.New("option: --opennebula-disk is incompatible with --opennebula-template-*")
+		}
 		// DisableVNC is incompatible
 		if d.DisableVNC {
 			return errors.New("option: --opennebula-disable-vnc is incompatible with --opennebula-template-*")
@@ -320,11 +585,16 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 			return errors.New("specify a image to use as the OS with --opennebula-image-name or --opennebula-image-id")
 		}
 
-		// NetworkName or NetworkID is required
-		if d.NetworkName == "" && d.NetworkID == "" {
+		// Networks or NetworkIDs is required
+		if len(d.Networks) == 0 && len(d.NetworkIDs) == 0 {
 			return errors.New("specify a network to connect to with --opennebula-network-name or --opennebula-network-id")
 		}
 
+		// A blank disk is required for DockerDataDisk
+		if d.DockerDataDisk && len(d.Disks) == 0 {
+			return errors.New("--opennebula-docker-data-disk requires a disk to mount, add one with --opennebula-disk")
+		}
+
 		// Assign default capacity values
 		if d.CPU == "" {
 			d.CPU = defaultCPU
@@ -342,6 +612,29 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	return nil
 }
 
+// checkAuth checks the options of the authentication method
+func (d *Driver) checkAuth() error {
+	switch d.Auth {
+	case "", "password", "file":
+	case "token":
+		if d.User == "" || d.Token == "" {
+			return errors.New("the token authentication requires --opennebula-user and --opennebula-token")
+		}
+	case "server_cipher":
+		if d.User == "" || d.Password == "" {
+			return errors.New("the server_cipher authentication requires --opennebula-user and --opennebula-password")
+		}
+	case "x509":
+		if d.User == "" || d.X509Cert == "" || d.X509Key == "" {
+			return errors.New("the x509 authentication requires --opennebula-user, --opennebula-x509-cert and --opennebula-x509-key")
+		}
+	default:
+		return fmt.Errorf("unknown authentication method %q for --opennebula-auth", d.Auth)
+	}
+
+	return nil
+}
+
 func (d *Driver) DriverName() string {
 	return "opennebula"
 }
@@ -354,27 +647,28 @@ func (d *Driver) GetSSHUsername() string {
 	return d.SSHUser
 }
 
-func (d *Driver) PreCreateCheck() error {
-	return nil
-}
-
-func (d *Driver) Create() error {
+func (d *Driver) Create() (err error) {
 	var (
 		vector     *goca.TemplateBuilderVector
 		vmtemplate *goca.Template
-
-		err error
 	)
 
 	// build config and set the xmlrpc client
 	d.setClient()
 
-	log.Infof("Creating SSH key..")
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+	d.StoresVMID = true
+
+	if err := d.createSSHKey(); err != nil {
 		return err
 	}
 
-	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	defer func() {
+		if err != nil {
+			err = d.rollback(err)
+		}
+	}()
+
+	authorizedKeys, err := d.authorizedKeys()
 	if err != nil {
 		return err
 	}
@@ -420,6 +714,11 @@ func (d *Driver) Create() error {
 			vector.AddValue("FORMAT", "raw")
 		}
 
+		// Extra disks
+		if err := d.addDisks(template); err != nil {
+			return err
+		}
+
 		// VNC
 		if !d.DisableVNC {
 			vector = template.NewVector("GRAPHICS")
@@ -442,40 +741,30 @@ func (d *Driver) Create() error {
 	}
 
 	// Network
-	if d.NetworkName != "" || d.NetworkID != "" {
-		vector = template.NewVector("NIC")
-
-		if d.NetworkName != "" {
-			vector.AddValue("NETWORK", d.NetworkName)
-			if d.NetworkOwner != "" {
-				vector.AddValue("NETWORK_UNAME", d.NetworkOwner)
-			}
-		}
-
-		if d.NetworkID != "" {
-			vector.AddValue("NETWORK_ID", d.NetworkID)
-		}
+	if err := d.addNICs(template); err != nil {
+		return err
 	}
 
+	// Placement
+	d.addPlacement(template)
+
 	// Context
-	vector = template.NewVector("CONTEXT")
-	vector.AddValue("NETWORK", "YES")
-	vector.AddValue("SSH_PUBLIC_KEY", "$USER[SSH_PUBLIC_KEY]")
-	vector.AddValue("DOCKER_SSH_USER", d.SSHUser)
-	vector.AddValue("DOCKER_SSH_PUBLIC_KEY", string(pubKey))
-	contextScript64 := base64.StdEncoding.EncodeToString([]byte(contextScript))
-	vector.AddValue("START_SCRIPT_BASE64", contextScript64)
+	if err := d.addContext(template, authorizedKeys); err != nil {
+		return err
+	}
 
 	// Instantiate
 	log.Infof("Starting	 VM..")
 
+	var vmID uint
 	if d.TemplateName != "" || d.TemplateID != "" {
 
 		if d.TemplateName != "" {
-			vmtemplate, err = goca.NewTemplateFromName(d.TemplateName)
+			templateID, err := goca.NewResolver(goca.PoolWhoMine, 0).TemplateID(d.TemplateName)
 			if err != nil {
 				return err
 			}
+			vmtemplate = goca.NewTemplate(templateID)
 		} else {
 			templateID, err := strconv.Atoi(d.TemplateID)
 			if err != nil {
@@ -484,16 +773,18 @@ func (d *Driver) Create() error {
 			vmtemplate = goca.NewTemplate(uint(templateID))
 		}
 
-		_, err = vmtemplate.Instantiate(d.MachineName, false, template.String())
+		vmID, err = vmtemplate.Instantiate(d.MachineName, false, template.String())
 
 	} else {
-		_, err = goca.CreateVM(template.String(), false)
+		vmID, err = goca.CreateVM(template.String(), false)
 	}
 
 	if err != nil {
 		return err
 	}
 
+	d.VMID = strconv.FormatUint(uint64(vmID), 10)
+
 	if d.IPAddress, err = d.GetIP(); err != nil {
 		return err
 	}
@@ -501,17 +792,100 @@ func (d *Driver) Create() error {
 	return d.Start()
 }
 
+// rollback cleans up after a failed Create: it terminates the VM and removes
+// the SSH key, unless --opennebula-keep-on-failure is set. The returned error
+// includes the errors reported by OpenNebula for the VM.
+func (d *Driver) rollback(err error) error {
+	if d.VMID != "" {
+		vm, vmErr := d.getVM()
+		if vmErr != nil {
+			log.Warnf("Can't get the VM %s of the failed machine: %s", d.VMID, vmErr)
+		} else if infoErr := vm.Info(); infoErr != nil {
+			// The VM is terminated anyway, only its errors are missing
+			log.Warnf("Can't get the errors of the VM %s of the failed machine: %s", d.VMID, infoErr)
+		} else if vm.UserTemplate != nil {
+			if vm.UserTemplate.Error != "" {
+				err = fmt.Errorf("%s, VM error: %s", err, vm.UserTemplate.Error)
+			}
+			if vm.UserTemplate.SchedMessage != "" {
+				err = fmt.Errorf("%s, scheduler message: %s", err, vm.UserTemplate.SchedMessage)
+			}
+		}
+
+		if d.KeepOnFailure {
+			log.Warnf("Keeping the VM %s of the failed machine", d.VMID)
+			return err
+		}
+
+		log.Infof("Terminating the VM %s of the failed machine..", d.VMID)
+		if vmErr == nil {
+			vmErr = vm.TerminateHard()
+		}
+		if vmErr != nil {
+			log.Warnf("Can't terminate the VM %s, remove it manually: %s", d.VMID, vmErr)
+		} else {
+			// docker-machine rm must not act on the terminated VM
+			d.VMID = ""
+		}
+	}
+
+	if d.KeepOnFailure {
+		return err
+	}
+
+	for _, path := range []string{d.GetSSHKeyPath(), d.publicSSHKeyPath()} {
+		if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Warnf("Can't remove %s: %s", path, rmErr)
+		}
+	}
+
+	return err
+}
+
+// errNoVM is returned by getVM for the machines without VM, e.g. after a
+// failed Create
+var errNoVM = errors.New("the machine has no VM")
+
+// getVM sets the client and returns the VM of the machine. The machines
+// created by older versions without VMID are looked up by name, once: their
+// ID is then stored.
+func (d *Driver) getVM() (*goca.VM, error) {
+	d.setClient()
+
+	// A VM of the same name may belong to another machine
+	if d.VMID == "" && d.StoresVMID {
+		return nil, errNoVM
+	}
+
+	if d.VMID != "" {
+		id, err := strconv.ParseUint(d.VMID, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("wrong VM ID %q in the machine state: %s", d.VMID, err)
+		}
+		return goca.NewVM(uint(id)), nil
+	}
+
+	vm, err := goca.NewVMFromName(d.MachineName)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Found VM %d by name, storing its ID", vm.ID)
+	d.VMID = strconv.FormatUint(uint64(vm.ID), 10)
+
+	return vm, nil
+}
+
 func (d *Driver) GetURL() (string, error) {
 	ip, err := d.GetIP()
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("tcp://%s:2376", ip), nil
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
 }
 
 func (d *Driver) GetIP() (string, error) {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
 	if err != nil {
 		return "", err
 	}
@@ -521,22 +895,15 @@ func (d *Driver) GetIP() (string, error) {
 		return "", err
 	}
 
-	if len(vm.Template.NIC) > 0 {
-		if vm.Template.NIC[0].IP != "" {
-			d.IPAddress = vm.Template.NIC[0].IP
-		}
-	}
-
-	if d.IPAddress == "" {
-		return "", fmt.Errorf("IP address is not set")
+	if d.IPAddress, err = d.sshAddress(vm); err != nil {
+		return "", err
 	}
 
 	return d.IPAddress, nil
 }
 
 func (d *Driver) GetState() (state.State, error) {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
 	if err != nil {
 		return state.None, err
 	}
@@ -546,131 +913,41 @@ func (d *Driver) GetState() (state.State, error) {
 		return state.None, err
 	}
 
-	vmState, lcmState, err := vm.StateString()
+	vmState, lcmState, err := vm.State()
 	if err != nil {
 		return state.None, err
 	}
 
-	switch vmState {
-	case "INIT", "PENDING", "HOLD", "CLONING":
-		return state.Starting, nil
-	case "ACTIVE":
-		switch lcmState {
-		case "RUNNING",
-
-			// migration is considered running
-			"MIGRATE",
-			"SAVE_MIGRATE",
-			"PROLOG_MIGRATE",
-			"BOOT_MIGRATE",
-
-			// recover --recreate is also considered running
-			"CLEANUP_RESUBMIT",
-
-			// operation on the VMs
-			"HOTPLUG",
-			"HOTPLUG_SNAPSHOT",
-			"HOTPLUG_NIC",
-			"HOTPLUG_SAVEAS",
-			"DISK_SNAPSHOT",
-			"DISK_SNAPSHOT_DELETE":
-
-			return state.Running, nil
-
-		case "LCM_INIT",
-			"PROLOG",
-			"BOOT",
-			"PROLOG_RESUME",
-			"BOOT_UNKNOWN",
-			"BOOT_POWEROFF",
-			"BOOT_SUSPENDED",
-			"BOOT_STOPPED",
-			"PROLOG_UNDEPLOY",
-			"BOOT_UNDEPLOY",
-			"PROLOG_MIGRATE_UNKNOWN":
-
-			return state.Starting, nil
-
-		case "HOTPLUG_SAVEAS_POWEROFF",
-			"HOTPLUG_SAVEAS_SUSPENDED",
-			"HOTPLUG_PROLOG_POWEROFF",
-			"HOTPLUG_EPILOG_POWEROFF",
-			"PROLOG_MIGRATE_POWEROFF",
-			"PROLOG_MIGRATE_SUSPEND",
-			"DISK_SNAPSHOT_POWEROFF",
-			"DISK_SNAPSHOT_REVERT_POWEROFF",
-			"DISK_SNAPSHOT_DELETE_POWEROFF",
-			"DISK_SNAPSHOT_SUSPENDED",
-			"DISK_SNAPSHOT_REVERT_SUSPENDED",
-			"DISK_SNAPSHOT_DELETE_SUSPENDED":
-
-			return state.Stopped, nil
-
-		case "SAVE_SUSPEND",
-			"SAVE_STOP",
-			"EPILOG_STOP",
-			"EPILOG",
-			"SHUTDOWN",
-			"SHUTDOWN_POWEROFF",
-			"SHUTDOWN_UNDEPLOY",
-			"EPILOG_UNDEPLOY":
-			return state.Stopping, nil
-
-		case "UNKNOWN",
-			"CLEANUP_DELETE",
-			"BOOT_FAILURE",
-			"BOOT_MIGRATE_FAILURE",
-			"PROLOG_MIGRATE_FAILURE",
-			"PROLOG_FAILURE",
-			"EPILOG_FAILURE",
-			"EPILOG_STOP_FAILURE",
-			"EPILOG_UNDEPLOY_FAILURE",
-			"PROLOG_MIGRATE_POWEROFF_FAILURE",
-			"PROLOG_MIGRATE_SUSPEND_FAILURE",
-			"BOOT_UNDEPLOY_FAILURE",
-			"BOOT_STOPPED_FAILURE",
-			"PROLOG_RESUME_FAILURE",
-			"PROLOG_UNDEPLOY_FAILURE",
-			"PROLOG_MIGRATE_UNKNOWN_FAILURE":
-
-			return state.Error, nil
-
-		}
-
-	case "POWEROFF", "UNDEPLOYED":
-		return state.Stopped, nil
-	case "STOPPED", "SUSPENDED":
-		return state.Saved, nil
-	case "DONE", "FAILED", "CLONING_FAILURE":
-		return state.Error, nil
+	s, ok := machineState(vmState, lcmState)
+	if !ok {
+		log.Warnf("VM %d is in the state %s %s unknown to the driver", vm.ID, vmState, lcmState)
 	}
 
-	return state.Error, nil
+	return s, nil
 }
 
+// Start resumes the VM. The VM is resized first if the ONE_RESIZE_CPU,
+// ONE_RESIZE_VCPU, ONE_RESIZE_MEMORY or ONE_RESIZE_DISK environment variables
+// request a capacity different from its own.
 func (d *Driver) Start() error {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
 	if err != nil {
 		return err
 	}
 
-	vm.Resume()
+	request, err := readResizeEnv()
+	if err != nil {
+		return err
+	}
+	if err := d.resize(vm, request); err != nil {
+		return err
+	}
 
-	s := state.None
-	retries, _ := strconv.Atoi(d.StartRetries)
-	for retry := 0; retry < retries && s != state.Running; retry++ {
-		s, err = d.GetState()
-		if err != nil {
-			return err
-		}
+	vm.Resume()
 
-		switch s {
-		case state.Error:
-			return errors.New("vM in error state")
-		default:
-			time.Sleep(2 * time.Second)
-		}
+	// Fails early if the VM reaches a failure state
+	if err := vm.WaitRunning(context.Background(), d.waitOptions()); err != nil {
+		return err
 	}
 
 	if d.IPAddress == "" {
@@ -686,8 +963,7 @@ func (d *Driver) Start() error {
 }
 
 func (d *Driver) Stop() error {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
 	if err != nil {
 		return err
 	}
@@ -701,8 +977,10 @@ func (d *Driver) Stop() error {
 }
 
 func (d *Driver) Remove() error {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
+	if err == errNoVM {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -716,8 +994,7 @@ func (d *Driver) Remove() error {
 }
 
 func (d *Driver) Restart() error {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
 	if err != nil {
 		return err
 	}
@@ -731,8 +1008,7 @@ func (d *Driver) Restart() error {
 }
 
 func (d *Driver) Kill() error {
-	d.setClient()
-	vm, err := goca.NewVMFromName(d.MachineName)
+	vm, err := d.getVM()
 	if err != nil {
 		return err
 	}
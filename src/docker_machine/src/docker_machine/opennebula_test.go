@@ -1 +1,1030 @@
 package opennebula
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// newTestDriver returns a driver using server, and creates its VM
+func newTestDriver(t *testing.T, server *gocatest.Server) (*Driver, uint) {
+	d := NewDriver("test", "")
+	d.Xmlrpcurl = server.URL
+	d.User = gocatest.AdminUser
+	d.Password = gocatest.AdminPassword
+	d.StartRetries = defaultStartRetries
+	d.setClient()
+
+	if _, err := goca.CreateVirtualNetwork("NAME = net\nBRIDGE = br0\nVN_MAD = bridge\n"+
+		"AR = [ TYPE = IP4, IP = 10.0.0.2, SIZE = 10 ]", -1); err != nil {
+		t.Fatal(err)
+	}
+	id, err := goca.CreateVM("NAME = test\nCPU = 1\nMEMORY = 64\nNIC = [ NETWORK = net ]", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.VMID = strconv.FormatUint(uint64(id), 10)
+
+	return d, id
+}
+
+// waitState calls GetState until the machine is in the state s
+func waitState(t *testing.T, d *Driver, s state.State) {
+	var current state.State
+	for i := 0; i < 5; i++ {
+		var err error
+		if current, err = d.GetState(); err != nil {
+			t.Fatal(err)
+		}
+		if current == s {
+			return
+		}
+	}
+	t.Fatalf("expected state %s, got %s", s, current)
+}
+
+func TestDriverLifecycle(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, id := newTestDriver(t, server)
+
+	waitState(t, d, state.Starting)
+	waitState(t, d, state.Running)
+
+	ip, err := d.GetIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.0.2" {
+		t.Fatalf("unexpected IP %s", ip)
+	}
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Stopped)
+
+	if err := d.Restart(); err == nil {
+		t.Fatal("restart of a stopped machine should fail")
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	vm := goca.NewVM(id)
+	for i := 0; i < 3; i++ {
+		if err := vm.Info(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, _, _ := vm.State(); s != goca.Done {
+		t.Fatalf("removed VM is %s", s)
+	}
+}
+
+func TestDriverKill(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, id := newTestDriver(t, server)
+	waitState(t, d, state.Running)
+
+	if err := d.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Stopped)
+
+	if err := server.SetVMState(id, goca.Active, goca.BootFailure); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Error)
+}
+
+func TestDriverVMID(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, id := newTestDriver(t, server)
+
+	// The VM is found by its ID, even once renamed
+	if err := goca.NewVM(id).Rename("renamed"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Starting)
+
+	// Machines created by older versions are migrated
+	d.VMID = ""
+	if err := goca.NewVM(id).Rename(d.MachineName); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Running)
+	if d.VMID != strconv.FormatUint(uint64(id), 10) {
+		t.Fatalf("VM ID %d not stored: %q", id, d.VMID)
+	}
+
+	d.VMID = "wrong"
+	if _, err := d.GetState(); err == nil {
+		t.Fatal("GetState should fail with a wrong VM ID")
+	}
+}
+
+func TestDriverAPIErrors(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, _ := newTestDriver(t, server)
+
+	server.FailNext("one.vm.info", &gocatest.Error{Code: goca.OneInternalError, Message: "database locked"})
+	if _, err := d.GetState(); err == nil {
+		t.Fatal("GetState should fail")
+	}
+
+	d.Password = "wrong"
+	if _, err := d.GetState(); err == nil {
+		t.Fatal("GetState should fail with wrong credentials")
+	}
+}
+
+func TestMachineState(t *testing.T) {
+	tests := []struct {
+		vmState  goca.VMState
+		lcmState goca.LCMState
+		expected state.State
+	}{
+		{goca.Init, goca.LcmInit, state.Starting},
+		{goca.Pending, goca.LcmInit, state.Starting},
+		{goca.Hold, goca.LcmInit, state.Starting},
+		{goca.Stopped, goca.LcmInit, state.Saved},
+		{goca.Suspended, goca.LcmInit, state.Saved},
+		{goca.Done, goca.LcmInit, state.Error},
+		{goca.Poweroff, goca.LcmInit, state.Stopped},
+		{goca.Undeployed, goca.LcmInit, state.Stopped},
+		{goca.Cloning, goca.LcmInit, state.Starting},
+		{goca.CloningFailure, goca.LcmInit, state.Error},
+
+		{goca.Active, goca.LcmInit, state.Starting},
+		{goca.Active, goca.Prolog, state.Starting},
+		{goca.Active, goca.Boot, state.Starting},
+		{goca.Active, goca.Running, state.Running},
+		{goca.Active, goca.Migrate, state.Running},
+		{goca.Active, goca.SaveStop, state.Stopping},
+		{goca.Active, goca.SaveSuspend, state.Stopping},
+		{goca.Active, goca.SaveMigrate, state.Running},
+		{goca.Active, goca.PrologMigrate, state.Running},
+		{goca.Active, goca.PrologResume, state.Starting},
+		{goca.Active, goca.EpilogStop, state.Stopping},
+		{goca.Active, goca.Epilog, state.Stopping},
+		{goca.Active, goca.Shutdown, state.Stopping},
+		{goca.Active, goca.CleanupResubmit, state.Running},
+		{goca.Active, goca.Unknown, state.None},
+		{goca.Active, goca.Hotplug, state.Running},
+		{goca.Active, goca.ShutdownPoweroff, state.Stopping},
+		{goca.Active, goca.BootUnknown, state.Starting},
+		{goca.Active, goca.BootPoweroff, state.Starting},
+		{goca.Active, goca.BootSuspended, state.Starting},
+		{goca.Active, goca.BootStopped, state.Starting},
+		{goca.Active, goca.CleanupDelete, state.Stopping},
+		{goca.Active, goca.HotplugSnapshot, state.Running},
+		{goca.Active, goca.HotplugNic, state.Running},
+		{goca.Active, goca.HotplugSaveas, state.Running},
+		{goca.Active, goca.HotplugSaveasPoweroff, state.Stopped},
+		{goca.Active, goca.HotplugSaveasSuspended, state.Saved},
+		{goca.Active, goca.ShutdownUndeploy, state.Stopping},
+		{goca.Active, goca.EpilogUndeploy, state.Stopping},
+		{goca.Active, goca.PrologUndeploy, state.Starting},
+		{goca.Active, goca.BootUndeploy, state.Starting},
+		{goca.Active, goca.HotplugPrologPoweroff, state.Stopped},
+		{goca.Active, goca.HotplugEpilogPoweroff, state.Stopped},
+		{goca.Active, goca.BootMigrate, state.Running},
+		{goca.Active, goca.BootFailure, state.Error},
+		{goca.Active, goca.BootMigrateFailure, state.Error},
+		{goca.Active, goca.PrologMigrateFailure, state.Error},
+		{goca.Active, goca.PrologFailure, state.Error},
+		{goca.Active, goca.EpilogFailure, state.Error},
+		{goca.Active, goca.EpilogStopFailure, state.Error},
+		{goca.Active, goca.EpilogUndeployFailure, state.Error},
+		{goca.Active, goca.PrologMigratePoweroff, state.Stopped},
+		{goca.Active, goca.PrologMigratePoweroffFailure, state.Error},
+		{goca.Active, goca.PrologMigrateSuspend, state.Saved},
+		{goca.Active, goca.PrologMigrateSuspendFailure, state.Error},
+		{goca.Active, goca.BootUndeployFailure, state.Error},
+		{goca.Active, goca.BootStoppedFailure, state.Error},
+		{goca.Active, goca.PrologResumeFailure, state.Error},
+		{goca.Active, goca.PrologUndeployFailure, state.Error},
+		{goca.Active, goca.DiskSnapshotPoweroff, state.Stopped},
+		{goca.Active, goca.DiskSnapshotRevertPoweroff, state.Stopped},
+		{goca.Active, goca.DiskSnapshotDeletePoweroff, state.Stopped},
+		{goca.Active, goca.DiskSnapshotSuspended, state.Saved},
+		{goca.Active, goca.DiskSnapshotRevertSuspended, state.Saved},
+		{goca.Active, goca.DiskSnapshotDeleteSuspended, state.Saved},
+		{goca.Active, goca.DiskSnapshot, state.Running},
+		{goca.Active, goca.DiskSnapshotDelete, state.Running},
+		{goca.Active, goca.PrologMigrateUnknown, state.Starting},
+		{goca.Active, goca.PrologMigrateUnknownFailure, state.Error},
+		{goca.Active, goca.DiskResize, state.Running},
+		{goca.Active, goca.DiskResizePoweroff, state.Stopped},
+		{goca.Active, goca.DiskResizeUndeployed, state.Stopped},
+		{goca.Active, goca.HotplugNicPoweroff, state.Stopped},
+		{goca.Active, goca.HotplugResize, state.Running},
+		{goca.Active, goca.HotplugSaveasUndeployed, state.Stopped},
+		{goca.Active, goca.HotplugSaveasStopped, state.Saved},
+		{goca.Active, goca.Backup, state.Running},
+		{goca.Active, goca.BackupPoweroff, state.Stopped},
+	}
+
+	for _, test := range tests {
+		s, ok := machineState(test.vmState, test.lcmState)
+		if !ok {
+			t.Errorf("%s %s: unknown state", test.vmState, test.lcmState)
+		}
+		if s != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.vmState, test.lcmState, test.expected, s)
+		}
+	}
+
+	// Every state known to goca is mapped
+	for l := goca.LcmInit; l <= goca.BackupPoweroff; l++ {
+		if strings.HasPrefix(l.String(), "LCMState(") {
+			// deprecated value
+			continue
+		}
+		if _, ok := lcmStates[l]; !ok {
+			t.Errorf("LCM state %s isn't mapped", l)
+		}
+	}
+
+	for _, unknown := range []struct {
+		vmState  goca.VMState
+		lcmState goca.LCMState
+	}{
+		{goca.VMState(99), goca.LcmInit},
+		{goca.Active, goca.LCMState(99)},
+		{goca.Active, goca.LCMState(13)},
+	} {
+		if s, ok := machineState(unknown.vmState, unknown.lcmState); ok || s != state.None {
+			t.Errorf("%s %s: expected an unknown state, got %s", unknown.vmState, unknown.lcmState, s)
+		}
+	}
+}
+
+func TestDriverUnknownState(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, id := newTestDriver(t, server)
+
+	for _, lcmState := range []goca.LCMState{goca.Unknown, goca.LCMState(99)} {
+		if err := server.SetVMState(id, goca.Active, lcmState); err != nil {
+			t.Fatal(err)
+		}
+		s, err := d.GetState()
+		if err != nil {
+			t.Fatalf("%s: %s", lcmState, err)
+		}
+		if s != state.None {
+			t.Fatalf("%s: expected no state, got %s", lcmState, s)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	d := &Driver{
+		Networks: []string{
+			"mgmt",
+			"data,security-groups=100:101,model=virtio,ip=10.0.0.5",
+			// An environment variable value, split at the commas
+			`public "lan"`, "owner=bob", "mac=02:00:0a:00:00:05",
+		},
+		NetworkIDs:   []string{"7"},
+		NetworkOwner: "alice",
+	}
+
+	template := goca.NewTemplateBuilder()
+	if err := d.addNICs(template); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `NIC=[
+    NETWORK="mgmt",
+    NETWORK_UNAME="alice" ]
+NIC=[
+    NETWORK="data",
+    SECURITY_GROUPS="100,101",
+    MODEL="virtio",
+    IP="10.0.0.5",
+    NETWORK_UNAME="alice" ]
+NIC=[
+    NETWORK="public \"lan\"",
+    NETWORK_UNAME="bob",
+    MAC="02:00:0a:00:00:05" ]
+NIC=[
+    NETWORK_ID="7" ]`
+	if template.String() != expected {
+		t.Fatalf("unexpected NICs:\n%s", template.String())
+	}
+
+	for _, wrong := range []*Driver{
+		{Networks: []string{"model=virtio"}},
+		{Networks: []string{"data,speed=10"}},
+		{Networks: []string{"data,,model=virtio"}},
+		{NetworkIDs: []string{"data"}},
+	} {
+		if _, err := wrong.nics(); err == nil {
+			t.Errorf("%v %v should not parse", wrong.Networks, wrong.NetworkIDs)
+		}
+	}
+}
+
+func TestParseDisks(t *testing.T) {
+	d := &Driver{
+		Disks: []string{
+			`data "v2",owner=bob,dev-prefix=vd,cache=none`,
+			"12,driver=qcow2",
+			// An environment variable value, split at the commas
+			"volatile", "size=10240", "format=qcow2",
+			"volatile,size=2048,type=swap",
+		},
+	}
+
+	template := goca.NewTemplateBuilder()
+	if err := d.addDisks(template); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `DISK=[
+    IMAGE="data \"v2\"",
+    IMAGE_UNAME="bob",
+    DEV_PREFIX="vd",
+    CACHE="none" ]
+DISK=[
+    IMAGE_ID="12",
+    DRIVER="qcow2" ]
+DISK=[
+    SIZE="10240",
+    FORMAT="qcow2",
+    TYPE="fs" ]
+DISK=[
+    SIZE="2048",
+    TYPE="swap",
+    FORMAT="raw" ]`
+	if template.String() != expected {
+		t.Fatalf("unexpected template:\n%s", template)
+	}
+
+	for _, wrong := range [][]string{
+		{"size=1024"},
+		{"volatile"},
+		{"volatile,size=big"},
+		{"volatile,size=1024,owner=bob"},
+		{"volatile,size=1024,type=block"},
+		{"data,format=raw"},
+		{"data,size=-1"},
+		{"data,bus=scsi"},
+		{"data,,size=1024"},
+	} {
+		if _, err := parseDisks(wrong); err == nil {
+			t.Errorf("%q should fail", wrong)
+		}
+	}
+}
+
+func TestDriverSSHNetwork(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, _ := newTestDriver(t, server)
+
+	if _, err := goca.CreateVirtualNetwork("NAME = data\nBRIDGE = br1\nVN_MAD = bridge\n"+
+		"AR = [ TYPE = IP4_6, IP = 192.168.0.2, SIZE = 10, GLOBAL_PREFIX = \"2001:db8::\" ]", -1); err != nil {
+		t.Fatal(err)
+	}
+	id, err := goca.CreateVM("NAME = ssh\nCPU = 1\nMEMORY = 64\nNIC = [ NETWORK = net ]\nNIC = [ NETWORK = data ]", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.VMID = strconv.FormatUint(uint64(id), 10)
+
+	for _, test := range []struct {
+		network string
+		ipv6    bool
+		ip      string
+	}{
+		{"", false, "10.0.0.3"},
+		{"data", false, "192.168.0.2"},
+		{"1", false, "192.168.0.2"},
+		{"data", true, "2001:db8::c0ff:fea8:2"},
+		{"net", true, ""},
+		{"other", false, ""},
+	} {
+		d.SSHNetwork, d.SSHIPv6 = test.network, test.ipv6
+		ip, err := d.GetIP()
+		if test.ip == "" {
+			if err == nil {
+				t.Errorf("%q ipv6=%v: expected an error, got %s", test.network, test.ipv6, ip)
+			}
+			continue
+		}
+		if err != nil || ip != test.ip {
+			t.Errorf("%q ipv6=%v: expected %s, got %s %v", test.network, test.ipv6, test.ip, ip, err)
+		}
+	}
+
+	d.SSHNetwork, d.SSHIPv6 = "data", true
+	if url, err := d.GetURL(); err != nil || url != "tcp://[2001:db8::c0ff:fea8:2]:2376" {
+		t.Fatalf("unexpected URL %s %v", url, err)
+	}
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "opennebula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestContextAttributes(t *testing.T) {
+	userData := writeTempFile(t, "#cloud-config\npackages: [\"git\"]\n")
+	defer os.Remove(userData)
+	startScript := writeTempFile(t, "#!/bin/bash\necho extra\n")
+	defer os.Remove(startScript)
+
+	d := NewDriver("test", "")
+	d.Context = []string{"network=NO", "set_hostname=docker"}
+	d.UserData = userData
+	d.UserDataEncoding = defaultUserDataEncoding
+	d.StartScript = startScript
+	d.DockerDataDisk = true
+
+	attrs, err := d.contextAttributes("ssh-rsa key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]string{}
+	for _, attr := range attrs {
+		if _, ok := context[attr[0]]; ok {
+			t.Errorf("%s set twice", attr[0])
+		}
+		context[attr[0]] = attr[1]
+	}
+
+	decode := func(key string) string {
+		content, err := base64.StdEncoding.DecodeString(context[key])
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		return string(content)
+	}
+
+	if context["NETWORK"] != "NO" || context["SET_HOSTNAME"] != "docker" || context["DOCKER_SSH_PUBLIC_KEY"] != "ssh-rsa key" {
+		t.Errorf("unexpected context %v", context)
+	}
+	if context["USERDATA_ENCODING"] != "base64" || !strings.Contains(decode("USER_DATA"), "#cloud-config") {
+		t.Errorf("unexpected user data %q", context["USER_DATA"])
+	}
+	if decode("DOCKER_START_SCRIPT_BASE64") != "#!/bin/bash\necho extra\n" {
+		t.Errorf("unexpected start script %q", context["DOCKER_START_SCRIPT_BASE64"])
+	}
+	if script := decode("START_SCRIPT_BASE64"); !strings.HasPrefix(script, contextScript) || !strings.HasSuffix(script, extraScript) {
+		t.Errorf("unexpected context script %q", script)
+	}
+	if script := decode("START_SCRIPT_BASE64"); context["DOCKER_DATA_DISK"] != "YES" || !strings.Contains(script, dataDiskScript) {
+		t.Errorf("unexpected data disk context %q, script %q", context["DOCKER_DATA_DISK"], script)
+	}
+
+	// The double quotes are escaped in the template
+	d.Context = []string{`motd=say "hi"`, `network=YES", FILES="/etc/shadow`}
+	d.UserDataEncoding = "none"
+	template := goca.NewTemplateBuilder()
+	if err := d.addContext(template, "ssh-rsa key"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`MOTD="say \"hi\""`,
+		`NETWORK="YES\", FILES=\"/etc/shadow"`,
+		`USER_DATA="#cloud-config` + "\n" + `packages: [\"git\"]`,
+	} {
+		if !strings.Contains(template.String(), expected) {
+			t.Errorf("%s not found in %s", expected, template)
+		}
+	}
+
+	for _, wrong := range []*Driver{
+		{Context: []string{"START_SCRIPT=reboot"}},
+		{Context: []string{"NOVALUE"}},
+		{UserDataEncoding: "gzip"},
+	} {
+		if err := wrong.checkContext(); err == nil {
+			t.Errorf("%v %q should fail", wrong.Context, wrong.UserDataEncoding)
+		}
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d := &Driver{
+		SchedRequirements:   `HYPERVISOR = "kvm"`,
+		SchedDSRequirements: "FREE_MB > 10240",
+		SchedRank:           "-RUNNING_VMS",
+		VMGroup:             "swarm",
+		VMGroupRole:         "managers",
+		Cluster:             "100",
+		Host:                "node1",
+		Datastore:           "0",
+	}
+	if err := d.checkPlacement(); err != nil {
+		t.Fatal(err)
+	}
+
+	template := goca.NewTemplateBuilder()
+	d.addPlacement(template)
+
+	expected := `SCHED_REQUIREMENTS="(HYPERVISOR = \"kvm\") & (CLUSTER_ID = 100) & (NAME = \"node1\")"
+SCHED_DS_REQUIREMENTS="(FREE_MB > 10240) & (ID = 0)"
+SCHED_RANK="-RUNNING_VMS"
+VMGROUP=[
+    VMGROUP_NAME="swarm",
+    ROLE="managers" ]`
+	if template.String() != expected {
+		t.Fatalf("unexpected template:\n%s", template)
+	}
+
+	// The escaped values are parsed back by OpenNebula
+	template.AddValue("NAME", "placed")
+	template.AddValue("CPU", "1")
+	template.AddValue("MEMORY", "64")
+	goca.SetClient(goca.NewConfig(gocatest.AdminUser, gocatest.AdminPassword, server.URL))
+	id, err := goca.CreateVM(template.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goca.NewVM(id)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	requirements := vm.UserTemplate.Dynamic.GetContentByName("SCHED_REQUIREMENTS")
+	if requirements != `(HYPERVISOR = "kvm") & (CLUSTER_ID = 100) & (NAME = "node1")` {
+		t.Fatalf("unexpected SCHED_REQUIREMENTS %s", requirements)
+	}
+
+	d = &Driver{Cluster: "production", VMGroup: "7", VMGroupRole: "workers"}
+	template = goca.NewTemplateBuilder()
+	d.addPlacement(template)
+
+	expected = `SCHED_REQUIREMENTS="CLUSTER = \"production\""
+VMGROUP=[
+    VMGROUP_ID="7",
+    ROLE="workers" ]`
+	if template.String() != expected {
+		t.Fatalf("unexpected template:\n%s", template)
+	}
+
+	for _, d := range []*Driver{
+		{VMGroup: "swarm"},
+		{VMGroupRole: "managers"},
+		{Host: `node"1`},
+	} {
+		if err := d.checkPlacement(); err == nil {
+			t.Errorf("%+v: checkPlacement should fail", d)
+		}
+	}
+}
+
+func TestPreCreateCheck(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+	goca.SetClient(server.Config())
+
+	imageID, err := goca.CreateImage("NAME = os\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goca.NewImage(imageID).Info(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := goca.CreateImage("NAME = locked\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1); err != nil {
+		t.Fatal(err)
+	}
+	brokenID, err := goca.CreateImage("NAME = broken\nPATH = /tmp/data.qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetImageState(brokenID, goca.ImageError); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := goca.CreateVirtualNetwork("NAME = net\nBRIDGE = br0\nVN_MAD = bridge\n"+
+		"AR = [ TYPE = IP4, IP = 10.0.0.2, SIZE = 10 ]", -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := goca.CreateTemplate("NAME = big\nCPU = 4\nMEMORY = 8192"); err != nil {
+		t.Fatal(err)
+	}
+	uid, err := goca.CreateUser("alice", "secret", "core", []uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goca.NewUser(uid).Quota("VM = [ VMS = 5, CPU = 2, MEMORY = 4096 ]"); err != nil {
+		t.Fatal(err)
+	}
+
+	newDriver := func() *Driver {
+		d := NewDriver("test", "")
+		d.Xmlrpcurl = server.URL
+		d.User = gocatest.AdminUser
+		d.Password = gocatest.AdminPassword
+		d.ImageName = "os"
+		d.Networks = []string{"net"}
+		d.CPU = defaultCPU
+		d.Memory = defaultMemory
+		return d
+	}
+
+	// alice uses the resources of oneadmin
+	asAlice := func(d *Driver) {
+		d.User, d.Password = "alice", "secret"
+		d.ImageOwner, d.NetworkOwner = "oneadmin", "oneadmin"
+		d.Memory = "2048"
+	}
+
+	d := newDriver()
+	d.Disks = []string{"os,size=4096", strconv.FormatUint(uint64(imageID), 10), "volatile,size=1024"}
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+	d = newDriver()
+	asAlice(d)
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		flag   string
+		change func(d *Driver)
+	}{
+		{"--opennebula-xmlrpcurl", func(d *Driver) { d.Xmlrpcurl = "http://127.0.0.1:1/RPC2" }},
+		{"--opennebula-password", func(d *Driver) { d.Password = "wrong" }},
+		{"--opennebula-image-name", func(d *Driver) { d.ImageName = "missing" }},
+		{"--opennebula-image-name", func(d *Driver) { d.ImageName = "locked" }},
+		{"--opennebula-image-name", func(d *Driver) { d.ImageOwner = "alice" }},
+		{"--opennebula-image-id", func(d *Driver) { d.ImageName, d.ImageID = "", "42" }},
+		{"--opennebula-network-name", func(d *Driver) { d.Networks = []string{"net", "missing"} }},
+		{"--opennebula-network-id", func(d *Driver) { d.Networks, d.NetworkIDs = nil, []string{"42"} }},
+		{"--opennebula-ssh-network", func(d *Driver) { d.SSHNetwork = "other" }},
+		{"--opennebula-disk", func(d *Driver) { d.Disks = []string{"volatile,size=1024", "missing"} }},
+		{"--opennebula-disk", func(d *Driver) { d.Disks = []string{"broken"} }},
+		{"--opennebula-disk", func(d *Driver) { d.Disks = []string{"42"} }},
+		{"--opennebula-template-name", func(d *Driver) { d.ImageName, d.TemplateName = "", "missing" }},
+		{"--opennebula-template-name", func(d *Driver) {
+			asAlice(d)
+			d.ImageName, d.TemplateName, d.CPU, d.Memory = "", "oneadmin/big", "", ""
+		}},
+		{"--opennebula-cpu", func(d *Driver) { asAlice(d); d.CPU = "3" }},
+		{"--opennebula-memory", func(d *Driver) { asAlice(d); d.Memory = "8192" }},
+	} {
+		d := newDriver()
+		test.change(d)
+		err := d.PreCreateCheck()
+		if err == nil || !strings.Contains(err.Error(), test.flag) {
+			t.Errorf("expected an error about %s, got %v", test.flag, err)
+		}
+	}
+}
+
+func TestCreateRollback(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		server := gocatest.NewServer()
+		defer server.Close()
+
+		storePath, err := ioutil.TempDir("", "opennebula")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(storePath)
+
+		// The VM of newTestDriver has the name of the machine
+		d, sameNameID := newTestDriver(t, server)
+
+		imageID, err := goca.CreateImage("NAME = os\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := goca.NewImage(imageID).Info(); err != nil {
+			t.Fatal(err)
+		}
+		d.StorePath = storePath
+		d.VMID = ""
+		d.ImageName = "os"
+		d.Networks = []string{"net"}
+		d.CPU, d.Memory = defaultCPU, defaultMemory
+		d.KeepOnFailure = keep
+		if err := os.MkdirAll(filepath.Dir(d.GetSSHKeyPath()), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		// The VM fails to boot
+		id := -1
+		server.Hook("one.vm.info", func(call *gocatest.Call) error {
+			if id >= 0 {
+				return nil
+			}
+			id = call.Params[0].(int)
+			server.SetVMAttribute(uint(id), "ERROR", "Error executing image transfer script")
+			return server.SetVMState(uint(id), goca.Active, goca.BootFailure)
+		})
+
+		err = d.Create()
+		if err == nil || !strings.Contains(err.Error(), "Error executing image transfer script") {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// docker-machine rm doesn't act on the terminated VM, nor on the VM of
+		// the same name
+		if keep != (d.VMID != "") {
+			t.Errorf("keep=%v: VM ID %q in the machine state", keep, d.VMID)
+		}
+		if !keep {
+			if err := d.Remove(); err != nil {
+				t.Errorf("rm of the failed machine: %v", err)
+			}
+			sameName := goca.NewVM(sameNameID)
+			if err := sameName.Info(); err != nil {
+				t.Fatal(err)
+			}
+			if s, _, _ := sameName.State(); s == goca.Done || sameName.Name != d.MachineName {
+				t.Errorf("VM %s of the same name is %s", sameName.Name, s)
+			}
+		}
+
+		vm := goca.NewVM(uint(id))
+		if err := vm.Info(); err != nil {
+			t.Fatal(err)
+		}
+		s, _, _ := vm.State()
+		if keep && s == goca.Done || !keep && s != goca.Done {
+			t.Errorf("keep=%v: VM is %s", keep, s)
+		}
+
+		_, statErr := os.Stat(d.GetSSHKeyPath())
+		if keep == os.IsNotExist(statErr) {
+			t.Errorf("keep=%v: SSH key %v", keep, statErr)
+		}
+	}
+}
+
+// The VM is terminated even if its errors can't be retrieved
+func TestRollbackInfoError(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, id := newTestDriver(t, server)
+
+	server.FailNext("one.vm.info", &gocatest.Error{Code: goca.OneInternalError, Message: "database locked"})
+	if err := d.rollback(errors.New("boot failure")); err == nil || err.Error() != "boot failure" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if d.VMID != "" {
+		t.Errorf("VM ID %q in the machine state", d.VMID)
+	}
+	vm := goca.NewVM(id)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if s, _, _ := vm.State(); s != goca.Done {
+		t.Errorf("VM is %s", s)
+	}
+}
+
+func TestSSHKeys(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+	goca.SetClient(server.Config())
+
+	dir, err := ioutil.TempDir("", "opennebula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "bastion")
+	if err := ssh.GenerateSSHKey(key); err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, "extra.pub")
+	if err := ioutil.WriteFile(extra, []byte(`from="10.0.0.0/8" ssh-ed25519 AAAAC3 admin@bastion`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDriver("test", filepath.Join(dir, "store"))
+	d.SSHKey = key
+	d.SSHAuthorizedKeys = []string{extra}
+	if err := os.MkdirAll(filepath.Dir(d.GetSSHKeyPath()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkSSHKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is copied to the store of the machine
+	if err := d.createSSHKey(); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := ioutil.ReadFile(key)
+	copied, err := ioutil.ReadFile(d.GetSSHKeyPath())
+	if err != nil || string(copied) != string(original) {
+		t.Fatalf("SSH key not copied: %v", err)
+	}
+
+	keys, err := d.authorizedKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != strings.TrimSpace(string(pubKey))+"\n"+`from="10.0.0.0/8" ssh-ed25519 AAAAC3 admin@bastion` {
+		t.Errorf("unexpected authorized keys %q", keys)
+	}
+
+	// The key options are escaped in the template
+	template := goca.NewTemplateBuilder()
+	if err := d.addContext(template, keys); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(template.String(), `from=\"10.0.0.0/8\" ssh-ed25519`) {
+		t.Errorf("unescaped authorized keys in %s", template)
+	}
+
+	// Without context key, the user's key is authorized
+	d.NoContextKey = true
+	if keys, err := d.authorizedKeys(); err != nil || !strings.HasPrefix(keys, userPublicKey+"\n") {
+		t.Errorf("unexpected authorized keys %q, %v", keys, err)
+	}
+
+	user, err := goca.CurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkUserKey(user); err == nil {
+		t.Error("a user without SSH_PUBLIC_KEY should fail")
+	}
+	if err := user.Update(`SSH_PUBLIC_KEY = "ssh-ed25519 AAAAC3 other"`, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkUserKey(user); err == nil {
+		t.Error("a user without the key should fail")
+	}
+	if err := user.Update(`SSH_PUBLIC_KEY = "`+strings.TrimSpace(string(pubKey))+`"`, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkUserKey(user); err != nil {
+		t.Error(err)
+	}
+
+	for _, wrong := range []*Driver{
+		{NoContextKey: true},
+		{SSHKey: filepath.Join(dir, "missing")},
+		{SSHKey: extra},
+		{SSHAuthorizedKeys: []string{filepath.Join(dir, "missing.pub")}},
+	} {
+		if err := wrong.checkSSHKeys(); err == nil {
+			t.Errorf("%+v should fail", wrong)
+		}
+	}
+}
+
+func TestDriverResize(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, _ := newTestDriver(t, server)
+
+	imageID, err := goca.CreateImage("NAME = os\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goca.NewImage(imageID).Info(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := goca.CreateVM("NAME = resized\nCPU = 1\nVCPU = 1\nMEMORY = 64\nDISK = [ IMAGE = os ]", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.VMID = strconv.FormatUint(uint64(id), 10)
+	d.CPU, d.VCPU, d.Memory = "1", "1", "64"
+	waitState(t, d, state.Running)
+
+	// Without request, the capacity changed outside docker-machine is kept
+	vm := goca.NewVM(id)
+	d.CPU, d.Memory = "2", "128"
+	if err := d.resize(vm, resizeRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Running)
+
+	// Nothing to resize
+	if err := d.resize(vm, resizeRequest{CPU: "1", Memory: "64"}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, state.Running)
+
+	os.Setenv("ONE_RESIZE_MEMORY", "128")
+	os.Setenv("ONE_RESIZE_VCPU", "2")
+	defer os.Unsetenv("ONE_RESIZE_MEMORY")
+	defer os.Unsetenv("ONE_RESIZE_VCPU")
+	request, err := readResizeEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request != (resizeRequest{VCPU: "2", Memory: "128"}) {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	request.CPU, request.DiskSize = "0.5", "4096"
+
+	if err := d.resize(vm, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	vcpu, _ := vm.Template.Dynamic.GetContentByName("VCPU")
+	if s, _, _ := vm.State(); s != goca.Poweroff {
+		t.Errorf("resized VM is %s", s)
+	}
+	if vm.Template.CPU != 0.5 || vcpu != "2" || vm.Template.Memory != 128 || vm.Template.Disk[0].Size != 4096 {
+		t.Errorf("VM not resized: CPU %v, VCPU %s, MEMORY %d, disk %d",
+			vm.Template.CPU, vcpu, vm.Template.Memory, vm.Template.Disk[0].Size)
+	}
+	// The request isn't stored with the machine
+	if d.CPU != "2" || d.VCPU != "1" || d.Memory != "128" || d.DiskSize != "" {
+		t.Errorf("capacity of the machine changed: CPU %s, VCPU %s, MEMORY %s, disk %s",
+			d.CPU, d.VCPU, d.Memory, d.DiskSize)
+	}
+
+	// The disk doesn't shrink
+	if err := d.resize(vm, resizeRequest{DiskSize: "1024"}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("ONE_RESIZE_MEMORY", "lots")
+	if _, err := readResizeEnv(); err == nil {
+		t.Error("a wrong ONE_RESIZE_MEMORY should fail")
+	}
+}
+
+func TestWaitOptions(t *testing.T) {
+	for retries, timeout := range map[string]time.Duration{
+		"5":    10 * time.Second,
+		"0":    1200 * time.Second,
+		"-1":   1200 * time.Second,
+		"many": 1200 * time.Second,
+		"":     1200 * time.Second,
+	} {
+		d := &Driver{StartRetries: retries}
+		if opts := d.waitOptions(); opts.Timeout != timeout || opts.Interval != 2*time.Second {
+			t.Errorf("%q: expected a timeout of %s, got %+v", retries, timeout, opts)
+		}
+	}
+}
+
+func TestDriverStartFailure(t *testing.T) {
+	server := gocatest.NewServer()
+	defer server.Close()
+
+	d, id := newTestDriver(t, server)
+	if err := server.SetVMState(id, goca.Active, goca.BootFailure); err != nil {
+		t.Fatal(err)
+	}
+
+	err := d.Start()
+	if _, ok := err.(*goca.FailureStateError); !ok {
+		t.Errorf("FailureStateError expected, got %v", err)
+	}
+}
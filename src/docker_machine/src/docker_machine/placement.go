@@ -0,0 +1,108 @@
+package opennebula
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+// escapeValue escapes the double quotes of a value of the template
+func escapeValue(s string) string {
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+// placementExpression returns the expression selecting a resource by ID or
+// by name: the attribute idAttr is compared to the IDs, nameAttr to the names
+func placementExpression(idAttr, nameAttr, value string) string {
+	if isID(value) {
+		return fmt.Sprintf("%s = %s", idAttr, value)
+	}
+	return fmt.Sprintf("%s = \"%s\"", nameAttr, value)
+}
+
+// joinRequirements joins scheduler expressions with &, it returns "" if there
+// is none
+func joinRequirements(expressions []string) string {
+	if len(expressions) == 1 {
+		return expressions[0]
+	}
+	for i := range expressions {
+		expressions[i] = "(" + expressions[i] + ")"
+	}
+	return strings.Join(expressions, " & ")
+}
+
+// schedRequirements returns the SCHED_REQUIREMENTS and SCHED_DS_REQUIREMENTS
+// of the VM: the ones of the flags, restricted to the cluster, the host and
+// the datastore of the flags
+func (d *Driver) schedRequirements() (string, string) {
+	var host, ds []string
+
+	if d.SchedRequirements != "" {
+		host = append(host, d.SchedRequirements)
+	}
+	if d.Cluster != "" {
+		host = append(host, placementExpression("CLUSTER_ID", "CLUSTER", d.Cluster))
+	}
+	if d.Host != "" {
+		host = append(host, placementExpression("ID", "NAME", d.Host))
+	}
+
+	if d.SchedDSRequirements != "" {
+		ds = append(ds, d.SchedDSRequirements)
+	}
+	if d.Datastore != "" {
+		ds = append(ds, placementExpression("ID", "NAME", d.Datastore))
+	}
+
+	return joinRequirements(host), joinRequirements(ds)
+}
+
+// checkPlacement checks the options of the placement of the VM
+func (d *Driver) checkPlacement() error {
+	if d.VMGroup != "" && d.VMGroupRole == "" {
+		return errors.New("--opennebula-vm-group requires --opennebula-vm-group-role")
+	}
+	if d.VMGroupRole != "" && d.VMGroup == "" {
+		return errors.New("--opennebula-vm-group-role requires --opennebula-vm-group")
+	}
+
+	for _, option := range [][2]string{
+		{"--opennebula-cluster", d.Cluster},
+		{"--opennebula-host", d.Host},
+		{"--opennebula-datastore", d.Datastore},
+	} {
+		if strings.Contains(option[1], `"`) {
+			return fmt.Errorf("%s: %q isn't a valid name", option[0], option[1])
+		}
+	}
+
+	return nil
+}
+
+// addPlacement adds the scheduling attributes and the VM group to template
+func (d *Driver) addPlacement(template *goca.TemplateBuilder) {
+	hostRequirements, dsRequirements := d.schedRequirements()
+
+	if hostRequirements != "" {
+		template.AddValue("SCHED_REQUIREMENTS", escapeValue(hostRequirements))
+	}
+	if dsRequirements != "" {
+		template.AddValue("SCHED_DS_REQUIREMENTS", escapeValue(dsRequirements))
+	}
+	if d.SchedRank != "" {
+		template.AddValue("SCHED_RANK", escapeValue(d.SchedRank))
+	}
+
+	if d.VMGroup != "" {
+		vector := template.NewVector("VMGROUP")
+		if isID(d.VMGroup) {
+			vector.AddValue("VMGROUP_ID", d.VMGroup)
+		} else {
+			vector.AddValue("VMGROUP_NAME", escapeValue(d.VMGroup))
+		}
+		vector.AddValue("ROLE", escapeValue(d.VMGroupRole))
+	}
+}
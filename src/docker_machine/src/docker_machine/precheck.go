@@ -0,0 +1,338 @@
+package opennebula
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+// PreCreateCheck checks the options against OpenNebula before anything is
+// created: the credentials, the SSH key of the user, the template, the
+// images, the networks and the VM quotas
+func (d *Driver) PreCreateCheck() error {
+	d.setClient()
+
+	user, err := goca.CurrentUser()
+	if err != nil {
+		return d.connectionError(err)
+	}
+
+	if d.NoContextKey {
+		if err := d.checkUserKey(user); err != nil {
+			return err
+		}
+	}
+
+	// The resources are looked up like OpenNebula does: among the ones of the
+	// user, unless the name is qualified by its owner
+	resolver := goca.NewResolver(goca.PoolWhoMine, 0)
+
+	cpu, memory := d.CPU, d.Memory
+	cpuFlag, memoryFlag := "--opennebula-cpu", "--opennebula-memory"
+
+	if d.TemplateName != "" || d.TemplateID != "" {
+		template, flag, err := d.checkTemplate(resolver)
+		if err != nil {
+			return err
+		}
+		if cpu == "" {
+			cpu, cpuFlag = strconv.FormatFloat(template.Template.CPU, 'f', -1, 64), flag
+		}
+		if memory == "" {
+			memory, memoryFlag = strconv.Itoa(template.Template.Memory), flag
+		}
+	} else {
+		if err := d.checkImage(resolver); err != nil {
+			return err
+		}
+		if err := d.checkDisks(resolver); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkNetworks(resolver); err != nil {
+		return err
+	}
+
+	return checkVMQuota(user, []quotaRequest{
+		{"VMS", "1", "--opennebula-user"},
+		{"RUNNING_VMS", "1", "--opennebula-user"},
+		{"CPU", cpu, cpuFlag},
+		{"RUNNING_CPU", cpu, cpuFlag},
+		{"MEMORY", memory, memoryFlag},
+		{"RUNNING_MEMORY", memory, memoryFlag},
+	})
+}
+
+// authFlags are the flags of the credentials of each authentication method
+var authFlags = map[string]string{
+	"":              "--opennebula-user and --opennebula-password",
+	"password":      "--opennebula-user and --opennebula-password",
+	"file":          "--opennebula-auth-file",
+	"token":         "--opennebula-user and --opennebula-token",
+	"server_cipher": "--opennebula-user, --opennebula-password and --opennebula-target-user",
+	"x509":          "--opennebula-user, --opennebula-x509-cert and --opennebula-x509-key",
+}
+
+// connectionError names the flags at fault when one.user.info fails
+func (d *Driver) connectionError(err error) error {
+	switch e := err.(type) {
+	case *goca.ClientError:
+		if e.Code != goca.ClientReqAuth {
+			return fmt.Errorf("can't connect to OpenNebula, check --opennebula-xmlrpcurl: %s", err)
+		}
+	case *goca.ResponseError:
+		if e.Code != goca.OneAuthenticationError {
+			return fmt.Errorf("can't get the user information: %s", err)
+		}
+	}
+
+	return fmt.Errorf("authentication failed, check %s: %s", authFlags[d.Auth], err)
+}
+
+// lookupError describes the failure to find the resource of a flag
+func lookupError(flag string, err error) error {
+	if e, ok := err.(*goca.ResponseError); ok && e.Code == goca.OneNoExistsError {
+		return fmt.Errorf("%s: %s", flag, err)
+	}
+
+	switch err.(type) {
+	case *goca.NotFoundError, *goca.AmbiguousError:
+		return fmt.Errorf("%s: %s", flag, err)
+	}
+
+	return fmt.Errorf("%s: can't check the resource: %s", flag, err)
+}
+
+// parseID parses the value of an ID flag
+func parseID(flag, value string) (uint, error) {
+	id, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q is not an ID", flag, value)
+	}
+	return uint(id), nil
+}
+
+// isID returns true if value is an ID, rather than a name
+func isID(value string) bool {
+	_, err := parseID("", value)
+	return err == nil
+}
+
+// qualifiedName returns the name of a resource for a Resolver
+func qualifiedName(name, owner string) string {
+	if owner == "" {
+		return name
+	}
+	return owner + "/" + name
+}
+
+// checkTemplate retrieves the template of the flags, it returns the flag too
+func (d *Driver) checkTemplate(resolver *goca.Resolver) (*goca.Template, string, error) {
+	var (
+		id   uint
+		err  error
+		flag = "--opennebula-template-id"
+	)
+
+	if d.TemplateName != "" {
+		flag = "--opennebula-template-name"
+		id, err = resolver.TemplateID(d.TemplateName)
+		if err != nil {
+			return nil, flag, lookupError(flag, err)
+		}
+	} else if id, err = parseID(flag, d.TemplateID); err != nil {
+		return nil, flag, err
+	}
+
+	template := goca.NewTemplate(id)
+	if err := template.Info(); err != nil {
+		return nil, flag, lookupError(flag, err)
+	}
+
+	return template, flag, nil
+}
+
+// checkImage checks that the image of the flags can be used
+func (d *Driver) checkImage(resolver *goca.Resolver) error {
+	var (
+		id   uint
+		err  error
+		flag = "--opennebula-image-id"
+	)
+
+	if d.ImageName != "" {
+		flag = "--opennebula-image-name"
+		id, err = resolver.ImageID(qualifiedName(d.ImageName, d.ImageOwner))
+		if err != nil {
+			return lookupError(flag, err)
+		}
+	} else if id, err = parseID(flag, d.ImageID); err != nil {
+		return err
+	}
+
+	return checkImageState(flag, id)
+}
+
+// checkImageState checks that the image id can be attached to the machine
+func checkImageState(flag string, id uint) error {
+	image := goca.NewImage(id)
+	if err := image.Info(); err != nil {
+		return lookupError(flag, err)
+	}
+
+	state, err := image.State()
+	if err != nil {
+		return fmt.Errorf("%s: %s", flag, err)
+	}
+
+	switch {
+	case state == goca.ImageReady:
+	case state == goca.ImageUsed && image.PersistentValue == 0:
+	default:
+		return fmt.Errorf("%s: image %d (%s) is %s, it must be READY", flag, image.ID, image.Name, state)
+	}
+
+	return nil
+}
+
+// checkDisks checks that the images of --opennebula-disk can be used
+func (d *Driver) checkDisks(resolver *goca.Resolver) error {
+	disks, err := d.disks()
+	if err != nil {
+		return err
+	}
+
+	for i, disk := range disks {
+		if disk.volatile() {
+			continue
+		}
+
+		var (
+			id   uint
+			err  error
+			flag = fmt.Sprintf("--opennebula-disk: disk %d", i)
+		)
+
+		if name := disk.get("IMAGE"); name != "" {
+			id, err = resolver.ImageID(qualifiedName(name, disk.get("IMAGE_UNAME")))
+			if err != nil {
+				return lookupError(flag, err)
+			}
+		} else if id, err = parseID(flag, disk.get("IMAGE_ID")); err != nil {
+			return err
+		}
+
+		if err := checkImageState(flag, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkNetworks checks that the networks of the flags exist, and that the
+// network of --opennebula-ssh-network is one of them
+func (d *Driver) checkNetworks(resolver *goca.Resolver) error {
+	nics, err := d.nics()
+	if err != nil {
+		return err
+	}
+
+	sshNetwork := d.SSHNetwork == "" || len(nics) == 0
+	for _, n := range nics {
+		var (
+			id   uint
+			flag = "--opennebula-network-id"
+		)
+
+		if name := n.get("NETWORK"); name != "" {
+			flag = "--opennebula-network-name"
+			id, err = resolver.VirtualNetworkID(qualifiedName(name, n.get("NETWORK_UNAME")))
+			if err != nil {
+				return lookupError(flag, err)
+			}
+		} else if id, err = parseID(flag, n.get("NETWORK_ID")); err != nil {
+			return err
+		}
+
+		vnet := goca.NewVirtualNetwork(id)
+		if err := vnet.Info(); err != nil {
+			return lookupError(flag, err)
+		}
+
+		if d.SSHNetwork == vnet.Name || d.SSHNetwork == strconv.FormatUint(uint64(vnet.ID), 10) {
+			sshNetwork = true
+		}
+	}
+
+	if !sshNetwork {
+		return fmt.Errorf("--opennebula-ssh-network: %q is not one of the networks of the machine", d.SSHNetwork)
+	}
+
+	return nil
+}
+
+// quotaRequest is the amount of a VM quota the machine needs
+type quotaRequest struct {
+	key   string
+	value string
+	flag  string
+}
+
+// checkVMQuota checks that the VM quota of the user allows the requests. The
+// group quotas aren't checked.
+func checkVMQuota(user *goca.User, requests []quotaRequest) error {
+	limits, used := map[string]string{}, map[string]string{}
+
+	if len(user.DefaultUserQuotas.VMQuotas) > 0 {
+		q := user.DefaultUserQuotas.VMQuotas[0]
+		limits["VMS"], limits["CPU"], limits["MEMORY"] = q.VMs, q.CPU, q.Memory
+		limits["RUNNING_VMS"], limits["RUNNING_CPU"], limits["RUNNING_MEMORY"] = q.RunningVMs, q.RunningCpu, q.RunningMemory
+	}
+
+	if len(user.VMQuotas) > 0 {
+		q := user.VMQuotas[0]
+		for key, limit := range map[string]string{
+			"VMS": q.VMs, "CPU": q.CPU, "MEMORY": q.Memory,
+			"RUNNING_VMS": q.RunningVMs, "RUNNING_CPU": q.RunningCpu, "RUNNING_MEMORY": q.RunningMemory,
+		} {
+			// -1 is the default quota
+			if limit != "" && limit != "-1" {
+				limits[key] = limit
+			}
+		}
+		used["VMS"], used["CPU"], used["MEMORY"] = q.VMsUsed, q.CPUUsed, q.MemoryUsed
+		used["RUNNING_VMS"], used["RUNNING_CPU"], used["RUNNING_MEMORY"] = q.RunningVMsUsed, q.RunningCpuUsed, q.RunningMemoryUsed
+	}
+
+	for _, req := range requests {
+		if req.value == "" {
+			continue
+		}
+
+		requested, err := strconv.ParseFloat(req.value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", req.flag, req.value)
+		}
+
+		// Negative limits are the default quota, if undefined, or unlimited
+		limit, err := strconv.ParseFloat(limits[req.key], 64)
+		if err != nil || limit < 0 {
+			continue
+		}
+		usage, _ := strconv.ParseFloat(used[req.key], 64)
+
+		if usage+requested > limit {
+			return fmt.Errorf("%s: the machine needs %s %s, but user %s uses %s of a %s quota of %s",
+				req.flag, req.value, req.key, user.Name, formatFloat(usage), req.key, formatFloat(limit))
+		}
+	}
+
+	return nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
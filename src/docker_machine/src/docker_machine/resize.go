@@ -0,0 +1,194 @@
+package opennebula
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// resizeRequest is the capacity requested with the ONE_RESIZE_* environment
+// variables for one docker-machine start. It isn't stored with the machine:
+// the capacity is only enforced when it's requested.
+type resizeRequest struct {
+	CPU      string
+	VCPU     string
+	Memory   string
+	DiskSize string
+}
+
+// readResizeEnv returns the capacity requested with the ONE_RESIZE_*
+// environment variables
+func readResizeEnv() (resizeRequest, error) {
+	var r resizeRequest
+
+	for _, env := range []struct {
+		name  string
+		value *string
+	}{
+		{"ONE_RESIZE_CPU", &r.CPU},
+		{"ONE_RESIZE_VCPU", &r.VCPU},
+		{"ONE_RESIZE_MEMORY", &r.Memory},
+		{"ONE_RESIZE_DISK", &r.DiskSize},
+	} {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		if number, err := strconv.ParseFloat(value, 64); err != nil || number <= 0 {
+			return resizeRequest{}, fmt.Errorf("%s: %q is not a positive number", env.name, value)
+		}
+		*env.value = value
+	}
+
+	return r, nil
+}
+
+// waitOptions returns the options of the waits of the VM, bounded by
+// --opennebula-start-retries, or by its default if it isn't a positive number:
+// a zero timeout would wait forever
+func (d *Driver) waitOptions() goca.WaitOptions {
+	retries, err := strconv.Atoi(d.StartRetries)
+	if err != nil || retries <= 0 {
+		retries, _ = strconv.Atoi(defaultStartRetries)
+	}
+	return goca.WaitOptions{
+		Interval: 2 * time.Second,
+		Timeout:  time.Duration(retries) * 2 * time.Second,
+	}
+}
+
+// template returns the template of the requested capacity which differs from
+// the one of vm, or "" if there is none
+func (r resizeRequest) template(vm *goca.VM) (string, error) {
+	template := goca.NewTemplateBuilder()
+	changed := false
+
+	if r.CPU != "" {
+		cpu, _ := strconv.ParseFloat(r.CPU, 64)
+		if cpu != vm.Template.CPU {
+			template.AddValue("CPU", r.CPU)
+			changed = true
+		}
+	}
+
+	if r.VCPU != "" {
+		vcpu, _ := vm.Template.Dynamic.GetContentByName("VCPU")
+		if r.VCPU != vcpu {
+			template.AddValue("VCPU", r.VCPU)
+			changed = true
+		}
+	}
+
+	if r.Memory != "" {
+		memory, err := strconv.Atoi(r.Memory)
+		if err != nil {
+			return "", fmt.Errorf("ONE_RESIZE_MEMORY: %q is not a number of MB", r.Memory)
+		}
+		if memory != vm.Template.Memory {
+			template.AddValue("MEMORY", r.Memory)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return "", nil
+	}
+	return template.String(), nil
+}
+
+// diskSize returns the requested size of the OS disk of vm, or "" if it isn't
+// grown. The disks don't shrink.
+func (r resizeRequest) diskSize(vm *goca.VM) (string, error) {
+	if r.DiskSize == "" || len(vm.Template.Disk) == 0 {
+		return "", nil
+	}
+
+	size, err := strconv.Atoi(r.DiskSize)
+	if err != nil {
+		return "", fmt.Errorf("ONE_RESIZE_DISK: %q is not a number of MB", r.DiskSize)
+	}
+
+	switch current := vm.Template.Disk[0].Size; {
+	case size > current:
+		return r.DiskSize, nil
+	case size < current:
+		log.Warnf("The OS disk of %d MB can't shrink to %d MB", current, size)
+	}
+
+	return "", nil
+}
+
+// resize applies the requested capacity to vm: it powers the VM off, resizes
+// it and grows its OS disk. The VM is left powered off, or undeployed, for
+// Start to resume it. Nothing is done without request.
+func (d *Driver) resize(vm *goca.VM, r resizeRequest) error {
+	if r == (resizeRequest{}) {
+		return nil
+	}
+
+	if err := vm.Info(); err != nil {
+		return err
+	}
+
+	template, err := r.template(vm)
+	if err != nil {
+		return err
+	}
+	diskSize, err := r.diskSize(vm)
+	if err != nil {
+		return err
+	}
+	if template == "" && diskSize == "" {
+		return nil
+	}
+
+	vmState, lcmState, err := vm.State()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch {
+	case vmState == goca.Poweroff, vmState == goca.Undeployed:
+	case vmState == goca.Active && lcmState == goca.Running:
+		log.Infof("Powering off the VM %d to resize it..", vm.ID)
+		if err := vm.Poweroff(); err != nil {
+			return err
+		}
+		if err := vm.WaitPoweroff(ctx, d.waitOptions()); err != nil {
+			return err
+		}
+	default:
+		log.Warnf("The VM %d can't be resized in the state %s %s", vm.ID, vmState, lcmState)
+		return nil
+	}
+
+	if template != "" {
+		log.Infof("Resizing the VM %d..", vm.ID)
+		if err := vm.Resize(template, true); err != nil {
+			return err
+		}
+	}
+
+	if diskSize != "" {
+		log.Infof("Growing the OS disk of the VM %d to %s MB..", vm.ID, diskSize)
+		if err := vm.DiskResize(vm.Template.Disk[0].ID, diskSize); err != nil {
+			return err
+		}
+
+		// The disk is resized in the DISK_RESIZE_POWEROFF or
+		// DISK_RESIZE_UNDEPLOYED state
+		return vm.WaitForState(ctx, func(vm *goca.VM) bool {
+			vmState := goca.VMState(vm.StateRaw)
+			return vmState == goca.Poweroff || vmState == goca.Undeployed
+		}, d.waitOptions())
+	}
+
+	return nil
+}
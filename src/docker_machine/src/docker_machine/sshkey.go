@@ -0,0 +1,118 @@
+package opennebula
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/docker/machine/libmachine/ssh"
+)
+
+// userPublicKey is the SSH_PUBLIC_KEY of the OpenNebula user, in the context
+const userPublicKey = "$USER[SSH_PUBLIC_KEY]"
+
+// checkSSHKeys checks the options of the SSH keys
+func (d *Driver) checkSSHKeys() error {
+	// A generated key can only be authorized through the context
+	if d.NoContextKey && d.SSHKey == "" {
+		return errors.New("--opennebula-ssh-no-context-key requires --opennebula-ssh-key-path")
+	}
+
+	if d.SSHKey != "" {
+		if _, err := os.Stat(d.SSHKey); err != nil {
+			return fmt.Errorf("--opennebula-ssh-key-path: %s", err)
+		}
+		if _, err := os.Stat(d.SSHKey + ".pub"); err != nil && !d.NoContextKey {
+			return fmt.Errorf("--opennebula-ssh-key-path: the public key is required: %s", err)
+		}
+	}
+
+	for _, path := range d.SSHAuthorizedKeys {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("--opennebula-ssh-authorized-keys: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// createSSHKey creates the SSH key of the machine: a copy of the key of
+// --opennebula-ssh-key-path, or a new one
+func (d *Driver) createSSHKey() error {
+	if d.SSHKey == "" {
+		log.Infof("Creating SSH key..")
+		return ssh.GenerateSSHKey(d.GetSSHKeyPath())
+	}
+
+	log.Infof("Copying SSH key %s..", d.SSHKey)
+	if err := mcnutils.CopyFile(d.SSHKey, d.GetSSHKeyPath()); err != nil {
+		return fmt.Errorf("--opennebula-ssh-key-path: %s", err)
+	}
+	if err := os.Chmod(d.GetSSHKeyPath(), 0600); err != nil {
+		return err
+	}
+
+	// The public key isn't used without context key
+	err := mcnutils.CopyFile(d.SSHKey+".pub", d.publicSSHKeyPath())
+	if err != nil && !(d.NoContextKey && os.IsNotExist(err)) {
+		return fmt.Errorf("--opennebula-ssh-key-path: %s", err)
+	}
+
+	return nil
+}
+
+// authorizedKeys returns the public keys authorized for the SSH user, one per
+// line: the key of the machine, or the SSH_PUBLIC_KEY of the OpenNebula user
+// with --opennebula-ssh-no-context-key, then the keys of
+// --opennebula-ssh-authorized-keys, with their options. addContext escapes
+// their double quotes.
+func (d *Driver) authorizedKeys() (string, error) {
+	var keys []string
+
+	if d.NoContextKey {
+		keys = append(keys, userPublicKey)
+	} else {
+		key, err := ioutil.ReadFile(d.publicSSHKeyPath())
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, strings.TrimSpace(string(key)))
+	}
+
+	for _, path := range d.SSHAuthorizedKeys {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("--opennebula-ssh-authorized-keys: %s", err)
+		}
+		keys = append(keys, strings.TrimSpace(string(content)))
+	}
+
+	return strings.Join(keys, "\n"), nil
+}
+
+// checkUserKey checks that the SSH_PUBLIC_KEY of the OpenNebula user includes
+// the key of --opennebula-ssh-key-path, for --opennebula-ssh-no-context-key
+func (d *Driver) checkUserKey(user *goca.User) error {
+	userKeys, _ := user.Template.Dynamic.GetContentByName("SSH_PUBLIC_KEY")
+	if strings.TrimSpace(userKeys) == "" {
+		return fmt.Errorf("--opennebula-ssh-no-context-key: user %s has no SSH_PUBLIC_KEY", user.Name)
+	}
+
+	// Without public key file, the key can't be compared
+	key, err := ioutil.ReadFile(d.SSHKey + ".pub")
+	if err != nil {
+		return nil
+	}
+
+	fields := strings.Fields(string(key))
+	if len(fields) < 2 || !strings.Contains(userKeys, fields[1]) {
+		return fmt.Errorf("--opennebula-ssh-no-context-key: the SSH_PUBLIC_KEY of user %s doesn't include the key %s.pub", user.Name, d.SSHKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package opennebula
+
+import (
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// vmStates maps the states of the VMs, except ACTIVE, to the machine states
+var vmStates = map[goca.VMState]state.State{
+	goca.Init:           state.Starting,
+	goca.Pending:        state.Starting,
+	goca.Hold:           state.Starting,
+	goca.Cloning:        state.Starting,
+	goca.Stopped:        state.Saved,
+	goca.Suspended:      state.Saved,
+	goca.Done:           state.Error,
+	goca.Poweroff:       state.Stopped,
+	goca.Undeployed:     state.Stopped,
+	goca.CloningFailure: state.Error,
+}
+
+// lcmStates maps the LCM states of the ACTIVE VMs to the machine states
+var lcmStates = map[goca.LCMState]state.State{
+	goca.LcmInit:              state.Starting,
+	goca.Prolog:               state.Starting,
+	goca.Boot:                 state.Starting,
+	goca.PrologResume:         state.Starting,
+	goca.BootUnknown:          state.Starting,
+	goca.BootPoweroff:         state.Starting,
+	goca.BootSuspended:        state.Starting,
+	goca.BootStopped:          state.Starting,
+	goca.PrologUndeploy:       state.Starting,
+	goca.BootUndeploy:         state.Starting,
+	goca.PrologMigrateUnknown: state.Starting,
+
+	goca.Running: state.Running,
+
+	// migration is considered running
+	goca.Migrate:       state.Running,
+	goca.SaveMigrate:   state.Running,
+	goca.PrologMigrate: state.Running,
+	goca.BootMigrate:   state.Running,
+
+	// recover --recreate is also considered running
+	goca.CleanupResubmit: state.Running,
+
+	// operations on the running VMs
+	goca.Hotplug:            state.Running,
+	goca.HotplugSnapshot:    state.Running,
+	goca.HotplugNic:         state.Running,
+	goca.HotplugSaveas:      state.Running,
+	goca.HotplugResize:      state.Running,
+	goca.DiskSnapshot:       state.Running,
+	goca.DiskSnapshotDelete: state.Running,
+	goca.DiskResize:         state.Running,
+	goca.Backup:             state.Running,
+
+	// operations on the powered off or undeployed VMs
+	goca.HotplugSaveasPoweroff:      state.Stopped,
+	goca.HotplugPrologPoweroff:      state.Stopped,
+	goca.HotplugEpilogPoweroff:      state.Stopped,
+	goca.PrologMigratePoweroff:      state.Stopped,
+	goca.DiskSnapshotPoweroff:       state.Stopped,
+	goca.DiskSnapshotRevertPoweroff: state.Stopped,
+	goca.DiskSnapshotDeletePoweroff: state.Stopped,
+	goca.DiskResizePoweroff:         state.Stopped,
+	goca.DiskResizeUndeployed:       state.Stopped,
+	goca.HotplugNicPoweroff:         state.Stopped,
+	goca.HotplugSaveasUndeployed:    state.Stopped,
+	goca.BackupPoweroff:             state.Stopped,
+
+	// operations on the suspended or stopped VMs
+	goca.HotplugSaveasSuspended:      state.Saved,
+	goca.PrologMigrateSuspend:        state.Saved,
+	goca.DiskSnapshotSuspended:       state.Saved,
+	goca.DiskSnapshotRevertSuspended: state.Saved,
+	goca.DiskSnapshotDeleteSuspended: state.Saved,
+	goca.HotplugSaveasStopped:        state.Saved,
+
+	goca.SaveStop:         state.Stopping,
+	goca.SaveSuspend:      state.Stopping,
+	goca.EpilogStop:       state.Stopping,
+	goca.Epilog:           state.Stopping,
+	goca.Shutdown:         state.Stopping,
+	goca.ShutdownPoweroff: state.Stopping,
+	goca.ShutdownUndeploy: state.Stopping,
+	goca.EpilogUndeploy:   state.Stopping,
+	goca.CleanupDelete:    state.Stopping,
+
+	// the VM isn't found by the monitoring of its host, which may be a
+	// transient issue: the state of the machine is unknown until it's found
+	goca.Unknown: state.None,
+
+	goca.BootFailure:                  state.Error,
+	goca.BootMigrateFailure:           state.Error,
+	goca.PrologMigrateFailure:         state.Error,
+	goca.PrologFailure:                state.Error,
+	goca.EpilogFailure:                state.Error,
+	goca.EpilogStopFailure:            state.Error,
+	goca.EpilogUndeployFailure:        state.Error,
+	goca.PrologMigratePoweroffFailure: state.Error,
+	goca.PrologMigrateSuspendFailure:  state.Error,
+	goca.BootUndeployFailure:          state.Error,
+	goca.BootStoppedFailure:           state.Error,
+	goca.PrologResumeFailure:          state.Error,
+	goca.PrologUndeployFailure:        state.Error,
+	goca.PrologMigrateUnknownFailure:  state.Error,
+}
+
+// machineState returns the machine state of a VM. The states unknown to the
+// driver, from a newer OpenNebula, are returned as state.None, and ok is false.
+func machineState(vmState goca.VMState, lcmState goca.LCMState) (s state.State, ok bool) {
+	if vmState == goca.Active {
+		s, ok = lcmStates[lcmState]
+	} else {
+		s, ok = vmStates[vmState]
+	}
+	if !ok {
+		return state.None, false
+	}
+	return s, true
+}
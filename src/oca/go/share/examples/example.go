@@ -18,7 +18,7 @@ package main
             log.Fatal(err)
         }
 
-        name, _ := vm.XPath("/VM/NAME")
+        name, err := vm.XPath("/VM/NAME")
         if err != nil {
             log.Fatal(err)
         }
@@ -0,0 +1,300 @@
+package goca
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthProvider provides the session string sent with each call, in the
+// format <user>:<secret>. It's called before each call, so implementations
+// fetching the secret from an external service should cache it.
+type AuthProvider interface {
+	Session(ctx context.Context) (string, error)
+}
+
+// AuthProviderFunc adapts a function to the AuthProvider interface, e.g. to
+// fetch the credentials from a secret store
+type AuthProviderFunc func(ctx context.Context) (string, error)
+
+// Session calls f
+func (f AuthProviderFunc) Session(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// PasswordAuth authenticates with a user name and a password, for the core
+// auth driver
+type PasswordAuth struct {
+	User     string
+	Password string
+}
+
+// Session returns <user>:<password>
+func (a *PasswordAuth) Session(ctx context.Context) (string, error) {
+	if a.User == "" {
+		return "", errors.New("password auth: empty user name")
+	}
+	return a.User + ":" + a.Password, nil
+}
+
+func (a *PasswordAuth) passwordCredentials() {}
+
+// passwordCredentials is implemented by the providers of <user>:<password>
+// session strings, the only ones exchanged for login tokens. The other ones,
+// e.g. the server_cipher tokens, don't authenticate the user before the colon.
+type passwordCredentials interface {
+	passwordCredentials()
+}
+
+// LoginTokenAuth authenticates with a login token created beforehand, e.g.
+// by oneuser token-create
+type LoginTokenAuth struct {
+	User  string
+	Token string
+}
+
+// Session returns <user>:<token>
+func (a *LoginTokenAuth) Session(ctx context.Context) (string, error) {
+	if a.User == "" || a.Token == "" {
+		return "", errors.New("login token auth: empty user name or token")
+	}
+	return a.User + ":" + a.Token, nil
+}
+
+// FileAuth reads the session string from a file in the ONE_AUTH format: a
+// single <user>:<secret> line, where the secret is a password or a token
+// generated by oneuser login. The file is read at the first call.
+type FileAuth struct {
+	// Path of the file. Defaults to $ONE_AUTH, or ~/.one/one_auth.
+	Path string
+
+	mu      sync.Mutex
+	session string
+}
+
+// Session returns the content of the file, or an error describing why it
+// can't be used
+func (a *FileAuth) Session(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.session != "" {
+		return a.session, nil
+	}
+
+	path := a.Path
+	if path == "" {
+		path = defaultOneAuthPath()
+	}
+
+	session, err := readOneAuthFile(path)
+	if err != nil {
+		return "", err
+	}
+	a.session = session
+
+	return session, nil
+}
+
+func defaultOneAuthPath() string {
+	if path := os.Getenv("ONE_AUTH"); path != "" {
+		return path
+	}
+	return os.Getenv("HOME") + "/.one/one_auth"
+}
+
+// readOneAuthFile reads a <user>:<secret> line from path
+func readOneAuthFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("auth file: %s", err)
+	}
+
+	session := strings.TrimSpace(string(content))
+	if session == "" {
+		return "", fmt.Errorf("auth file %s: empty file", path)
+	}
+	if strings.ContainsAny(session, "\r\n") {
+		return "", fmt.Errorf("auth file %s: a single line is expected", path)
+	}
+	if i := strings.Index(session, ":"); i <= 0 || i == len(session)-1 {
+		return "", fmt.Errorf("auth file %s: bad format, <user>:<password> expected", path)
+	}
+
+	return session, nil
+}
+
+// ServerCipherAuth authenticates with the server_cipher auth driver, used by
+// the OpenNebula servers (e.g. Sunstone) to perform calls on behalf of
+// users. The tokens are built like the ones of server_cipher_auth.rb.
+type ServerCipherAuth struct {
+	// ServerUser and ServerPassword are the credentials of the server user
+	ServerUser     string
+	ServerPassword string
+
+	// TargetUser is the user the calls are performed for. Defaults to
+	// ServerUser.
+	TargetUser string
+
+	// Lifetime of the tokens. Defaults to DefaultLoginLifetime.
+	Lifetime time.Duration
+
+	// now is used by the tests
+	now func() time.Time
+}
+
+// Session returns a new token <server user>:<target user>:<encrypted token>
+func (a *ServerCipherAuth) Session(ctx context.Context) (string, error) {
+	if a.ServerUser == "" || a.ServerPassword == "" {
+		return "", errors.New("server_cipher auth: empty server user name or password")
+	}
+
+	target := a.TargetUser
+	if target == "" {
+		target = a.ServerUser
+	}
+
+	lifetime := a.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultLoginLifetime
+	}
+
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	expires := now().Add(lifetime).Unix()
+
+	token, err := serverCipherEncrypt(a.ServerPassword,
+		fmt.Sprintf("%s:%s:%d", a.ServerUser, target, expires))
+	if err != nil {
+		return "", err
+	}
+
+	return a.ServerUser + ":" + target + ":" + token, nil
+}
+
+// serverCipherEncrypt encrypts text with AES-256-CBC, with the first 32 chars
+// of the SHA1 hex digest of password as the key and a zero IV, and returns
+// it in base64
+func serverCipherEncrypt(password, text string) (string, error) {
+	digest := sha1.Sum([]byte(password))
+	key := []byte(hex.EncodeToString(digest[:])[:32])
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(text)%aes.BlockSize
+	data := append([]byte(text), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	iv := make([]byte, aes.BlockSize)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// X509Auth authenticates with the x509 auth driver. The tokens are built like
+// the ones of x509_auth.rb, signed with the private key of the certificate.
+type X509Auth struct {
+	User string
+
+	// CertPEM is the certificate chain of the user, the user certificate
+	// first. KeyPEM is the RSA private key of the user certificate.
+	CertPEM []byte
+	KeyPEM  []byte
+
+	// Lifetime of the tokens. 0 means until the expiration of the
+	// certificate.
+	Lifetime time.Duration
+}
+
+// Session returns <user>:<token>
+func (a *X509Auth) Session(ctx context.Context) (string, error) {
+	var certs []*x509.Certificate
+	var pems []string
+
+	rest := a.CertPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("x509 auth: %s", err)
+		}
+		certs = append(certs, cert)
+		pems = append(pems, string(pem.EncodeToMemory(block)))
+	}
+	if len(certs) == 0 {
+		return "", errors.New("x509 auth: no certificate found")
+	}
+
+	block, _ := pem.Decode(a.KeyPEM)
+	if block == nil {
+		return "", errors.New("x509 auth: no private key found")
+	}
+	key, err := parseRSAKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("x509 auth: %s", err)
+	}
+
+	expires := certs[0].NotAfter.Unix()
+	if a.Lifetime > 0 {
+		expires = time.Now().Add(a.Lifetime).Unix()
+	}
+
+	// Raw PKCS#1 v1.5 signature, like OpenSSL private_encrypt
+	signed, err := rsa.SignPKCS1v15(nil, key, crypto.Hash(0), []byte(fmt.Sprintf("%s:%d", a.User, expires)))
+	if err != nil {
+		return "", fmt.Errorf("x509 auth: %s", err)
+	}
+
+	token := base64.StdEncoding.EncodeToString(signed) + ":" + strings.Join(pems, ":")
+
+	return a.User + ":" + base64.StdEncoding.EncodeToString([]byte(token)), nil
+}
+
+func parseRSAKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("RSA private key expected")
+	}
+
+	return rsaKey, nil
+}
+
+// staticAuth is the provider of OneConfig.Token
+type staticAuth string
+
+func (a staticAuth) Session(ctx context.Context) (string, error) {
+	return string(a), nil
+}
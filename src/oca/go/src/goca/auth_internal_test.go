@@ -0,0 +1,51 @@
+package goca
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerCipherAuth(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	auth := &ServerCipherAuth{
+		ServerUser:     "serveradmin",
+		ServerPassword: "secret",
+		TargetUser:     "user",
+		Lifetime:       time.Hour,
+		now:            func() time.Time { return now },
+	}
+
+	session, err := auth.Session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.SplitN(session, ":", 3)
+	if len(parts) != 3 || parts[0] != "serveradmin" || parts[1] != "user" {
+		t.Fatalf("unexpected session %q", session)
+	}
+
+	// Decrypt like server_cipher_auth.rb
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum([]byte("secret"))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(digest[:])[:32]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(data, data)
+	data = data[:len(data)-int(data[len(data)-1])]
+
+	if expected := "serveradmin:user:1500003600"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
@@ -0,0 +1,166 @@
+package goca_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+func TestFileAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		content string
+		session string
+		err     string
+	}{
+		{content: "user:pass\n", session: "user:pass"},
+		{content: "", err: "empty file"},
+		{content: "user\n", err: "bad format"},
+		{content: "user:pass\nother:pass\n", err: "single line"},
+	} {
+		path := filepath.Join(dir, "one_auth")
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := (&goca.FileAuth{Path: path}).Session(context.Background())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.content, test.err, err)
+			}
+			continue
+		}
+		if err != nil || session != test.session {
+			t.Errorf("%q: expected %q, got %q, %v", test.content, test.session, session, err)
+		}
+	}
+
+	// The calls report why the file can't be used
+	os.Setenv("ONE_AUTH", filepath.Join(dir, "missing"))
+	defer os.Unsetenv("ONE_AUTH")
+
+	server, restore := newTestServer()
+	defer restore()
+	server.Hook("", func(call *gocatest.Call) error {
+		t.Errorf("unexpected call %s", call.Method)
+		return nil
+	})
+
+	goca.SetClient(goca.NewConfig("", "", server.URL))
+	err = goca.NewVM(1).Info()
+	clientErr, ok := err.(*goca.ClientError)
+	if !ok || clientErr.Code != goca.ClientReqAuth || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestAuthProvider(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+	server.Handle("one.vm.info", func(*gocatest.Call) (interface{}, error) {
+		return "<VM><ID>1</ID></VM>", nil
+	})
+
+	secret := "user:secret1"
+	goca.SetClient(goca.OneConfig{XmlrpcURL: server.URL, Auth: goca.AuthProviderFunc(func(ctx context.Context) (string, error) {
+		if secret == "" {
+			return "", errors.New("sealed")
+		}
+		return secret, nil
+	})})
+
+	vm := goca.NewVM(1)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	secret = "user:secret2"
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	var sessions []string
+	for _, call := range server.Calls() {
+		sessions = append(sessions, call.Session)
+	}
+	if strings.Join(sessions, ",") != "user:secret1,user:secret2" {
+		t.Errorf("unexpected sessions %v", sessions)
+	}
+
+	secret = ""
+	if err := vm.Info(); err == nil || !strings.Contains(err.Error(), "sealed") {
+		t.Errorf("expected the provider error, got %v", err)
+	}
+}
+
+func TestX509Auth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "user"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Unix(2000000000, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	session, err := (&goca.X509Auth{User: "user", CertPEM: certPEM, KeyPEM: keyPEM}).Session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.SplitN(session, ":", 2)
+	if len(parts) != 2 || parts[0] != "user" {
+		t.Fatalf("unexpected session %q", session)
+	}
+	token, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// <signed text>:<certificate>
+	parts = strings.SplitN(string(token), ":", 2)
+	if len(parts) != 2 || !bytes.Equal([]byte(parts[1]), certPEM) {
+		t.Fatalf("unexpected token %q", token)
+	}
+	signed, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.Hash(0), []byte("user:2000000000"), signed)
+	if err != nil {
+		t.Errorf("bad signature: %s", err)
+	}
+
+	_, err = (&goca.X509Auth{User: "user", CertPEM: certPEM}).Session(context.Background())
+	if err == nil {
+		t.Error("expected an error without private key")
+	}
+}
@@ -0,0 +1,152 @@
+package goca
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DefaultBulkConcurrency is the number of operations run at the same time by
+// a Bulk when Concurrency is not set
+const DefaultBulkConcurrency = 8
+
+// Bulk applies an operation to many resources concurrently, e.g. to power off
+// the VMs of a cluster:
+//
+//	bulk := &goca.Bulk{Concurrency: 20, Rate: 10}
+//	results := bulk.VMs(ctx, ids, (*goca.VM).Poweroff, func(ctx context.Context, vm *goca.VM) error {
+//		return vm.WaitPoweroff(ctx)
+//	})
+//	for _, r := range results.Failed() {
+//		...
+//	}
+type Bulk struct {
+	// Concurrency is the maximum number of operations in progress. Defaults
+	// to DefaultBulkConcurrency.
+	Concurrency int
+
+	// Rate is the maximum number of operations started per second. 0 means
+	// no limit.
+	Rate float64
+}
+
+// BulkResult is the outcome of the operation on one resource
+type BulkResult struct {
+	ID  uint
+	Err error
+}
+
+// BulkResults are the outcomes of a bulk operation, in the order of the IDs
+type BulkResults []BulkResult
+
+// Failed returns the results of the failed operations
+func (results BulkResults) Failed() BulkResults {
+	var failed BulkResults
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Err returns nil if all the operations succeeded, otherwise a BulkError
+func (results BulkResults) Err() error {
+	failed := results.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return &BulkError{Failed: failed, Total: len(results)}
+}
+
+// BulkError is returned by BulkResults.Err when some operations failed
+type BulkError struct {
+	Failed BulkResults
+	Total  int
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%d of %d operations failed, first error on ID %d: %s",
+		len(e.Failed), e.Total, e.Failed[0].ID, e.Failed[0].Err)
+}
+
+// Run calls op for each ID. When ctx is done, the operations not started yet
+// fail with the error of the context.
+func (b *Bulk) Run(ctx context.Context, ids []uint, op func(ctx context.Context, id uint) error) BulkResults {
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBulkConcurrency
+	}
+
+	var limiter *tokenBucket
+	if b.Rate > 0 {
+		limiter = newTokenBucket(b.Rate, 1)
+	}
+
+	results := make(BulkResults, len(ids))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, id := range ids {
+		results[i].ID = id
+
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+
+		if limiter != nil {
+			if err := limiter.wait(ctx); err != nil {
+				<-sem
+				results[i].Err = err
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, id uint) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i].Err = op(ctx, id)
+		}(i, id)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// VMs calls action for each VM, then wait if it's not nil, e.g. to wait for
+// the target state of the action
+func (b *Bulk) VMs(ctx context.Context, ids []uint, action func(vm *VM) error, wait func(ctx context.Context, vm *VM) error) BulkResults {
+	return b.Run(ctx, ids, func(ctx context.Context, id uint) error {
+		vm := NewVM(id)
+		err := action(vm)
+		if err != nil || wait == nil {
+			return err
+		}
+		return wait(ctx, vm)
+	})
+}
+
+// Images calls action for each image, then wait if it's not nil, e.g. to
+// wait for the target state of the action
+func (b *Bulk) Images(ctx context.Context, ids []uint, action func(image *Image) error, wait func(ctx context.Context, image *Image) error) BulkResults {
+	return b.Run(ctx, ids, func(ctx context.Context, id uint) error {
+		image := NewImage(id)
+		err := action(image)
+		if err != nil || wait == nil {
+			return err
+		}
+		return wait(ctx, image)
+	})
+}
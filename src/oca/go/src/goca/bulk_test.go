@@ -0,0 +1,122 @@
+package goca_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+func TestBulkRun(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+
+	ids := []uint{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	failure := errors.New("failure")
+
+	bulk := &goca.Bulk{Concurrency: 3}
+	results := bulk.Run(context.Background(), ids, func(ctx context.Context, id uint) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		if id%4 == 0 {
+			return failure
+		}
+		return nil
+	})
+
+	if maxRunning > 3 {
+		t.Errorf("%d operations run at the same time", maxRunning)
+	}
+
+	for i, r := range results {
+		if r.ID != ids[i] {
+			t.Errorf("result %d: expected ID %d, got %d", i, ids[i], r.ID)
+		}
+	}
+
+	failed := results.Failed()
+	if len(failed) != 2 || failed[0].ID != 4 || failed[1].ID != 8 || failed[0].Err != failure {
+		t.Errorf("unexpected failures %v", failed)
+	}
+	if _, ok := results.Err().(*goca.BulkError); !ok {
+		t.Errorf("BulkError expected, got %v", results.Err())
+	}
+}
+
+func TestBulkRate(t *testing.T) {
+	bulk := &goca.Bulk{Concurrency: 10, Rate: 100}
+
+	start := time.Now()
+	results := bulk.Run(context.Background(), []uint{1, 2, 3, 4, 5, 6}, func(ctx context.Context, id uint) error {
+		return nil
+	})
+	if results.Err() != nil {
+		t.Fatal(results.Err())
+	}
+
+	// The first operation starts at once, the next ones every 10ms
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("6 operations at 100/s took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = bulk.Run(ctx, []uint{1, 2}, func(ctx context.Context, id uint) error {
+		t.Error("no operation expected")
+		return nil
+	})
+	for _, r := range results {
+		if r.Err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, r.Err)
+		}
+	}
+}
+
+func TestBulkVMs(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+
+	var ids []uint
+	for i := 0; i < 3; i++ {
+		id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetVMState(id, goca.Active, goca.Running); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	server.Hook("one.vm.action", func(call *gocatest.Call) error {
+		if call.Params[1] == int(ids[2]) {
+			return &gocatest.Error{Code: goca.OneActionError, Message: "wrong state"}
+		}
+		return nil
+	})
+
+	bulk := &goca.Bulk{}
+	results := bulk.VMs(context.Background(), ids, (*goca.VM).Poweroff, func(ctx context.Context, vm *goca.VM) error {
+		return vm.WaitPoweroff(ctx, goca.WaitTestOptions)
+	})
+
+	failed := results.Failed()
+	if len(failed) != 1 || failed[0].ID != ids[2] {
+		t.Errorf("expected VM %d to fail, got %v", ids[2], failed)
+	}
+}
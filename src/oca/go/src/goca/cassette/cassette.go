@@ -0,0 +1,316 @@
+// Package cassette records the XML-RPC calls sent to OpenNebula and their
+// responses, and replays them later without server. It's used to run the
+// goca tests offline.
+//
+// A Cassette is an http.RoundTripper, to set in goca.OneConfig.Transport.
+// The calls are matched on their method and arguments, the session string is
+// redacted, like the passwords and the tokens in the arguments and the
+// responses. The identical calls are replayed in the recorded order, e.g. the
+// successive one.vm.info of a wait loop.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// EnvMode is the environment variable selecting the mode of the cassettes:
+// live, record or replay
+const EnvMode = "GOCA_CASSETTE"
+
+// Mode of a cassette
+type Mode int
+
+const (
+	// Live sends the calls to the server, without recording them
+	Live Mode = iota
+
+	// Record sends the calls to the server, and records them
+	Record
+
+	// Replay answers the calls with the recorded responses
+	Replay
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Live:
+		return "live"
+	case Record:
+		return "record"
+	case Replay:
+		return "replay"
+	default:
+		return ""
+	}
+}
+
+// ModeFromEnv returns the mode set by the EnvMode environment variable,
+// Live if it's not set
+func ModeFromEnv() (Mode, error) {
+	switch value := os.Getenv(EnvMode); value {
+	case "", "live":
+		return Live, nil
+	case "record":
+		return Record, nil
+	case "replay":
+		return Replay, nil
+	default:
+		return Live, fmt.Errorf("%s: unknown mode %q, expected live, record or replay", EnvMode, value)
+	}
+}
+
+// redacted replaces the secrets in the recorded calls
+const redacted = "[REDACTED]"
+
+// secretElements are the elements of the responses containing secrets, as
+// escaped in the XML-RPC strings or not
+var secretElements = regexp.MustCompile(`(<|&lt;)(PASSWORD|TOKEN)(>|&gt;).*?(<|&lt;)/(PASSWORD|TOKEN)(>|&gt;)`)
+
+// secretArgs are the indexes of the arguments containing secrets, the session
+// string excluded, by method. They're redacted in the recorded and in the
+// replayed calls.
+var secretArgs = map[string][]int{
+	"one.user.allocate": {1},
+	"one.user.passwd":   {1},
+	"one.user.chauth":   {2},
+	"one.user.login":    {1},
+}
+
+// secretResults are the methods returning a secret, the token of
+// one.user.login
+var secretResults = map[string]bool{"one.user.login": true}
+
+// stringValue is an XML-RPC string value
+var stringValue = regexp.MustCompile(`<string>.*?</string>`)
+
+// redactArgs replaces the secret arguments of a call
+func redactArgs(method string, args []string) {
+	for _, i := range secretArgs[method] {
+		if i < len(args) {
+			args[i] = redacted
+		}
+	}
+}
+
+// redactResponse replaces the secrets of the response of a call
+func redactResponse(method, response string) string {
+	if secretResults[method] {
+		response = stringValue.ReplaceAllString(response, "<string>"+redacted+"</string>")
+	}
+	return secretElements.ReplaceAllString(response, "$1$2$3"+redacted+"$4/$5$6")
+}
+
+// Interaction is a recorded call
+type Interaction struct {
+	Method string `json:"method"`
+
+	// Args are the XML-RPC values of the arguments, the session string
+	// excluded
+	Args []string `json:"args"`
+
+	StatusCode int    `json:"status_code"`
+	Response   string `json:"response"`
+}
+
+// Cassette records or replays the calls
+type Cassette struct {
+	// User is the user name of the recorded session string
+	User string `json:"user"`
+
+	Interactions []*Interaction `json:"interactions"`
+
+	// Transport sends the requests in the Live and Record modes. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper `json:"-"`
+
+	path string
+	mode Mode
+
+	mu     sync.Mutex
+	played []bool
+}
+
+// New returns a cassette stored at path. In the Replay mode, the file is
+// loaded.
+func New(path string, mode Mode) (*Cassette, error) {
+	c := &Cassette{path: path, mode: mode}
+
+	if mode == Replay {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, c); err != nil {
+			return nil, fmt.Errorf("cassette %s: %s", path, err)
+		}
+		c.played = make([]bool, len(c.Interactions))
+	}
+
+	return c, nil
+}
+
+// Mode returns the mode of the cassette
+func (c *Cassette) Mode() Mode {
+	return c.mode
+}
+
+// Save writes the recorded calls in the file of the cassette. It does nothing
+// if the cassette is not recording.
+func (c *Cassette) Save() error {
+	if c.mode != Record {
+		return nil
+	}
+
+	c.mu.Lock()
+	content, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.path, append(content, '\n'), 0644)
+}
+
+// RoundTrip sends, records or replays the request, depending on the mode
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.mode == Live {
+		return c.transport().RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	method, session, args, err := parseCall(body)
+	if err != nil {
+		return nil, fmt.Errorf("cassette: %s", err)
+	}
+	redactArgs(method, args)
+
+	if c.mode == Replay {
+		return c.replay(req, method, args)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp, err := c.transport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	c.mu.Lock()
+	if i := strings.Index(session, ":"); i > 0 && c.User == "" {
+		c.User = session[:i]
+	}
+	c.Interactions = append(c.Interactions, &Interaction{
+		Method:     method,
+		Args:       args,
+		StatusCode: resp.StatusCode,
+		Response:   redactResponse(method, string(respBody)),
+	})
+	c.mu.Unlock()
+
+	return resp, nil
+}
+
+// replay answers with the first recorded response not replayed yet of the
+// call
+func (c *Cassette) replay(req *http.Request, method string, args []string) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, interaction := range c.Interactions {
+		if c.played[i] || interaction.Method != method || !equalArgs(interaction.Args, args) {
+			continue
+		}
+		c.played[i] = true
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.StatusCode, http.StatusText(interaction.StatusCode)),
+			StatusCode:    interaction.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"text/xml"}},
+			Body:          ioutil.NopCloser(strings.NewReader(interaction.Response)),
+			ContentLength: int64(len(interaction.Response)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("cassette %s: no recorded response for %s(%s)", c.path, method, strings.Join(args, ", "))
+}
+
+func (c *Cassette) transport() http.RoundTripper {
+	if c.Transport != nil {
+		return c.Transport
+	}
+	return http.DefaultTransport
+}
+
+// parseCall returns the method, the session string, and the other arguments
+// of an XML-RPC call
+func parseCall(body []byte) (method string, session string, args []string, err error) {
+	var call struct {
+		Method string `xml:"methodName"`
+		Params []struct {
+			Value struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"value"`
+		} `xml:"params>param"`
+	}
+	if err := xml.Unmarshal(body, &call); err != nil {
+		return "", "", nil, err
+	}
+
+	args = []string{}
+	for i, param := range call.Params {
+		if i == 0 {
+			// The session string is either a string value or raw text
+			var s struct {
+				String string `xml:"string"`
+				Text   string `xml:",chardata"`
+			}
+			xml.Unmarshal([]byte("<value>"+param.Value.Inner+"</value>"), &s)
+			session = s.String + strings.TrimSpace(s.Text)
+			continue
+		}
+		args = append(args, strings.TrimSpace(param.Value.Inner))
+	}
+
+	return call.Method, session, args, nil
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package cassette
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func call(t *testing.T, client *http.Client, url, session, arg string) (string, error) {
+	body := `<?xml version="1.0"?><methodCall><methodName>one.vm.info</methodName><params>` +
+		`<param><value><string>` + session + `</string></value></param>` +
+		`<param><value><int>` + arg + `</int></value></param></params></methodCall>`
+
+	resp, err := client.Post(url, "text/xml", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content), nil
+}
+
+func TestCassette(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "calls.json")
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "<int>1</int>") {
+			w.Write([]byte("first<PASSWORD>secret</PASSWORD>"))
+		} else {
+			w.Write([]byte("second"))
+		}
+	}))
+	defer server.Close()
+
+	// Record
+	c, err := New(path, Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: c}
+	for _, arg := range []string{"1", "2", "1"} {
+		if _, err := call(t, client, server.URL, "oneadmin:secret", arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "secret") {
+		t.Errorf("the secrets are recorded: %s", content)
+	}
+
+	// Replay, with another session string and order
+	c, err = New(path, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != "oneadmin" {
+		t.Errorf("expected the user oneadmin, got %q", c.User)
+	}
+	client = &http.Client{Transport: c}
+	for _, test := range []struct{ arg, response string }{
+		{"2", "second"},
+		{"1", "first<PASSWORD>[REDACTED]</PASSWORD>"},
+		{"1", "first<PASSWORD>[REDACTED]</PASSWORD>"},
+	} {
+		response, err := call(t, client, server.URL, "oneadmin:other", test.arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != test.response {
+			t.Errorf("expected %q, got %q", test.response, response)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls to the server, got %d", calls)
+	}
+
+	// All the recorded calls have been replayed
+	if _, err := call(t, client, server.URL, "oneadmin:other", "1"); err == nil {
+		t.Error("expected an error for a call not recorded")
+	}
+}
+
+func TestCassetteSecretArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "calls.json")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := "<int>1</int>"
+		if body, _ := ioutil.ReadAll(r.Body); strings.Contains(string(body), "one.user.login") {
+			result = "<string>token</string>"
+		}
+		w.Write([]byte("<methodResponse><value>" + result + "</value></methodResponse>"))
+	}))
+	defer server.Close()
+
+	call := func(client *http.Client, method, password string) string {
+		body := `<?xml version="1.0"?><methodCall><methodName>` + method + `</methodName><params>` +
+			`<param><value><string>oneadmin:secret</string></value></param>` +
+			`<param><value><int>1</int></value></param>` +
+			`<param><value><string>` + password + `</string></value></param></params></methodCall>`
+
+		resp, err := client.Post(server.URL, "text/xml", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	c, err := New(path, Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call(&http.Client{Transport: c}, "one.user.passwd", "password")
+	call(&http.Client{Transport: c}, "one.user.login", "")
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "password", "token"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("%s is recorded: %s", secret, content)
+		}
+	}
+
+	// The secret arguments aren't matched
+	c, err = New(path, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call(&http.Client{Transport: c}, "one.user.passwd", "other")
+	response := call(&http.Client{Transport: c}, "one.user.login", "")
+	if !strings.Contains(response, "<string>[REDACTED]</string>") {
+		t.Errorf("expected a redacted token, got %q", response)
+	}
+}
+
+func TestModeFromEnv(t *testing.T) {
+	defer os.Unsetenv(EnvMode)
+
+	for value, expected := range map[string]Mode{"": Live, "record": Record, "replay": Replay} {
+		os.Setenv(EnvMode, value)
+		mode, err := ModeFromEnv()
+		if err != nil || mode != expected {
+			t.Errorf("%q: expected %s, got %s, %v", value, expected, mode, err)
+		}
+	}
+
+	os.Setenv(EnvMode, "rewind")
+	if _, err := ModeFromEnv(); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
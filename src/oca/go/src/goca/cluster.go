@@ -2,7 +2,6 @@ package goca
 
 import (
 	"encoding/xml"
-	"errors"
 )
 
 // ClusterPool represents an OpenNebula ClusterPool
@@ -12,6 +11,8 @@ type ClusterPool struct {
 
 // Cluster represents an OpenNebula Cluster
 type Cluster struct {
+	XMLResource
+
 	ID           uint            `xml:"ID"`
 	Name         string          `xml:"NAME"`
 	HostsID      []int           `xml:"HOSTS>ID"`
@@ -54,28 +55,11 @@ func NewCluster(id uint) *Cluster {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the cluster.
 func NewClusterFromName(name string) (*Cluster, error) {
-	var id uint
-
-	clusterPool, err := NewClusterPool()
+	id, err := resolveName(resolveCluster, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(clusterPool.Clusters); i++ {
-		if clusterPool.Clusters[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = clusterPool.Clusters[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewCluster(id), nil
 }
 
@@ -161,5 +145,6 @@ func (cluster *Cluster) Info() error {
 		return err
 	}
 	*cluster = Cluster{}
+	cluster.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), cluster)
 }
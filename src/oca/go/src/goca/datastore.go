@@ -2,7 +2,6 @@ package goca
 
 import (
 	"encoding/xml"
-	"errors"
 	"fmt"
 )
 
@@ -13,6 +12,8 @@ type DatastorePool struct {
 
 // Datastore represents an OpenNebula Datastore
 type Datastore struct {
+	XMLResource
+
 	ID          uint              `xml:"ID"`
 	UID         int               `xml:"UID"`
 	GID         int               `xml:"GID"`
@@ -89,28 +90,11 @@ func NewDatastore(id uint) *Datastore {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the datastore.
 func NewDatastoreFromName(name string) (*Datastore, error) {
-	var id uint
-
-	datastorePool, err := NewDatastorePool()
+	id, err := resolveName(resolveDatastore, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(datastorePool.Datastores); i++ {
-		if datastorePool.Datastores[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = datastorePool.Datastores[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewDatastore(id), nil
 }
 
@@ -184,6 +168,7 @@ func (datastore *Datastore) Info() error {
 		return err
 	}
 	*datastore = Datastore{}
+	datastore.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), datastore)
 }
 
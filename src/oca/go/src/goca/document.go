@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // DocumentPool represents an OpenNebula DocumentPool
@@ -12,6 +12,8 @@ type DocumentPool struct {
 
 // Document represents an OpenNebula Document
 type Document struct {
+	XMLResource
+
 	ID          uint             `xml:"ID"`
 	UID         int              `xml:"UID"`
 	GID         int              `xml:"GID"`
@@ -31,26 +33,18 @@ type documentTemplate struct {
 // NewDocumentPool returns a document pool. A connection to OpenNebula is
 // performed.
 func NewDocumentPool(documentType int, args ...int) (*DocumentPool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 1:
-		who = args[0]
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, true)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Call("one.documentpool.info", who, start, end, documentType)
+	return NewDocumentPoolWithOptions(documentType, opts)
+}
+
+// NewDocumentPoolWithOptions returns a pool of the documents of type
+// documentType filtered by opts. A connection to OpenNebula is performed.
+func NewDocumentPoolWithOptions(documentType int, opts PoolOptions) (*DocumentPool, error) {
+	response, err := client.Call("one.documentpool.info", opts.Who, opts.Start, opts.End, documentType)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +58,12 @@ func NewDocumentPool(documentType int, args ...int) (*DocumentPool, error) {
 	return documentPool, nil
 }
 
+// NewDocumentPoolIterator returns an iterator over the documents of type
+// documentType, retrieving pageSize IDs at a time
+func NewDocumentPoolIterator(ctx context.Context, documentType int, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.documentpool.info", "DOCUMENT", opts, pageSize, documentType)
+}
+
 // NewDocument finds a document object by ID. No connection to OpenNebula.
 func NewDocument(id uint) *Document {
 	return &Document{ID: id}
@@ -73,28 +73,11 @@ func NewDocument(id uint) *Document {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the document.
 func NewDocumentFromName(name string, documentType int) (*Document, error) {
-	var id uint
-
-	documentPool, err := NewDocumentPool(documentType)
+	id, err := resolveName(resolveDocument(documentType), name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(documentPool.Documents); i++ {
-		if documentPool.Documents[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = documentPool.Documents[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewDocument(id), nil
 }
 
@@ -121,6 +104,17 @@ func (document *Document) Delete() error {
 	return err
 }
 
+// Info retrieves information for the document.
+func (document *Document) Info() error {
+	response, err := client.Call("one.document.info", document.ID)
+	if err != nil {
+		return err
+	}
+	*document = Document{}
+	document.body = response.Body()
+	return xml.Unmarshal([]byte(response.Body()), document)
+}
+
 // Update replaces the document template contents.
 // * tpl: The new document template contents. Syntax can be the usual attribute=value or XML.
 // * appendTemplate: Update type: 0: Replace the whole template. 1: Merge new template with the existing one.
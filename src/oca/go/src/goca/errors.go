@@ -45,6 +45,9 @@ const (
 
 	// ClientRespONeParse if we can't parse a correct OpenNebula response
 	ClientRespONeParse
+
+	// ClientReqAuth if the AuthProvider can't provide the credentials
+	ClientReqAuth
 )
 
 func (s ClientErrCode) String() string {
@@ -61,6 +64,8 @@ func (s ClientErrCode) String() string {
 		return "RESPONSE_XMLRPC_PARSE"
 	case ClientRespONeParse:
 		return "RESPONSE_ONE_PARSE"
+	case ClientReqAuth:
+		return "REQUEST_AUTH"
 	default:
 		return ""
 	}
@@ -0,0 +1,42 @@
+package goca
+
+import (
+	"context"
+	"time"
+)
+
+// The internals used by the tests of package goca_test, driven by the
+// gocatest server
+
+var WaitTestOptions = waitTestOptions
+
+// SetTestClient sets the client like SetClient, and returns a function
+// restoring the previous one
+func SetTestClient(conf OneConfig) (restore func()) {
+	previous := client
+	SetClient(conf)
+	return func() {
+		client = previous
+	}
+}
+
+// LoginExpiration returns the expiration time of the login token of the
+// client
+func LoginExpiration() time.Time {
+	client.login.mu.Lock()
+	defer client.login.mu.Unlock()
+	return client.login.expiration
+}
+
+// SetLoginExpiration changes the expiration time of the login token of the
+// client, e.g. to renew it
+func SetLoginExpiration(expiration time.Time) {
+	client.login.mu.Lock()
+	client.login.expiration = expiration
+	client.login.mu.Unlock()
+}
+
+// InfoContext retrieves the information of the VM, until ctx is done
+func (vm *VM) InfoContext(ctx context.Context) error {
+	return vm.infoContext(ctx)
+}
@@ -2,11 +2,11 @@ package goca
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"strings"
 
 	"github.com/kolo/xmlrpc"
 )
@@ -20,15 +20,41 @@ type OneConfig struct {
 	// Token is the authentication string. In the format of <user>:<password>
 	Token string
 
+	// Auth provides the authentication string. It overrides Token when it's
+	// not nil.
+	Auth AuthProvider `json:"-"`
+
 	// XmlrpcURL contains OpenNebula's XML-RPC API endpoint. Defaults to
 	// http://localhost:2633/RPC2
 	XmlrpcURL string
+
+	// Transport sends the HTTP requests. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper `json:"-"`
+
+	// RateLimit applies to all the requests sent to OpenNebula
+	RateLimit RateLimit
+
+	// MethodRateLimits apply to the requests of an XML-RPC method, e.g.
+	// "one.vmpool.info", in addition to RateLimit
+	MethodRateLimits map[string]RateLimit
+
+	// Login enables the login tokens for the <user>:<password> credentials of
+	// a PasswordAuth. nil disables them.
+	Login *LoginConfig
 }
 
 type oneClient struct {
 	url               string
-	token             string
+	auth              AuthProvider
 	httpClient        *http.Client
+
+	limiter        *limiter
+	methodLimiters map[string]*limiter
+
+	login *loginSession
+
+	// vmPoolExtended tells if one.vmpool.infoextended is available
+	vmPoolExtended int32
 }
 
 type response struct {
@@ -47,21 +73,19 @@ func init() {
 // and xmlrpcURL
 func NewConfig(user string, password string, xmlrpcURL string) OneConfig {
 	var authToken string
-	var oneAuthPath string
+	var auth AuthProvider
 
 	oneXmlrpc := xmlrpcURL
 
 	if user == "" && password == "" {
-		oneAuthPath = os.Getenv("ONE_AUTH")
-		if oneAuthPath == "" {
-			oneAuthPath = os.Getenv("HOME") + "/.one/one_auth"
-		}
+		oneAuthPath := defaultOneAuthPath()
 
-		token, err := ioutil.ReadFile(oneAuthPath)
+		token, err := readOneAuthFile(oneAuthPath)
 		if err == nil {
-			authToken = strings.TrimSpace(string(token))
+			authToken = token
 		} else {
-			authToken = ""
+			// The calls report why the file can't be used
+			auth = &FileAuth{Path: oneAuthPath}
 		}
 	} else {
 		authToken = user + ":" + password
@@ -76,6 +100,7 @@ func NewConfig(user string, password string, xmlrpcURL string) OneConfig {
 
 	config := OneConfig{
 		Token:     authToken,
+		Auth:      auth,
 		XmlrpcURL: oneXmlrpc,
 	}
 
@@ -85,10 +110,28 @@ func NewConfig(user string, password string, xmlrpcURL string) OneConfig {
 // SetClient assigns a value to the client variable
 func SetClient(conf OneConfig) {
 
+	auth := conf.Auth
+	if auth == nil {
+		auth = staticAuth(conf.Token)
+	}
+
 	client = &oneClient{
 		url:               conf.XmlrpcURL,
-		token:             conf.Token,
-		httpClient:        &http.Client{},
+		auth:              auth,
+		httpClient:        &http.Client{Transport: conf.Transport},
+		limiter:           newLimiter(conf.RateLimit),
+		login:             newLoginSession(conf.Login),
+	}
+
+	for method, limit := range conf.MethodRateLimits {
+		l := newLimiter(limit)
+		if l == nil {
+			continue
+		}
+		if client.methodLimiters == nil {
+			client.methodLimiters = map[string]*limiter{}
+		}
+		client.methodLimiters[method] = l
 	}
 }
 
@@ -114,10 +157,35 @@ func SystemConfig() (string, error) {
 
 // Call is an XML-RPC wrapper. It returns a pointer to response and an error.
 func (c *oneClient) Call(method string, args ...interface{}) (*response, error) {
-	return c.endpointCall(c.url, method, args...)
+	return c.endpointCall(context.Background(), c.url, method, args...)
 }
 
-func (c *oneClient) endpointCall(url string, method string, args ...interface{}) (*response, error) {
+// CallContext is like Call, but gives up when ctx is done, including while
+// waiting for the rate limits.
+func (c *oneClient) CallContext(ctx context.Context, method string, args ...interface{}) (*response, error) {
+	return c.endpointCall(ctx, c.url, method, args...)
+}
+
+func (c *oneClient) endpointCall(ctx context.Context, url string, method string, args ...interface{}) (*response, error) {
+	session, token, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.sessionCall(ctx, url, session, method, args...)
+	if token && c.loginRejected(session, err) {
+		session, _, err = c.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r, err = c.sessionCall(ctx, url, session, method, args...)
+	}
+
+	return r, err
+}
+
+// sessionCall performs the call with the session string session
+func (c *oneClient) sessionCall(ctx context.Context, url string, session string, method string, args ...interface{}) (*response, error) {
 	var (
 		ok bool
 
@@ -128,35 +196,9 @@ func (c *oneClient) endpointCall(url string, method string, args ...interface{})
 		errCode  int64
 	)
 
-	xmlArgs := make([]interface{}, len(args)+1)
-
-	xmlArgs[0] = c.token
-	copy(xmlArgs[1:], args[:])
-
-	buf, err := xmlrpc.EncodeMethodCall(method, xmlArgs...)
-	if err != nil {
-		return nil,
-			&ClientError{Code: ClientReqBuild, msg: "xmlrpc request encoding", err: err}
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(buf))
+	resp, err := c.post(ctx, url, session, method, args...)
 	if err != nil {
-		return nil,
-			&ClientError{Code: ClientReqBuild, msg: "http request build", err: err}
-	}
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil,
-			&ClientError{Code: ClientReqHTTP, msg: "http make request", err: err}
-	}
-
-	if resp.StatusCode/100 != 2 {
-		return nil, &ClientError{
-			Code:     ClientRespHTTP,
-			msg:      fmt.Sprintf("http status code: %d", resp.StatusCode),
-			httpResp: resp,
-		}
+		return nil, err
 	}
 
 	respData, err := ioutil.ReadAll(resp.Body)
@@ -221,6 +263,55 @@ func (c *oneClient) endpointCall(url string, method string, args ...interface{})
 	return r, nil
 }
 
+// post sends the XML-RPC request and returns the HTTP response, once the rate
+// limits allow it. Its body has to be closed by the caller, which releases
+// the in-flight request.
+func (c *oneClient) post(ctx context.Context, url string, session string, method string, args ...interface{}) (*http.Response, error) {
+	xmlArgs := make([]interface{}, len(args)+1)
+
+	xmlArgs[0] = session
+	copy(xmlArgs[1:], args[:])
+
+	buf, err := xmlrpc.EncodeMethodCall(method, xmlArgs...)
+	if err != nil {
+		return nil,
+			&ClientError{Code: ClientReqBuild, msg: "xmlrpc request encoding", err: err}
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(buf))
+	if err != nil {
+		return nil,
+			&ClientError{Code: ClientReqBuild, msg: "http request build", err: err}
+	}
+	req = req.WithContext(ctx)
+
+	release, err := c.acquire(ctx, method)
+	if err != nil {
+		return nil,
+			&ClientError{Code: ClientReqHTTP, msg: "rate limit wait", err: err}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		release()
+		return nil,
+			&ClientError{Code: ClientReqHTTP, msg: "http make request", err: err}
+	}
+
+	if resp.StatusCode/100 != 2 {
+		release()
+		return nil, &ClientError{
+			Code:     ClientRespHTTP,
+			msg:      fmt.Sprintf("http status code: %d", resp.StatusCode),
+			httpResp: resp,
+		}
+	}
+
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+
+	return resp, nil
+}
+
 // Body accesses the body of the response
 func (r *response) Body() string {
 	return r.body
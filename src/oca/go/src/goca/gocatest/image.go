@@ -0,0 +1,424 @@
+package gocatest
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+var imageTypes = map[string]int{"OS": 0, "CDROM": 1, "DATABLOCK": 2, "KERNEL": 3, "RAMDISK": 4, "CONTEXT": 5}
+
+type image struct {
+	id          int
+	uid, gid    int
+	name        string
+	imageType   int
+	persistent  bool
+	size        int
+	state       goca.ImageState
+	datastoreID int
+	regTime     int64
+	vms         []int
+	template    *template
+}
+
+type vmTemplate struct {
+	id       int
+	uid, gid int
+	name     string
+	regTime  int64
+	template *template
+}
+
+// SetImageState sets the state of an image, e.g. goca.ImageError
+func (s *Server) SetImageState(id uint, state goca.ImageState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	img, ok := s.images[int(id)]
+	if !ok {
+		return fmt.Errorf("image %d not found", id)
+	}
+	img.state = state
+	return nil
+}
+
+func (s *Server) imageIDs() []int {
+	return sortedIDs(len(s.images), func(add func(int)) {
+		for id := range s.images {
+			add(id)
+		}
+	})
+}
+
+func (s *Server) templateIDs() []int {
+	return sortedIDs(len(s.templates), func(add func(int)) {
+		for id := range s.templates {
+			add(id)
+		}
+	})
+}
+
+// findImage returns the image of a DISK, from IMAGE_ID, or IMAGE and
+// IMAGE_UNAME or IMAGE_UID
+func (s *Server) findImage(disk *attribute, uid int) (*image, error) {
+	if value, ok := disk.get("IMAGE_ID"); ok {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong IMAGE_ID %q", value)
+		}
+		img, ok := s.images[id]
+		if !ok {
+			return nil, fmt.Errorf("Error getting image [%d]", id)
+		}
+		return img, nil
+	}
+
+	name, _ := disk.get("IMAGE")
+	owner := uid
+	if uname, ok := disk.get("IMAGE_UNAME"); ok {
+		owner = -1
+		for _, u := range s.users {
+			if u.name == uname {
+				owner = u.id
+			}
+		}
+	} else if value, ok := disk.get("IMAGE_UID"); ok {
+		owner, _ = strconv.Atoi(value)
+	}
+
+	for _, id := range s.imageIDs() {
+		img := s.images[id]
+		if img.name == name && img.uid == owner {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("User %d does not own an image with name: %s", owner, name)
+}
+
+func (s *Server) writeOwner(w *xmlWriter, uid, gid int) {
+	w.elem("UID", uid)
+	w.elem("GID", gid)
+	w.elem("UNAME", s.userName(uid))
+	w.elem("GNAME", s.groupName(gid))
+}
+
+func writePermissions(w *xmlWriter) {
+	w.open("PERMISSIONS")
+	for _, p := range []string{"OWNER_U", "OWNER_M"} {
+		w.elem(p, 1)
+	}
+	for _, p := range []string{"OWNER_A", "GROUP_U", "GROUP_M", "GROUP_A", "OTHER_U", "OTHER_M", "OTHER_A"} {
+		w.elem(p, 0)
+	}
+	w.close("PERMISSIONS")
+}
+
+func (s *Server) writeImage(w *xmlWriter, img *image) {
+	w.open("IMAGE")
+	w.elem("ID", img.id)
+	s.writeOwner(w, img.uid, img.gid)
+	w.elem("NAME", img.name)
+	writePermissions(w)
+	w.elem("TYPE", img.imageType)
+	w.elem("DISK_TYPE", 0)
+	if img.persistent {
+		w.elem("PERSISTENT", 1)
+	} else {
+		w.elem("PERSISTENT", 0)
+	}
+	w.elem("REGTIME", img.regTime)
+	w.elem("SOURCE", fmt.Sprintf("/var/lib/one/datastores/%d/%d", img.datastoreID, img.id))
+	w.elem("PATH", "")
+	w.elem("FSTYPE", "")
+	w.elem("SIZE", img.size)
+	w.elem("STATE", int(img.state))
+	w.elem("RUNNING_VMS", len(img.vms))
+	w.elem("CLONING_OPS", 0)
+	w.elem("CLONING_ID", -1)
+	w.elem("TARGET_SNAPSHOT", -1)
+	w.elem("DATASTORE_ID", img.datastoreID)
+	w.elem("DATASTORE", "default")
+	w.ids("VMS", img.vms)
+	w.ids("CLONES", nil)
+	w.ids("APP_CLONES", nil)
+	img.template.writeXML(w, "TEMPLATE")
+	w.open("SNAPSHOTS")
+	w.close("SNAPSHOTS")
+	w.close("IMAGE")
+}
+
+func (s *Server) writeTemplate(w *xmlWriter, tpl *vmTemplate) {
+	w.open("VMTEMPLATE")
+	w.elem("ID", tpl.id)
+	s.writeOwner(w, tpl.uid, tpl.gid)
+	w.elem("NAME", tpl.name)
+	writePermissions(w)
+	w.elem("REGTIME", tpl.regTime)
+	tpl.template.writeXML(w, "TEMPLATE")
+	w.close("VMTEMPLATE")
+}
+
+func init() {
+	methods["one.image.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		t, dsID := req.template(0), req.int(1)
+		if req.err != nil {
+			return nil, nil
+		}
+
+		name, _ := t.get("NAME")
+		if name == "" {
+			return nil, failure(req.Method, "No NAME in template for Image.")
+		}
+		for _, img := range s.images {
+			if img.name == name && img.uid == req.user.id {
+				return nil, failure(req.Method, fmt.Sprintf("NAME is already taken by IMAGE %d.", img.id))
+			}
+		}
+
+		img := &image{
+			id:          s.id("image"),
+			uid:         req.user.id,
+			gid:         req.user.gid,
+			name:        name,
+			size:        1,
+			state:       goca.ImageLocked,
+			datastoreID: dsID,
+			regTime:     time.Now().Unix(),
+			template:    t,
+		}
+		t.del("NAME")
+
+		if value, ok := t.get("TYPE"); ok {
+			imageType, ok := imageTypes[value]
+			if !ok {
+				return nil, failure(req.Method, "Unknown type "+value)
+			}
+			img.imageType = imageType
+		}
+		if value, ok := t.get("SIZE"); ok {
+			img.size, _ = strconv.Atoi(value)
+		}
+		if value, ok := t.get("PERSISTENT"); ok {
+			img.persistent = value == "YES"
+		}
+
+		s.images[img.id] = img
+		return img.id, nil
+	}
+
+	// The images are LOCKED until the next call retrieving them
+	methods["one.image.info"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		var w xmlWriter
+		s.writeImage(&w, img)
+		if img.state == goca.ImageLocked {
+			img.state = goca.ImageReady
+		}
+		return w.String(), nil
+	}
+
+	methods["one.image.delete"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		if len(img.vms) > 0 {
+			return nil, wrongState(req.Method, "Cannot delete image: it is being used by VMs")
+		}
+		delete(s.images, id)
+		return id, nil
+	}
+
+	methods["one.image.update"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		req.updateTemplate(&img.template, 1)
+		return id, nil
+	}
+
+	methods["one.image.chown"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		if err := s.chown(req, &img.uid, &img.gid); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+
+	methods["one.image.rename"] = func(s *Server, req *request) (interface{}, error) {
+		id, name := req.int(0), req.string(1)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		img.name = name
+		return id, nil
+	}
+
+	methods["one.image.persistent"] = func(s *Server, req *request) (interface{}, error) {
+		id, persistent := req.int(0), req.bool(1)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		if len(img.vms) > 0 {
+			return nil, wrongState(req.Method, "Cannot change the persistent attribute of an image in use")
+		}
+		img.persistent = persistent
+		return id, nil
+	}
+
+	methods["one.image.enable"] = func(s *Server, req *request) (interface{}, error) {
+		id, enable := req.int(0), req.bool(1)
+		img, ok := s.images[id]
+		if !ok {
+			return nil, notFound(req.Method, "image", id)
+		}
+		if enable {
+			img.state = goca.ImageReady
+		} else {
+			img.state = goca.ImageDisabled
+		}
+		return id, nil
+	}
+
+	methods["one.imagepool.info"] = func(s *Server, req *request) (interface{}, error) {
+		filter := req.poolFilter(0, func(id int) (int, int) {
+			return s.images[id].uid, s.images[id].gid
+		})
+		var w xmlWriter
+		w.open("IMAGE_POOL")
+		for _, id := range filter(s.imageIDs()) {
+			s.writeImage(&w, s.images[id])
+		}
+		w.close("IMAGE_POOL")
+		return w.String(), nil
+	}
+
+	methods["one.template.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		t := req.template(0)
+		if req.err != nil {
+			return nil, nil
+		}
+
+		name, _ := t.get("NAME")
+		if name == "" {
+			return nil, failure(req.Method, "No NAME in template for VM Template.")
+		}
+		for _, tpl := range s.templates {
+			if tpl.name == name && tpl.uid == req.user.id {
+				return nil, failure(req.Method, fmt.Sprintf("NAME is already taken by TEMPLATE %d.", tpl.id))
+			}
+		}
+		t.del("NAME")
+
+		tpl := &vmTemplate{
+			id:       s.id("template"),
+			uid:      req.user.id,
+			gid:      req.user.gid,
+			name:     name,
+			regTime:  time.Now().Unix(),
+			template: t,
+		}
+		s.templates[tpl.id] = tpl
+		return tpl.id, nil
+	}
+
+	methods["one.template.info"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		tpl, ok := s.templates[id]
+		if !ok {
+			return nil, notFound(req.Method, "template", id)
+		}
+		var w xmlWriter
+		s.writeTemplate(&w, tpl)
+		return w.String(), nil
+	}
+
+	methods["one.template.update"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		tpl, ok := s.templates[id]
+		if !ok {
+			return nil, notFound(req.Method, "template", id)
+		}
+		req.updateTemplate(&tpl.template, 1)
+		return id, nil
+	}
+
+	methods["one.template.rename"] = func(s *Server, req *request) (interface{}, error) {
+		id, name := req.int(0), req.string(1)
+		tpl, ok := s.templates[id]
+		if !ok {
+			return nil, notFound(req.Method, "template", id)
+		}
+		tpl.name = name
+		return id, nil
+	}
+
+	methods["one.template.delete"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		if _, ok := s.templates[id]; !ok {
+			return nil, notFound(req.Method, "template", id)
+		}
+		delete(s.templates, id)
+		return id, nil
+	}
+
+	methods["one.template.instantiate"] = func(s *Server, req *request) (interface{}, error) {
+		id, name, hold := req.int(0), req.string(1), req.bool(2)
+		extra := &template{}
+		if len(req.Params) > 3 {
+			extra = req.template(3)
+		}
+		if req.err != nil {
+			return nil, nil
+		}
+
+		tpl, ok := s.templates[id]
+		if !ok {
+			return nil, notFound(req.Method, "template", id)
+		}
+
+		t := tpl.template.clone()
+		t.merge(extra)
+		if name != "" {
+			t.set("NAME", name)
+		} else if _, ok := t.get("NAME"); !ok {
+			t.set("NAME", fmt.Sprintf("%s-%d", tpl.name, s.nextID["vm"]))
+		}
+		t.set("TEMPLATE_ID", strconv.Itoa(tpl.id))
+
+		vm, err := s.allocateVM(req, t, hold)
+		if err != nil {
+			return nil, err
+		}
+		return vm.id, nil
+	}
+
+	methods["one.templatepool.info"] = func(s *Server, req *request) (interface{}, error) {
+		filter := req.poolFilter(0, func(id int) (int, int) {
+			return s.templates[id].uid, s.templates[id].gid
+		})
+		var w xmlWriter
+		w.open("VMTEMPLATE_POOL")
+		for _, id := range filter(s.templateIDs()) {
+			s.writeTemplate(&w, s.templates[id])
+		}
+		w.close("VMTEMPLATE_POOL")
+		return w.String(), nil
+	}
+}
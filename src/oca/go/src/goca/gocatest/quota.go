@@ -0,0 +1,127 @@
+package gocatest
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+// vmQuotaKeys are the attributes of the VM quotas, see one.user.quota
+var vmQuotaKeys = []string{"CPU", "MEMORY", "VMS", "RUNNING_CPU", "RUNNING_MEMORY", "RUNNING_VMS", "SYSTEM_DISK_SIZE"}
+
+// vmUsage returns the VM quota usage of a user, extra VMs excluded
+func (s *Server) vmUsage(uid int, extra ...*vm) map[string]float64 {
+	usage := map[string]float64{}
+	for _, vm := range s.vms {
+		if vm.uid != uid || vm.state == goca.Done {
+			continue
+		}
+		usage["CPU"] += vm.cpu()
+		usage["MEMORY"] += float64(vm.memory())
+		usage["VMS"]++
+		if vm.state != goca.Hold && vm.state != goca.Poweroff && vm.state != goca.Undeployed && vm.state != goca.Stopped {
+			usage["RUNNING_CPU"] += vm.cpu()
+			usage["RUNNING_MEMORY"] += float64(vm.memory())
+			usage["RUNNING_VMS"]++
+		}
+	}
+	for _, vm := range extra {
+		usage["CPU"] += vm.cpu()
+		usage["MEMORY"] += float64(vm.memory())
+		usage["VMS"]++
+		usage["RUNNING_CPU"] += vm.cpu()
+		usage["RUNNING_MEMORY"] += float64(vm.memory())
+		usage["RUNNING_VMS"]++
+	}
+	return usage
+}
+
+// checkVMQuota returns an error if the VM quota of the owner of vm doesn't
+// allow it
+func (s *Server) checkVMQuota(method string, vm *vm) error {
+	u, ok := s.users[vm.uid]
+	if !ok {
+		return nil
+	}
+
+	usage := s.vmUsage(vm.uid, vm)
+	for _, key := range vmQuotaKeys {
+		limit, ok := u.vmQuota[key]
+		if !ok || limit < 0 {
+			continue
+		}
+		if usage[key] > limit {
+			return &Error{Code: authorizationError, Message: fmt.Sprintf(
+				"[%s] User [%d] : user [%d] limit of %s reached for %s quota in VM.",
+				method, u.id, u.id, formatQuota(limit), key)}
+		}
+	}
+
+	return nil
+}
+
+func formatQuota(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// writeQuotas writes the quotas of the user, the VM ones only
+func (s *Server) writeQuotas(w *xmlWriter, u *user) {
+	w.open("DATASTORE_QUOTA")
+	w.close("DATASTORE_QUOTA")
+	w.open("NETWORK_QUOTA")
+	w.close("NETWORK_QUOTA")
+
+	w.open("VM_QUOTA")
+	if len(u.vmQuota) > 0 {
+		usage := s.vmUsage(u.id)
+		w.open("VM")
+		for _, key := range vmQuotaKeys {
+			limit, ok := u.vmQuota[key]
+			if !ok {
+				limit = -1
+			}
+			w.elem(key, formatQuota(limit))
+			w.elem(key+"_USED", formatQuota(usage[key]))
+		}
+		w.close("VM")
+	}
+	w.close("VM_QUOTA")
+
+	w.open("IMAGE_QUOTA")
+	w.close("IMAGE_QUOTA")
+	w.open("DEFAULT_USER_QUOTAS")
+	w.close("DEFAULT_USER_QUOTAS")
+}
+
+func init() {
+	methods["one.user.quota"] = func(s *Server, req *request) (interface{}, error) {
+		id, t := req.int(0), req.template(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		u, ok := s.users[id]
+		if !ok {
+			return nil, notFound(req.Method, "user", id)
+		}
+
+		for _, quota := range t.vectors("VM") {
+			for _, key := range vmQuotaKeys {
+				value, ok := quota.get(key)
+				if !ok {
+					continue
+				}
+				limit, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, failure(req.Method, fmt.Sprintf("Wrong value %q for %s quota", value, key))
+				}
+				if u.vmQuota == nil {
+					u.vmQuota = map[string]float64{}
+				}
+				u.vmQuota[key] = limit
+			}
+		}
+
+		return id, nil
+	}
+}
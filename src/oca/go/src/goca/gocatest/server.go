@@ -0,0 +1,597 @@
+// Package gocatest provides a fake OpenNebula XML-RPC server, to test the code
+// using goca without oned.
+//
+// The server keeps an in-memory model of the VMs, templates, images, virtual
+// networks, users, groups and hosts, and implements the main one.* methods
+// on them:
+//
+//	server := gocatest.NewServer()
+//	defer server.Close()
+//	goca.SetClient(server.Config())
+//
+//	id, err := goca.CreateVM("NAME=test\nCPU=1\nMEMORY=64", false)
+//
+// The VMs go through a simplified state machine: the transient states, e.g.
+// PROLOG and BOOT, last until the next call retrieving the VM. Hooks inject
+// errors and latency in the calls, handlers replace the model with canned
+// responses.
+//
+// The permissions and the ACLs are not enforced: every authenticated user can
+// do anything.
+package gocatest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+const (
+	// AdminUser and AdminPassword are the credentials of the oneadmin user
+	AdminUser     = "oneadmin"
+	AdminPassword = "opennebula"
+
+	// Version is returned by one.system.version
+	Version = "5.8.0"
+)
+
+// OpenNebula error codes, as returned in the responses
+const (
+	authenticationError = 0x0100
+	authorizationError  = 0x0200
+	noExistsError       = 0x0400
+	actionError         = 0x0800
+	internalError       = 0x2000
+)
+
+// XML-RPC fault codes, like the ones of xmlrpc-c
+const (
+	faultTypeMismatch   = -501
+	faultWrongArguments = -502
+	faultParseError     = -503
+	faultUnknownMethod  = -506
+)
+
+// Error is an OpenNebula error response. A Hook returning it makes the call
+// fail with it.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("OpenNebula error [%d]: %s", e.Code, e.Message)
+}
+
+// Fault is an XML-RPC fault response. A Hook returning it makes the call fail
+// with it.
+type Fault struct {
+	Code    int
+	Message string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("XML-RPC fault [%d]: %s", f.Code, f.Message)
+}
+
+// Call is an XML-RPC call received by the server
+type Call struct {
+	Method string
+
+	// Session is the session string, the first parameter
+	Session string
+
+	// Params are the other parameters: string, int, bool, float64 or
+	// []interface{}
+	Params []interface{}
+}
+
+// Hook is called before a call is handled. When it returns an error, the call
+// fails: an *Error or a *Fault is returned as is, the other errors as an
+// OpenNebula internal error.
+type Hook func(call *Call) error
+
+// Handler answers a call instead of the model. It returns the result, a
+// string, an int or a bool, or an error like a Hook.
+type Handler func(call *Call) (interface{}, error)
+
+type hook struct {
+	method string
+	fn     Hook
+
+	// once hooks are removed after their first call
+	once bool
+}
+
+// Server is a fake OpenNebula XML-RPC server
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	hooks    []*hook
+	handlers map[string]Handler
+	latency  map[string]time.Duration
+	calls    []Call
+
+	vms       map[int]*vm
+	templates map[int]*vmTemplate
+	images    map[int]*image
+	vnets     map[int]*vnet
+	users     map[int]*user
+	groups    map[int]*group
+	hosts     map[int]*host
+	nextID    map[string]int
+}
+
+// NewServer starts a server with the oneadmin and users groups, the oneadmin
+// and serveradmin users and a host, localhost
+func NewServer() *Server {
+	s := &Server{
+		handlers:  map[string]Handler{},
+		latency:   map[string]time.Duration{},
+		vms:       map[int]*vm{},
+		templates: map[int]*vmTemplate{},
+		images:    map[int]*image{},
+		vnets:     map[int]*vnet{},
+		users:     map[int]*user{},
+		groups:    map[int]*group{},
+		hosts:     map[int]*host{},
+		nextID:    map[string]int{},
+	}
+
+	s.addGroup("oneadmin")
+	s.addGroup("users")
+	s.addUser("oneadmin", AdminPassword, "core", []int{0})
+	s.addUser("serveradmin", AdminPassword, "server_cipher", []int{0})
+	s.addHost("localhost", "kvm", "kvm", 0)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Config returns the configuration of a goca client using the server with the
+// oneadmin credentials
+func (s *Server) Config() goca.OneConfig {
+	return goca.OneConfig{
+		Token:     AdminUser + ":" + AdminPassword,
+		XmlrpcURL: s.URL,
+	}
+}
+
+// Hook adds a hook called before the calls of method, or all the calls if
+// method is empty
+func (s *Server) Hook(method string, fn Hook) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, &hook{method: method, fn: fn})
+	s.mu.Unlock()
+}
+
+// FailNext makes the next call of method, or the next call if method is
+// empty, fail with err
+func (s *Server) FailNext(method string, err error) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, &hook{method: method, fn: func(*Call) error { return err }, once: true})
+	s.mu.Unlock()
+}
+
+// Handle makes fn answer the calls of method instead of the model, e.g. to
+// return responses the model can't produce. The calls aren't authenticated,
+// the hooks and the latency still apply. A nil fn restores the model.
+func (s *Server) Handle(method string, fn Handler) {
+	s.mu.Lock()
+	if fn != nil {
+		s.handlers[method] = fn
+	} else {
+		delete(s.handlers, method)
+	}
+	s.mu.Unlock()
+}
+
+// SetLatency delays the responses to the calls of method, or all the calls if
+// method is empty, by latency. 0 removes the delay.
+func (s *Server) SetLatency(method string, latency time.Duration) {
+	s.mu.Lock()
+	if latency > 0 {
+		s.latency[method] = latency
+	} else {
+		delete(s.latency, method)
+	}
+	s.mu.Unlock()
+}
+
+// Calls returns the calls received so far
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	call, err := decodeCall(r)
+	if err != nil {
+		writeResponse(w, nil, &Fault{Code: faultParseError, Message: err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, *call)
+	latency := s.latency[""] + s.latency[call.Method]
+	hooks := s.matchingHooks(call.Method)
+	handler := s.handlers[call.Method]
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for _, h := range hooks {
+		if err := h.fn(call); err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+	}
+
+	if handler != nil {
+		result, err := handler(call)
+		writeResponse(w, result, err)
+		return
+	}
+
+	result, err := s.handle(call)
+	writeResponse(w, result, err)
+}
+
+// matchingHooks returns the hooks of method, and removes the once ones
+func (s *Server) matchingHooks(method string) []*hook {
+	var matching []*hook
+	hooks := s.hooks[:0]
+	for _, h := range s.hooks {
+		if h.method != "" && h.method != method {
+			hooks = append(hooks, h)
+			continue
+		}
+		matching = append(matching, h)
+		if !h.once {
+			hooks = append(hooks, h)
+		}
+	}
+	s.hooks = hooks
+	return matching
+}
+
+// request is a call being handled
+type request struct {
+	*Call
+	user *user
+	err  error
+}
+
+// method handles a call. It returns a string, an int or an error.
+type method func(s *Server, req *request) (interface{}, error)
+
+var methods = map[string]method{}
+
+func (s *Server) handle(call *Call) (interface{}, error) {
+	m, ok := methods[call.Method]
+	if !ok {
+		return nil, &Fault{Code: faultUnknownMethod, Message: fmt.Sprintf("Method '%s' not defined", call.Method)}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req := &request{Call: call}
+	req.user = s.authenticate(call.Session)
+	if req.user == nil {
+		return nil, &Error{Code: authenticationError,
+			Message: fmt.Sprintf("[%s] User couldn't be authenticated, aborting call.", call.Method)}
+	}
+
+	result, err := m(s, req)
+	if req.err != nil {
+		return nil, req.err
+	}
+
+	return result, err
+}
+
+// authenticate returns the user of session, nil if the credentials are wrong
+func (s *Server) authenticate(session string) *user {
+	i := strings.Index(session, ":")
+	if i < 0 {
+		return nil
+	}
+	name, secret := session[:i], session[i+1:]
+
+	for _, u := range s.users {
+		if u.name != name || !u.enabled {
+			continue
+		}
+		if u.password == hashPassword(secret) {
+			return u
+		}
+		if token, ok := u.tokens[secret]; ok && time.Now().Before(token.expiration) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+func hashPassword(password string) string {
+	digest := sha1.Sum([]byte(password))
+	return hex.EncodeToString(digest[:])
+}
+
+// id returns the next ID of a kind of resource
+func (s *Server) id(kind string) int {
+	id := s.nextID[kind]
+	s.nextID[kind] = id + 1
+	return id
+}
+
+// Typed accessors of the parameters. A wrong parameter makes the call fail
+// with a fault.
+
+func (req *request) param(i int) interface{} {
+	if i >= len(req.Params) {
+		if req.err == nil {
+			req.err = &Fault{Code: faultWrongArguments, Message: fmt.Sprintf("Not enough parameters for %s", req.Method)}
+		}
+		return nil
+	}
+	return req.Params[i]
+}
+
+func (req *request) typeMismatch(i int, expected string) {
+	if req.err == nil {
+		req.err = &Fault{Code: faultTypeMismatch,
+			Message: fmt.Sprintf("Type mismatch: parameter %d of %s, %s expected", i+1, req.Method, expected)}
+	}
+}
+
+func (req *request) int(i int) int {
+	v, ok := req.param(i).(int)
+	if !ok && req.err == nil {
+		req.typeMismatch(i, "int")
+	}
+	return v
+}
+
+func (req *request) string(i int) string {
+	v, ok := req.param(i).(string)
+	if !ok && req.err == nil {
+		req.typeMismatch(i, "string")
+	}
+	return v
+}
+
+func (req *request) bool(i int) bool {
+	v, ok := req.param(i).(bool)
+	if !ok && req.err == nil {
+		req.typeMismatch(i, "boolean")
+	}
+	return v
+}
+
+// optInt returns the parameter i if it's set, def otherwise
+func (req *request) optInt(i int, def int) int {
+	if i >= len(req.Params) {
+		return def
+	}
+	return req.int(i)
+}
+
+// template parses the parameter i
+func (req *request) template(i int) *template {
+	t, err := parseTemplate(req.string(i))
+	if err != nil && req.err == nil {
+		req.err = &Error{Code: internalError, Message: fmt.Sprintf("[%s] Parse error: %s", req.Method, err)}
+	}
+	if t == nil {
+		t = &template{}
+	}
+	return t
+}
+
+// notFound is the error of a missing resource
+func notFound(method, resource string, id int) error {
+	return &Error{Code: noExistsError, Message: fmt.Sprintf("[%s] Error getting %s [%d].", method, resource, id)}
+}
+
+// wrongState is the error of an action not allowed in the state of a
+// resource
+func wrongState(method, message string) error {
+	return &Error{Code: actionError, Message: fmt.Sprintf("[%s] %s", method, message)}
+}
+
+// failure is the error of an action that failed
+func failure(method, message string) error {
+	return &Error{Code: internalError, Message: fmt.Sprintf("[%s] %s", method, message)}
+}
+
+// xmlrpcValue is an XML-RPC value of a call
+type xmlrpcValue struct {
+	Text    string  `xml:",chardata"`
+	String  *string `xml:"string"`
+	Int     *string `xml:"int"`
+	I4      *string `xml:"i4"`
+	I8      *string `xml:"i8"`
+	Boolean *string `xml:"boolean"`
+	Double  *string `xml:"double"`
+	Array   *struct {
+		Values []xmlrpcValue `xml:"data>value"`
+	} `xml:"array"`
+}
+
+func (v *xmlrpcValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.Int))
+	case v.I4 != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.I4))
+	case v.I8 != nil:
+		return strconv.Atoi(strings.TrimSpace(*v.I8))
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.Array != nil:
+		values := []interface{}{}
+		for i := range v.Array.Values {
+			value, err := v.Array.Values[i].decode()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	default:
+		return v.Text, nil
+	}
+}
+
+func decodeCall(r *http.Request) (*Call, error) {
+	var req struct {
+		Method string        `xml:"methodName"`
+		Params []xmlrpcValue `xml:"params>param>value"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	call := &Call{Method: req.Method}
+	for i := range req.Params {
+		value, err := req.Params[i].decode()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			session, ok := value.(string)
+			if !ok {
+				return nil, errors.New("the session string is not a string")
+			}
+			call.Session = session
+			continue
+		}
+		call.Params = append(call.Params, value)
+	}
+
+	return call, nil
+}
+
+// writeResponse writes the OpenNebula response [success, result, error code]
+// or a fault
+func writeResponse(w http.ResponseWriter, result interface{}, err error) {
+	w.Header().Set("Content-Type", "text/xml")
+
+	var response xmlWriter
+	response.WriteString(`<?xml version="1.0"?><methodResponse>`)
+
+	if fault, ok := err.(*Fault); ok {
+		response.WriteString(`<fault><value><struct><member><name>faultCode</name><value><i4>`)
+		response.WriteString(strconv.Itoa(fault.Code))
+		response.WriteString(`</i4></value></member><member><name>faultString</name><value>`)
+		response.elem("string", fault.Message)
+		response.WriteString(`</value></member></struct></value></fault></methodResponse>`)
+		w.Write(response.Bytes())
+		return
+	}
+
+	success, code := "1", 0
+	if err != nil {
+		oneErr, ok := err.(*Error)
+		if !ok {
+			oneErr = &Error{Code: internalError, Message: err.Error()}
+		}
+		success, code, result = "0", oneErr.Code, oneErr.Message
+	}
+
+	response.WriteString(`<params><param><value><array><data><value><boolean>` + success + `</boolean></value><value>`)
+	switch r := result.(type) {
+	case int:
+		response.elem("i4", r)
+	case bool:
+		if r {
+			response.elem("boolean", 1)
+		} else {
+			response.elem("boolean", 0)
+		}
+	default:
+		response.elem("string", fmt.Sprint(r))
+	}
+	response.WriteString(`</value><value><i4>` + strconv.Itoa(code) + `</i4></value></data></array></value></param></params></methodResponse>`)
+
+	w.Write(response.Bytes())
+}
+
+// pool filters and orders the resources of a pool call, from the who, start
+// and end parameters at index i
+func (req *request) poolFilter(i int, owned func(id int) (uid, gid int)) func(ids []int) []int {
+	who := req.optInt(i, -2)
+	start := req.optInt(i+1, -1)
+	end := req.optInt(i+2, -1)
+
+	return func(ids []int) []int {
+		var filtered []int
+		for _, id := range ids {
+			if owned != nil {
+				uid, gid := owned(id)
+				switch {
+				case who == -3 && uid != req.user.id,
+					who == -4 && gid != req.user.gid,
+					who == -1 && uid != req.user.id && gid != req.user.gid,
+					who >= 0 && uid != who:
+					continue
+				}
+			}
+			if end >= -1 && start >= 0 && id < start {
+				continue
+			}
+			if end >= 0 && id > end {
+				continue
+			}
+			filtered = append(filtered, id)
+		}
+
+		// The limit form: start is an offset and -end the limit
+		if end < -1 {
+			if start < 0 {
+				start = 0
+			}
+			if start > len(filtered) {
+				start = len(filtered)
+			}
+			filtered = filtered[start:]
+			if len(filtered) > -end {
+				filtered = filtered[:-end]
+			}
+		}
+
+		return filtered
+	}
+}
+
+func init() {
+	methods["one.system.version"] = func(s *Server, req *request) (interface{}, error) {
+		return Version, nil
+	}
+}
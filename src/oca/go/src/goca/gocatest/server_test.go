@@ -0,0 +1,515 @@
+package gocatest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/kolo/xmlrpc"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server := NewServer()
+	goca.SetClient(server.Config())
+	return server
+}
+
+// vmState retrieves the state of a VM, which advances its transient states
+func vmState(t *testing.T, vm *goca.VM) (goca.VMState, goca.LCMState) {
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	state, lcm, err := vm.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, lcm
+}
+
+// waitState retrieves the VM until it is in the state, at most 5 times
+func waitState(t *testing.T, vm *goca.VM, state goca.VMState, lcm goca.LCMState) {
+	for i := 0; i < 5; i++ {
+		if s, l := vmState(t, vm); s == state && (state != goca.Active || l == lcm) {
+			return
+		}
+	}
+	s, l := vmState(t, vm)
+	t.Fatalf("VM %d is %s/%s, expected %s/%s", vm.ID, s, l, state, lcm)
+}
+
+func TestServerVMLifecycle(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	id, err := goca.CreateVM("NAME = test\nCPU = 1\nMEMORY = 64\nLABEL = web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goca.NewVM(id)
+
+	if state, _ := vmState(t, vm); state != goca.Pending {
+		t.Fatalf("expected PENDING, got %s", state)
+	}
+	if vm.Name != "test" || vm.Template.CPU != 1 || vm.Template.Memory != 64 {
+		t.Fatalf("unexpected VM %+v", vm.Template)
+	}
+	if label := vm.UserTemplate.Dynamic.GetContentByName("LABEL"); label != "web" {
+		t.Fatalf("LABEL not in USER_TEMPLATE: %q", label)
+	}
+
+	waitState(t, vm, goca.Active, goca.Running)
+	if vm.DeployID == "" || len(vm.HistoryRecords) != 1 || vm.HistoryRecords[0].Hostname != "localhost" {
+		t.Fatalf("VM not deployed on localhost: %q %+v", vm.DeployID, vm.HistoryRecords)
+	}
+
+	if err := vm.Resize("CPU = 2", false); err == nil {
+		t.Fatal("resize of a running VM should fail")
+	} else if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneActionError {
+		t.Fatalf("expected an action error, got %v", err)
+	}
+
+	if err := vm.Poweroff(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, vm, goca.Poweroff, goca.LcmInit)
+
+	if err := vm.Resize("CPU = 2\nMEMORY = 128", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, vm, goca.Active, goca.Running)
+	if vm.Template.CPU != 2 || vm.Template.Memory != 128 {
+		t.Fatalf("VM not resized: %+v", vm.Template)
+	}
+
+	if err := vm.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, vm, goca.Done, goca.LcmInit)
+
+	if err := vm.Resume(); err == nil {
+		t.Fatal("resume of a DONE VM should fail")
+	}
+
+	err = goca.NewVM(42).Info()
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneNoExistsError {
+		t.Fatalf("expected a no exists error, got %v", err)
+	}
+}
+
+func TestServerNoHost(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	host := goca.NewHost(0)
+	if err := host.Status(1); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goca.NewVM(id)
+	vmState(t, vm)
+	if state, _ := vmState(t, vm); state != goca.Pending {
+		t.Fatalf("expected PENDING, got %s", state)
+	}
+	if !strings.Contains(vm.UserTemplate.SchedMessage, "No hosts") {
+		t.Fatalf("unexpected SCHED_MESSAGE %q", vm.UserTemplate.SchedMessage)
+	}
+}
+
+func TestServerTemplateImageNetwork(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	imageID, err := goca.CreateImage("NAME = os\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vnetID, err := goca.CreateVirtualNetwork("NAME = private\nBRIDGE = br0\nVN_MAD = bridge\n"+
+		"AR = [ TYPE = IP4, IP = 10.0.0.10, SIZE = 2 ]", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templateID, err := goca.CreateTemplate("NAME = tpl\nCPU = 1\nMEMORY = 64\n" +
+		"DISK = [ IMAGE = os ]\nNIC = [ NETWORK = private ]\nCONTEXT = [ NETWORK = YES ]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is LOCKED until it is retrieved once
+	if _, err := goca.NewTemplate(templateID).Instantiate("vm", false, ""); err == nil {
+		t.Fatal("instantiate with a locked image should fail")
+	}
+	if err := goca.NewImage(imageID).Info(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []uint{}
+	for _, name := range []string{"vm0", "vm1"} {
+		id, err := goca.NewTemplate(templateID).Instantiate(name, false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := goca.NewTemplate(templateID).Instantiate("vm2", false, ""); err == nil {
+		t.Fatal("instantiate without free leases should fail")
+	}
+
+	vm := goca.NewVM(ids[1])
+	vmState(t, vm)
+	if len(vm.Template.NIC) != 1 || vm.Template.NIC[0].IP != "10.0.0.11" || vm.Template.NIC[0].Network != "private" {
+		t.Fatalf("unexpected NIC %+v", vm.Template.NIC)
+	}
+	if ip := vm.Template.Context.Dynamic.GetContentByName("ETH0_IP"); ip != "10.0.0.11" {
+		t.Fatalf("unexpected ETH0_IP %q", ip)
+	}
+	if len(vm.Template.Disk) != 1 || vm.Template.Disk[0].Size != 2048 {
+		t.Fatalf("unexpected DISK %+v", vm.Template.Disk)
+	}
+
+	image := goca.NewImage(imageID)
+	if err := image.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := image.State(); state != goca.ImageUsed || len(image.VMsID) != 2 {
+		t.Fatalf("image %s, used by %v", state, image.VMsID)
+	}
+
+	// Terminating a VM frees its lease
+	if err := goca.NewVM(ids[0]).TerminateHard(); err != nil {
+		t.Fatal(err)
+	}
+	vnet := goca.NewVirtualNetwork(vnetID)
+	if err := vnet.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if vnet.UsedLeases != 1 {
+		t.Fatalf("expected 1 used lease, got %d", vnet.UsedLeases)
+	}
+
+	if err := server.SetImageState(uint(imageID), goca.ImageError); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := goca.NewTemplate(templateID).Instantiate("vm3", false, ""); err == nil {
+		t.Fatal("instantiate with an image in error should fail")
+	}
+}
+
+func TestServerHooks(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	server.FailNext("one.vm.allocate", &Error{Code: goca.OneAuthorizationError, Message: "not allowed"})
+	_, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneAuthorizationError {
+		t.Fatalf("expected an authorization error, got %v", err)
+	}
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.FailNext("", errors.New("boom"))
+	err = goca.NewVM(id).Info()
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneInternalError {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+
+	server.FailNext("", &Fault{Code: -501, Message: "wrong type"})
+	err = goca.NewVM(id).Info()
+	if e, ok := err.(*goca.ClientError); !ok || e.Code != goca.ClientRespXMLRPCFault {
+		t.Fatalf("expected an XML-RPC fault, got %v", err)
+	}
+
+	infos := 0
+	server.Hook("one.vm.info", func(call *Call) error {
+		infos++
+		if len(call.Params) != 1 || call.Params[0] != int(id) {
+			t.Errorf("unexpected params %v", call.Params)
+		}
+		return nil
+	})
+	server.SetLatency("one.vm.info", 50*time.Millisecond)
+	start := time.Now()
+	if err := goca.NewVM(id).Info(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("no latency: %s", elapsed)
+	}
+	if infos != 1 {
+		t.Fatalf("hook called %d times", infos)
+	}
+
+	calls := server.Calls()
+	if last := calls[len(calls)-1]; last.Method != "one.vm.info" || last.Session != AdminUser+":"+AdminPassword {
+		t.Fatalf("unexpected last call %+v", last)
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	server.Handle("one.vm.info", func(call *Call) (interface{}, error) {
+		if len(call.Params) != 1 || call.Params[0] != 7 {
+			t.Errorf("unexpected params %v", call.Params)
+		}
+		return "<VM><ID>7</ID><NAME>canned</NAME></VM>", nil
+	})
+	server.Handle("one.vm.action", func(*Call) (interface{}, error) {
+		return nil, &Error{Code: goca.OneActionError, Message: "wrong state"}
+	})
+
+	// The handled calls aren't authenticated
+	goca.SetClient(goca.NewConfig("nobody", "wrong", server.URL))
+	vm := goca.NewVM(7)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Name != "canned" {
+		t.Fatalf("unexpected name %q", vm.Name)
+	}
+	err := vm.Resume()
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneActionError {
+		t.Fatalf("expected an action error, got %v", err)
+	}
+
+	// The hooks still apply, and a nil handler restores the model
+	server.FailNext("one.vm.info", &Error{Code: goca.OneInternalError, Message: "boom"})
+	if err := vm.Info(); err == nil {
+		t.Fatal("the hook didn't fail the handled call")
+	}
+	server.Handle("one.vm.info", nil)
+	err = vm.Info()
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneAuthenticationError {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestServerChown(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	serveradmin, err := goca.NewUserFromName("serveradmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageID, err := goca.CreateImage("NAME = os\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := goca.NewImage(imageID)
+	if err := image.Chown(int(serveradmin.ID), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if image.UID != int(serveradmin.ID) || image.GID != 1 || image.UName != "serveradmin" {
+		t.Fatalf("unexpected owner %d:%d %s", image.UID, image.GID, image.UName)
+	}
+
+	vnetID, err := goca.CreateVirtualNetwork("NAME = private\nBRIDGE = br0\nVN_MAD = bridge", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vnet := goca.NewVirtualNetwork(vnetID)
+	if err := vnet.Chown(-1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := vnet.Chown(42, -1); err == nil {
+		t.Fatal("chown to an unknown user should fail")
+	}
+	if err := vnet.Info(); err != nil {
+		t.Fatal(err)
+	}
+	if vnet.UID != 0 || vnet.GID != 1 {
+		t.Fatalf("unexpected owner %d:%d", vnet.UID, vnet.GID)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	uid, err := goca.CreateUser("alice", "secret", "core", []uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goca.SetClient(goca.NewConfig("alice", "wrong", server.URL))
+	_, err = goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneAuthenticationError {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+
+	goca.SetClient(goca.NewConfig("alice", "secret", server.URL))
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goca.NewVM(id)
+	vmState(t, vm)
+	if vm.UID != int(uid) || vm.GID != 1 || vm.UName != "alice" {
+		t.Fatalf("unexpected owner %d:%d %s", vm.UID, vm.GID, vm.UName)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	session := AdminUser + ":" + AdminPassword
+
+	for _, test := range []struct {
+		method string
+		args   []interface{}
+		code   int
+	}{
+		{"one.vm.info", []interface{}{session}, faultWrongArguments},
+		{"one.vm.info", []interface{}{session, "zero"}, faultTypeMismatch},
+		{"one.vm.unknown", []interface{}{session}, faultUnknownMethod},
+	} {
+		req, err := xmlrpc.NewRequest(server.URL, test.method, test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = xmlrpc.NewResponse(body).Err()
+		if fault, ok := err.(xmlrpc.FaultError); !ok || fault.Code != test.code {
+			t.Errorf("%s%v: expected the fault %d, got %v", test.method, test.args[1:], test.code, err)
+		}
+	}
+}
+
+func TestServerPoolLimit(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A negative offset is the first page
+	for _, test := range []struct {
+		start, end int
+		ids        []uint
+	}{
+		{0, -2, []uint{0, 1}},
+		{-1, -2, []uint{0, 1}},
+		{2, -2, []uint{2}},
+		{5, -2, nil},
+	} {
+		pool, err := goca.NewVMPoolWithOptions(goca.PoolOptions{Who: -2, Start: test.start, End: test.end})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint
+		for _, vm := range pool.VMs {
+			ids = append(ids, vm.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+			t.Errorf("start=%d, end=%d: expected %v, got %v", test.start, test.end, test.ids, ids)
+		}
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	uid, err := goca.CreateUser("alice", "secret", "core", []uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goca.NewUser(uid).Quota("VM = [ VMS = 2, CPU = 1.5, MEMORY = -2 ]"); err != nil {
+		t.Fatal(err)
+	}
+
+	goca.SetClient(goca.NewConfig("alice", "secret", server.URL))
+	if _, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneAuthorizationError {
+		t.Fatalf("expected an authorization error, got %v", err)
+	}
+
+	user, err := goca.CurrentUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != uid || len(user.VMQuotas) != 1 {
+		t.Fatalf("unexpected user %d %+v", user.ID, user.VMQuotas)
+	}
+	q := user.VMQuotas[0]
+	if q.VMs != "2" || q.VMsUsed != "1" || q.CPU != "1.5" || q.CPUUsed != "1" || q.Memory != "-2" || q.MemoryUsed != "64" {
+		t.Fatalf("unexpected VM quota %+v", q)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tpl, err := parseTemplate(`NAME = "a b" # comment
+cpu = 0.5
+DISK = [ IMAGE = "os", SIZE = 10 ]
+DISK = [
+  SIZE = 20,
+  TYPE = fs
+]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := tpl.get("NAME"); name != "a b" {
+		t.Fatalf("NAME %q", name)
+	}
+	if cpu, _ := tpl.get("CPU"); cpu != "0.5" {
+		t.Fatalf("CPU %q", cpu)
+	}
+	disks := tpl.vectors("DISK")
+	if len(disks) != 2 {
+		t.Fatalf("%d disks", len(disks))
+	}
+	if size, _ := disks[1].get("SIZE"); size != "20" {
+		t.Fatalf("SIZE %q", size)
+	}
+
+	xmlTpl, err := parseTemplate("<TEMPLATE><NAME>x</NAME><NIC><NETWORK>n</NETWORK></NIC></TEMPLATE>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nics := xmlTpl.vectors("NIC"); len(nics) != 1 {
+		t.Fatalf("%d nics", len(nics))
+	} else if network, _ := nics[0].get("NETWORK"); network != "n" {
+		t.Fatalf("NETWORK %q", network)
+	}
+
+	for _, s := range []string{"NAME = \"a", "DISK = [ SIZE = 1", "= 1"} {
+		if _, err := parseTemplate(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package gocatest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// template is a resource template, made of single and vector attributes
+type template struct {
+	attrs []*attribute
+}
+
+type attribute struct {
+	name  string
+	value string
+
+	// pairs is not nil for the vector attributes
+	pairs []pair
+}
+
+type pair struct {
+	name  string
+	value string
+}
+
+// parseTemplate parses a template in the OpenNebula syntax or in XML
+func parseTemplate(s string) (*template, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "<") {
+		return parseXMLTemplate(s)
+	}
+
+	p := &templateParser{s: s}
+	t := &template{}
+
+	for {
+		p.skipSpaces(true)
+		if p.eof() {
+			return t, nil
+		}
+
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces(false)
+		if !p.accept('=') {
+			return nil, p.errorf("'=' expected after %s", name)
+		}
+		p.skipSpaces(false)
+
+		if !p.accept('[') {
+			value, err := p.value(false)
+			if err != nil {
+				return nil, err
+			}
+			t.attrs = append(t.attrs, &attribute{name: name, value: value})
+			continue
+		}
+
+		attr := &attribute{name: name, pairs: []pair{}}
+		for {
+			p.skipSpaces(true)
+			if p.accept(']') {
+				break
+			}
+			if len(attr.pairs) > 0 && !p.accept(',') {
+				return nil, p.errorf("',' or ']' expected in %s", name)
+			}
+			p.skipSpaces(true)
+
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpaces(true)
+			if !p.accept('=') {
+				return nil, p.errorf("'=' expected after %s", key)
+			}
+			p.skipSpaces(true)
+			value, err := p.value(true)
+			if err != nil {
+				return nil, err
+			}
+			attr.pairs = append(attr.pairs, pair{name: key, value: value})
+		}
+		t.attrs = append(t.attrs, attr)
+	}
+}
+
+type templateParser struct {
+	s   string
+	pos int
+}
+
+func (p *templateParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *templateParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skipSpaces skips the spaces, the new lines too if newLines, and the
+// comments
+func (p *templateParser) skipSpaces(newLines bool) {
+	for !p.eof() {
+		c := p.s[p.pos]
+		switch {
+		case c == '#' && newLines:
+			for !p.eof() && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\r' || (newLines && c == '\n'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *templateParser) accept(c byte) bool {
+	if !p.eof() && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *templateParser) name() (string, error) {
+	start := p.pos
+	for !p.eof() {
+		c := rune(p.s[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '-' {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("attribute name expected")
+	}
+	return strings.ToUpper(p.s[start:p.pos]), nil
+}
+
+// value parses a quoted value, or an unquoted one until the end of the line,
+// or a ',' or ']' in a vector
+func (p *templateParser) value(inVector bool) (string, error) {
+	if p.accept('"') {
+		var buf bytes.Buffer
+		for {
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			c := p.s[p.pos]
+			p.pos++
+			switch {
+			case c == '\\' && !p.eof() && (p.s[p.pos] == '"' || p.s[p.pos] == '\\'):
+				buf.WriteByte(p.s[p.pos])
+				p.pos++
+			case c == '"':
+				return buf.String(), nil
+			default:
+				buf.WriteByte(c)
+			}
+		}
+	}
+
+	start := p.pos
+	for !p.eof() {
+		c := p.s[p.pos]
+		if c == '\n' || (inVector && (c == ',' || c == ']')) {
+			break
+		}
+		p.pos++
+	}
+	return strings.TrimSpace(p.s[start:p.pos]), nil
+}
+
+func parseXMLTemplate(s string) (*template, error) {
+	var root struct {
+		Nodes []struct {
+			XMLName xml.Name
+			Content string `xml:",chardata"`
+			Nodes   []struct {
+				XMLName xml.Name
+				Content string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal([]byte(s), &root); err != nil {
+		return nil, err
+	}
+
+	t := &template{}
+	for _, n := range root.Nodes {
+		name := strings.ToUpper(n.XMLName.Local)
+		if len(n.Nodes) == 0 {
+			t.attrs = append(t.attrs, &attribute{name: name, value: n.Content})
+			continue
+		}
+		attr := &attribute{name: name, pairs: []pair{}}
+		for _, p := range n.Nodes {
+			attr.pairs = append(attr.pairs, pair{name: strings.ToUpper(p.XMLName.Local), value: p.Content})
+		}
+		t.attrs = append(t.attrs, attr)
+	}
+
+	return t, nil
+}
+
+// get returns the value of the single attribute name
+func (t *template) get(name string) (string, bool) {
+	for _, attr := range t.attrs {
+		if attr.name == name && attr.pairs == nil {
+			return attr.value, true
+		}
+	}
+	return "", false
+}
+
+// set replaces the attributes name by a single attribute
+func (t *template) set(name, value string) {
+	t.del(name)
+	t.attrs = append(t.attrs, &attribute{name: name, value: value})
+}
+
+func (t *template) del(name string) {
+	attrs := t.attrs[:0]
+	for _, attr := range t.attrs {
+		if attr.name != name {
+			attrs = append(attrs, attr)
+		}
+	}
+	t.attrs = attrs
+}
+
+// vectors returns the vector attributes name
+func (t *template) vectors(name string) []*attribute {
+	var vectors []*attribute
+	for _, attr := range t.attrs {
+		if attr.name == name && attr.pairs != nil {
+			vectors = append(vectors, attr)
+		}
+	}
+	return vectors
+}
+
+// take removes the attributes name from t, and returns them
+func (t *template) take(name string) []*attribute {
+	var taken []*attribute
+	attrs := t.attrs[:0]
+	for _, attr := range t.attrs {
+		if attr.name == name {
+			taken = append(taken, attr)
+		} else {
+			attrs = append(attrs, attr)
+		}
+	}
+	t.attrs = attrs
+	return taken
+}
+
+// merge replaces the attributes of t by the ones of other with the same name,
+// and appends the others
+func (t *template) merge(other *template) {
+	for _, attr := range other.attrs {
+		t.del(attr.name)
+	}
+	for _, attr := range other.attrs {
+		t.attrs = append(t.attrs, attr.clone())
+	}
+}
+
+func (t *template) clone() *template {
+	c := &template{}
+	for _, attr := range t.attrs {
+		c.attrs = append(c.attrs, attr.clone())
+	}
+	return c
+}
+
+func (t *template) writeXML(w *xmlWriter, root string) {
+	w.open(root)
+	for _, attr := range t.attrs {
+		if attr.pairs == nil {
+			w.elem(attr.name, attr.value)
+			continue
+		}
+		w.open(attr.name)
+		for _, p := range attr.pairs {
+			w.elem(p.name, p.value)
+		}
+		w.close(attr.name)
+	}
+	w.close(root)
+}
+
+func (a *attribute) clone() *attribute {
+	c := &attribute{name: a.name, value: a.value}
+	if a.pairs != nil {
+		c.pairs = append([]pair{}, a.pairs...)
+	}
+	return c
+}
+
+// get returns the value of the pair name of a vector
+func (a *attribute) get(name string) (string, bool) {
+	for _, p := range a.pairs {
+		if p.name == name {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// set adds or replaces the pair name of a vector
+func (a *attribute) set(name, value string) {
+	for i := range a.pairs {
+		if a.pairs[i].name == name {
+			a.pairs[i].value = value
+			return
+		}
+	}
+	a.pairs = append(a.pairs, pair{name: name, value: value})
+}
+
+// xmlWriter writes the XML documents of the responses
+type xmlWriter struct {
+	bytes.Buffer
+}
+
+func (w *xmlWriter) open(name string) {
+	w.WriteString("<" + name + ">")
+}
+
+func (w *xmlWriter) close(name string) {
+	w.WriteString("</" + name + ">")
+}
+
+func (w *xmlWriter) elem(name string, value interface{}) {
+	w.open(name)
+	xml.EscapeText(w, []byte(fmt.Sprint(value)))
+	w.close(name)
+}
+
+// ids writes the list of IDs in a name element
+func (w *xmlWriter) ids(name string, ids []int) {
+	w.open(name)
+	for _, id := range ids {
+		w.elem("ID", id)
+	}
+	w.close(name)
+}
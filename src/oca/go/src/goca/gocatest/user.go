@@ -0,0 +1,539 @@
+package gocatest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type user struct {
+	id       int
+	name     string
+	password string
+	driver   string
+	gid      int
+	groups   []int
+	enabled  bool
+	template *template
+	tokens   map[string]loginToken
+
+	// vmQuota are the limits of the VM quota, -1 and -2 for no limit
+	vmQuota map[string]float64
+}
+
+type loginToken struct {
+	expiration time.Time
+	egid       int
+}
+
+type group struct {
+	id       int
+	name     string
+	template *template
+}
+
+type host struct {
+	id        int
+	name      string
+	im        string
+	vmm       string
+	clusterID int
+	state     int
+	template  *template
+}
+
+// Host states
+const (
+	hostMonitored = 2
+	hostDisabled  = 4
+	hostOffline   = 8
+)
+
+func (s *Server) addGroup(name string) *group {
+	g := &group{id: s.id("group"), name: name, template: &template{}}
+	s.groups[g.id] = g
+	return g
+}
+
+func (s *Server) addUser(name, password, driver string, groups []int) *user {
+	if driver == "" {
+		driver = "core"
+	}
+	u := &user{
+		id:       s.id("user"),
+		name:     name,
+		password: hashPassword(password),
+		driver:   driver,
+		gid:      groups[0],
+		groups:   groups,
+		enabled:  true,
+		template: &template{},
+		tokens:   map[string]loginToken{},
+	}
+	s.users[u.id] = u
+	return u
+}
+
+func (s *Server) addHost(name, im, vmm string, clusterID int) *host {
+	h := &host{
+		id:        s.id("host"),
+		name:      name,
+		im:        im,
+		vmm:       vmm,
+		clusterID: clusterID,
+		state:     hostMonitored,
+		template:  &template{},
+	}
+	s.hosts[h.id] = h
+	return h
+}
+
+func (s *Server) userName(id int) string {
+	if u, ok := s.users[id]; ok {
+		return u.name
+	}
+	return ""
+}
+
+// chown changes the owner and the group of a resource to the ones of the
+// parameters 1 and 2, -1 keeps them
+func (s *Server) chown(req *request, uid, gid *int) error {
+	newUID, newGID := req.int(1), req.int(2)
+	if req.err != nil {
+		return nil
+	}
+	if newUID > -1 {
+		if _, ok := s.users[newUID]; !ok {
+			return notFound(req.Method, "user", newUID)
+		}
+	}
+	if newGID > -1 {
+		if _, ok := s.groups[newGID]; !ok {
+			return notFound(req.Method, "group", newGID)
+		}
+	}
+
+	if newUID > -1 {
+		*uid = newUID
+	}
+	if newGID > -1 {
+		*gid = newGID
+	}
+	return nil
+}
+
+func (s *Server) groupName(id int) string {
+	if g, ok := s.groups[id]; ok {
+		return g.name
+	}
+	return ""
+}
+
+func sortedIDs(n int, each func(add func(id int))) []int {
+	ids := make([]int, 0, n)
+	each(func(id int) { ids = append(ids, id) })
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *Server) userIDs() []int {
+	return sortedIDs(len(s.users), func(add func(int)) {
+		for id := range s.users {
+			add(id)
+		}
+	})
+}
+
+func (s *Server) groupIDs() []int {
+	return sortedIDs(len(s.groups), func(add func(int)) {
+		for id := range s.groups {
+			add(id)
+		}
+	})
+}
+
+func (s *Server) hostIDs() []int {
+	return sortedIDs(len(s.hosts), func(add func(int)) {
+		for id := range s.hosts {
+			add(id)
+		}
+	})
+}
+
+func (s *Server) writeUser(w *xmlWriter, u *user, extended bool) {
+	w.open("USER")
+	w.elem("ID", u.id)
+	w.elem("GID", u.gid)
+	w.ids("GROUPS", u.groups)
+	w.elem("GNAME", s.groupName(u.gid))
+	w.elem("NAME", u.name)
+	w.elem("PASSWORD", u.password)
+	w.elem("AUTH_DRIVER", u.driver)
+	if u.enabled {
+		w.elem("ENABLED", 1)
+	} else {
+		w.elem("ENABLED", 0)
+	}
+	if extended {
+		for token, t := range u.tokens {
+			w.open("LOGIN_TOKEN")
+			w.elem("TOKEN", token)
+			w.elem("EXPIRATION_TIME", t.expiration.Unix())
+			w.elem("EGID", t.egid)
+			w.close("LOGIN_TOKEN")
+		}
+	}
+	u.template.writeXML(w, "TEMPLATE")
+	if extended {
+		s.writeQuotas(w, u)
+	}
+	w.close("USER")
+}
+
+func (s *Server) writeGroup(w *xmlWriter, g *group) {
+	w.open("GROUP")
+	w.elem("ID", g.id)
+	w.elem("NAME", g.name)
+	var users []int
+	for _, id := range s.userIDs() {
+		for _, gid := range s.users[id].groups {
+			if gid == g.id {
+				users = append(users, id)
+			}
+		}
+	}
+	w.ids("USERS", users)
+	w.ids("ADMINS", nil)
+	g.template.writeXML(w, "TEMPLATE")
+	w.close("GROUP")
+}
+
+func (s *Server) writeHost(w *xmlWriter, h *host) {
+	var vms []int
+	cpu, memory := 0, 0
+	for _, id := range s.vmIDs() {
+		vm := s.vms[id]
+		if vm.hostID == h.id && vm.onHost() {
+			vms = append(vms, id)
+			cpu += int(vm.cpu() * 100)
+			memory += vm.memory() * 1024
+		}
+	}
+
+	w.open("HOST")
+	w.elem("ID", h.id)
+	w.elem("NAME", h.name)
+	w.elem("STATE", h.state)
+	w.elem("IM_MAD", h.im)
+	w.elem("VM_MAD", h.vmm)
+	w.elem("LAST_MON_TIME", time.Now().Unix())
+	w.elem("CLUSTER_ID", h.clusterID)
+	w.elem("CLUSTER", "default")
+	w.open("HOST_SHARE")
+	w.elem("DISK_USAGE", 0)
+	w.elem("MEM_USAGE", memory)
+	w.elem("CPU_USAGE", cpu)
+	w.elem("TOTAL_MEM", 16*1024*1024)
+	w.elem("TOTAL_CPU", 800)
+	w.elem("MAX_DISK", 100*1024)
+	w.elem("MAX_MEM", 16*1024*1024)
+	w.elem("MAX_CPU", 800)
+	w.elem("FREE_DISK", 100*1024)
+	w.elem("FREE_MEM", 16*1024*1024-memory)
+	w.elem("FREE_CPU", 800-cpu)
+	w.elem("USED_DISK", 0)
+	w.elem("USED_MEM", memory)
+	w.elem("USED_CPU", cpu)
+	w.elem("RUNNING_VMS", len(vms))
+	w.close("HOST_SHARE")
+	w.ids("VMS", vms)
+	h.template.writeXML(w, "TEMPLATE")
+	w.close("HOST")
+}
+
+func newToken() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func init() {
+	methods["one.user.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		name, password, driver := req.string(0), req.string(1), req.string(2)
+		groups := []int{1}
+		if len(req.Params) > 3 {
+			if list, ok := req.param(3).([]interface{}); ok && len(list) > 0 {
+				groups = nil
+				for _, g := range list {
+					gid, _ := g.(int)
+					if _, ok := s.groups[gid]; !ok {
+						return nil, failure(req.Method, fmt.Sprintf("Group %d does not exist", gid))
+					}
+					groups = append(groups, gid)
+				}
+			}
+		}
+		if req.err != nil {
+			return nil, nil
+		}
+
+		for _, u := range s.users {
+			if u.name == name {
+				return nil, failure(req.Method, "NAME is already taken by USER "+fmt.Sprint(u.id)+".")
+			}
+		}
+
+		return s.addUser(name, password, driver, groups).id, nil
+	}
+
+	methods["one.user.info"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		if id == -1 {
+			id = req.user.id
+		}
+		u, ok := s.users[id]
+		if !ok {
+			return nil, notFound(req.Method, "user", id)
+		}
+		var w xmlWriter
+		s.writeUser(&w, u, true)
+		return w.String(), nil
+	}
+
+	methods["one.user.delete"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		if _, ok := s.users[id]; !ok {
+			return nil, notFound(req.Method, "user", id)
+		}
+		if id == 0 {
+			return nil, wrongState(req.Method, "oneadmin cannot be deleted.")
+		}
+		delete(s.users, id)
+		return id, nil
+	}
+
+	methods["one.user.passwd"] = func(s *Server, req *request) (interface{}, error) {
+		id, password := req.int(0), req.string(1)
+		u, ok := s.users[id]
+		if !ok {
+			return nil, notFound(req.Method, "user", id)
+		}
+		u.password = hashPassword(password)
+		return id, nil
+	}
+
+	methods["one.user.update"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		u, ok := s.users[id]
+		if !ok {
+			return nil, notFound(req.Method, "user", id)
+		}
+		req.updateTemplate(&u.template, 1)
+		return id, nil
+	}
+
+	methods["one.user.chgrp"] = func(s *Server, req *request) (interface{}, error) {
+		id, gid := req.int(0), req.int(1)
+		u, ok := s.users[id]
+		if !ok {
+			return nil, notFound(req.Method, "user", id)
+		}
+		if _, ok := s.groups[gid]; !ok {
+			return nil, notFound(req.Method, "group", gid)
+		}
+		u.gid = gid
+		u.groups = append([]int{gid}, u.groups...)
+		return id, nil
+	}
+
+	methods["one.user.login"] = func(s *Server, req *request) (interface{}, error) {
+		name, token, valid, egid := req.string(0), req.string(1), req.int(2), req.optInt(3, -1)
+		var u *user
+		for _, candidate := range s.users {
+			if candidate.name == name {
+				u = candidate
+			}
+		}
+		if u == nil {
+			return nil, failure(req.Method, "Error getting user "+name)
+		}
+
+		if valid == 0 {
+			delete(u.tokens, token)
+			return token, nil
+		}
+		if token == "" {
+			token = newToken()
+		}
+		expiration := time.Now().Add(time.Duration(valid) * time.Second)
+		if valid < 0 {
+			expiration = time.Now().AddDate(100, 0, 0)
+		}
+		u.tokens[token] = loginToken{expiration: expiration, egid: egid}
+
+		return token, nil
+	}
+
+	methods["one.userpool.info"] = func(s *Server, req *request) (interface{}, error) {
+		var w xmlWriter
+		w.open("USER_POOL")
+		for _, id := range s.userIDs() {
+			s.writeUser(&w, s.users[id], false)
+		}
+		w.close("USER_POOL")
+		return w.String(), nil
+	}
+
+	methods["one.group.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		name := req.string(0)
+		for _, g := range s.groups {
+			if g.name == name {
+				return nil, failure(req.Method, "NAME is already taken by GROUP "+fmt.Sprint(g.id)+".")
+			}
+		}
+		return s.addGroup(name).id, nil
+	}
+
+	methods["one.group.info"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		if id == -1 {
+			id = req.user.gid
+		}
+		g, ok := s.groups[id]
+		if !ok {
+			return nil, notFound(req.Method, "group", id)
+		}
+		var w xmlWriter
+		s.writeGroup(&w, g)
+		return w.String(), nil
+	}
+
+	methods["one.group.delete"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		if _, ok := s.groups[id]; !ok {
+			return nil, notFound(req.Method, "group", id)
+		}
+		for _, u := range s.users {
+			for _, gid := range u.groups {
+				if gid == id {
+					return nil, wrongState(req.Method, "Group has users.")
+				}
+			}
+		}
+		delete(s.groups, id)
+		return id, nil
+	}
+
+	methods["one.group.update"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		g, ok := s.groups[id]
+		if !ok {
+			return nil, notFound(req.Method, "group", id)
+		}
+		req.updateTemplate(&g.template, 1)
+		return id, nil
+	}
+
+	methods["one.grouppool.info"] = func(s *Server, req *request) (interface{}, error) {
+		var w xmlWriter
+		w.open("GROUP_POOL")
+		for _, id := range s.groupIDs() {
+			s.writeGroup(&w, s.groups[id])
+		}
+		w.close("GROUP_POOL")
+		return w.String(), nil
+	}
+
+	methods["one.host.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		name, im, vmm, clusterID := req.string(0), req.string(1), req.string(2), req.optInt(3, -1)
+		if clusterID < 0 {
+			clusterID = 0
+		}
+		for _, h := range s.hosts {
+			if h.name == name {
+				return nil, failure(req.Method, "NAME is already taken by HOST "+fmt.Sprint(h.id)+".")
+			}
+		}
+		return s.addHost(name, im, vmm, clusterID).id, nil
+	}
+
+	methods["one.host.info"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		h, ok := s.hosts[id]
+		if !ok {
+			return nil, notFound(req.Method, "host", id)
+		}
+		var w xmlWriter
+		s.writeHost(&w, h)
+		return w.String(), nil
+	}
+
+	methods["one.host.delete"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		if _, ok := s.hosts[id]; !ok {
+			return nil, notFound(req.Method, "host", id)
+		}
+		for _, vm := range s.vms {
+			if vm.hostID == id && vm.onHost() {
+				return nil, wrongState(req.Method, "Can not remove a host with running VMs")
+			}
+		}
+		delete(s.hosts, id)
+		return id, nil
+	}
+
+	methods["one.host.status"] = func(s *Server, req *request) (interface{}, error) {
+		id, status := req.int(0), req.int(1)
+		h, ok := s.hosts[id]
+		if !ok {
+			return nil, notFound(req.Method, "host", id)
+		}
+		switch status {
+		case 0:
+			h.state = hostMonitored
+		case 1:
+			h.state = hostDisabled
+		case 2:
+			h.state = hostOffline
+		default:
+			return nil, failure(req.Method, "Wrong status")
+		}
+		return id, nil
+	}
+
+	methods["one.host.update"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		h, ok := s.hosts[id]
+		if !ok {
+			return nil, notFound(req.Method, "host", id)
+		}
+		req.updateTemplate(&h.template, 1)
+		return id, nil
+	}
+
+	methods["one.hostpool.info"] = func(s *Server, req *request) (interface{}, error) {
+		var w xmlWriter
+		w.open("HOST_POOL")
+		for _, id := range s.hostIDs() {
+			s.writeHost(&w, s.hosts[id])
+		}
+		w.close("HOST_POOL")
+		return w.String(), nil
+	}
+}
+
+// updateTemplate replaces the template t by the parameter i, or merges it
+// into t if the parameter i+1 is 1
+func (req *request) updateTemplate(t **template, i int) {
+	update, appendTemplate := req.template(i), req.int(i+1)
+	if req.err != nil {
+		return
+	}
+	if appendTemplate == 1 {
+		(*t).merge(update)
+		return
+	}
+	*t = update
+}
@@ -0,0 +1,712 @@
+package gocatest
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+)
+
+// vmTemplateAttributes are the attributes kept in the TEMPLATE of the VMs,
+// the others go to the USER_TEMPLATE
+var vmTemplateAttributes = map[string]bool{
+	"CPU": true, "VCPU": true, "MEMORY": true, "DISK": true, "NIC": true, "NIC_ALIAS": true,
+	"NIC_DEFAULT": true, "CONTEXT": true, "GRAPHICS": true, "OS": true, "FEATURES": true,
+	"RAW": true, "INPUT": true, "PCI": true, "VMGROUP": true, "TOPOLOGY": true, "TEMPLATE_ID": true,
+}
+
+type vm struct {
+	id       int
+	uid, gid int
+	name     string
+
+	state                  goca.VMState
+	lcm                    goca.LCMState
+	prevState              goca.VMState
+	prevLCM                goca.LCMState
+	resched                bool
+	stime, etime           int64
+	hostID                 int
+	history                []history
+	template, userTemplate *template
+	leases                 map[*vnet]bool
+	images                 []*image
+}
+
+type history struct {
+	hostID       int
+	hostname     string
+	stime, etime int64
+}
+
+func (s *Server) vmIDs() []int {
+	return sortedIDs(len(s.vms), func(add func(int)) {
+		for id := range s.vms {
+			add(id)
+		}
+	})
+}
+
+func (vm *vm) cpu() float64 {
+	value, _ := vm.template.get("CPU")
+	cpu, _ := strconv.ParseFloat(value, 64)
+	return cpu
+}
+
+func (vm *vm) memory() int {
+	value, _ := vm.template.get("MEMORY")
+	memory, _ := strconv.Atoi(value)
+	return memory
+}
+
+// onHost is true if the VM uses the resources of its host
+func (vm *vm) onHost() bool {
+	return vm.hostID >= 0 && (vm.state == goca.Active || vm.state == goca.Poweroff || vm.state == goca.Suspended)
+}
+
+func (vm *vm) setState(state goca.VMState, lcm goca.LCMState) {
+	vm.prevState, vm.prevLCM = vm.state, vm.lcm
+	vm.state, vm.lcm = state, lcm
+}
+
+// SetVMState forces the state of a VM, e.g. to simulate a failure
+func (s *Server) SetVMState(id uint, state goca.VMState, lcm goca.LCMState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[int(id)]
+	if !ok {
+		return fmt.Errorf("VM %d not found", id)
+	}
+	if state == goca.Done {
+		s.done(vm)
+		return nil
+	}
+	vm.setState(state, lcm)
+	return nil
+}
+
+// SetVMAttribute sets an attribute of the USER_TEMPLATE of a VM, e.g. ERROR
+func (s *Server) SetVMAttribute(id uint, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[int(id)]
+	if !ok {
+		return fmt.Errorf("VM %d not found", id)
+	}
+	vm.userTemplate.set(key, value)
+	return nil
+}
+
+// allocateVM creates a VM from t: it gets the images of its disks and the
+// leases of its NICs
+func (s *Server) allocateVM(req *request, t *template, hold bool) (vm *vm, err error) {
+	t = t.clone()
+	id := s.nextID["vm"]
+
+	vm = newVM(id, req.user)
+	allocated := vm
+
+	defer func() {
+		if err != nil {
+			s.releaseResources(allocated)
+			if _, ok := err.(*Error); !ok {
+				err = failure(req.Method, err.Error())
+			}
+		}
+	}()
+
+	if name, ok := t.get("NAME"); ok {
+		vm.name = name
+	} else {
+		vm.name = fmt.Sprintf("one-%d", id)
+	}
+	t.del("NAME")
+
+	if _, ok := t.get("MEMORY"); !ok {
+		return nil, fmt.Errorf("No MEMORY in template")
+	}
+	if vm.template, vm.userTemplate = splitVMTemplate(t); vm.cpu() <= 0 {
+		return nil, fmt.Errorf("CPU attribute must be a positive float or integer value")
+	}
+	if vm.memory() <= 0 {
+		return nil, fmt.Errorf("MEMORY attribute must be a positive integer value")
+	}
+
+	for i, disk := range vm.template.vectors("DISK") {
+		if err := s.attachDisk(vm, disk, i); err != nil {
+			return nil, err
+		}
+	}
+
+	context := vm.template.vectors("CONTEXT")
+	for i, nic := range vm.template.vectors("NIC") {
+		if err := s.attachNIC(vm, nic, i); err != nil {
+			return nil, err
+		}
+		if len(context) > 0 {
+			if network, _ := context[0].get("NETWORK"); network == "YES" {
+				ip, _ := nic.get("IP")
+				mac, _ := nic.get("MAC")
+				context[0].set(fmt.Sprintf("ETH%d_IP", i), ip)
+				context[0].set(fmt.Sprintf("ETH%d_MAC", i), mac)
+			}
+		}
+	}
+
+	vm.template.set("VMID", strconv.Itoa(id))
+	if hold {
+		vm.state = goca.Hold
+	}
+
+	if err := s.checkVMQuota(req.Method, vm); err != nil {
+		return nil, err
+	}
+
+	s.id("vm")
+	s.vms[id] = vm
+	return vm, nil
+}
+
+func newVM(id int, u *user) *vm {
+	return &vm{
+		id:     id,
+		uid:    u.id,
+		gid:    u.gid,
+		state:  goca.Pending,
+		stime:  time.Now().Unix(),
+		hostID: -1,
+		leases: map[*vnet]bool{},
+	}
+}
+
+// splitVMTemplate returns the TEMPLATE and USER_TEMPLATE of a VM
+func splitVMTemplate(t *template) (*template, *template) {
+	vmTemplate, userTemplate := &template{}, &template{}
+	for _, attr := range t.attrs {
+		if vmTemplateAttributes[attr.name] {
+			vmTemplate.attrs = append(vmTemplate.attrs, attr)
+		} else {
+			userTemplate.attrs = append(userTemplate.attrs, attr)
+		}
+	}
+	return vmTemplate, userTemplate
+}
+
+func (s *Server) attachDisk(vm *vm, disk *attribute, diskID int) error {
+	disk.set("DISK_ID", strconv.Itoa(diskID))
+
+	_, byName := disk.get("IMAGE")
+	_, byID := disk.get("IMAGE_ID")
+	if !byName && !byID {
+		// Volatile disk
+		if size, ok := disk.get("SIZE"); !ok || size == "" {
+			return fmt.Errorf("No SIZE in volatile DISK %d", diskID)
+		}
+		if _, ok := disk.get("TYPE"); !ok {
+			disk.set("TYPE", "fs")
+		}
+		return nil
+	}
+
+	img, err := s.findImage(disk, vm.uid)
+	if err != nil {
+		return err
+	}
+	if img.state != goca.ImageReady && !(img.state == goca.ImageUsed && !img.persistent) {
+		return fmt.Errorf("Image %d is not in READY state", img.id)
+	}
+
+	size := img.size
+	if value, ok := disk.get("SIZE"); ok {
+		requested, err := strconv.Atoi(value)
+		if err != nil || requested < img.size {
+			return fmt.Errorf("DISK %d SIZE must be greater than the image size %d", diskID, img.size)
+		}
+		size = requested
+	}
+
+	disk.set("IMAGE", img.name)
+	disk.set("IMAGE_ID", strconv.Itoa(img.id))
+	disk.set("IMAGE_UNAME", s.userName(img.uid))
+	disk.set("DATASTORE_ID", strconv.Itoa(img.datastoreID))
+	disk.set("ORIGINAL_SIZE", strconv.Itoa(img.size))
+	disk.set("SIZE", strconv.Itoa(size))
+	if img.persistent {
+		disk.set("PERSISTENT", "YES")
+	}
+
+	img.vms = append(img.vms, vm.id)
+	img.state = goca.ImageUsed
+	vm.images = append(vm.images, img)
+
+	return nil
+}
+
+func (s *Server) attachNIC(vm *vm, nic *attribute, nicID int) error {
+	n, err := s.findVNet(nic, vm.uid)
+	if err != nil {
+		return err
+	}
+
+	ip, _ := nic.get("IP")
+	mac, _ := nic.get("MAC")
+	l, err := n.allocate(vm.id, ip, mac)
+	if err != nil {
+		return err
+	}
+	vm.leases[n] = true
+
+	nic.set("NIC_ID", strconv.Itoa(nicID))
+	nic.set("NETWORK", n.name)
+	nic.set("NETWORK_ID", strconv.Itoa(n.id))
+	nic.set("NETWORK_UNAME", s.userName(n.uid))
+	nic.set("AR_ID", strconv.Itoa(l.ar.id))
+	nic.set("BRIDGE", n.bridge)
+	nic.set("VN_MAD", n.vnMad)
+	nic.set("MAC", l.ar.macAt(l.index))
+	if l.ar.hasIPv4() {
+		nic.set("IP", l.ar.ipAt(l.index))
+	}
+	if l.ar.globalPrefix != "" {
+		nic.set("IP6_GLOBAL", l.ar.ip6At(l.ar.globalPrefix, l.index))
+	}
+	if l.ar.ulaPrefix != "" {
+		nic.set("IP6_ULA", l.ar.ip6At(l.ar.ulaPrefix, l.index))
+	}
+
+	return nil
+}
+
+// releaseResources frees the leases and the images of a VM
+func (s *Server) releaseResources(vm *vm) {
+	for n := range vm.leases {
+		n.release(vm.id)
+	}
+	vm.leases = map[*vnet]bool{}
+
+	for _, img := range vm.images {
+		vms := img.vms[:0]
+		for _, id := range img.vms {
+			if id != vm.id {
+				vms = append(vms, id)
+			}
+		}
+		img.vms = vms
+		if len(vms) == 0 && img.state == goca.ImageUsed {
+			img.state = goca.ImageReady
+		}
+	}
+	vm.images = nil
+}
+
+func (s *Server) done(vm *vm) {
+	vm.setState(goca.Done, goca.LcmInit)
+	vm.etime = time.Now().Unix()
+	s.leaveHost(vm)
+	s.releaseResources(vm)
+}
+
+// deploy puts a pending VM on hostID, or the first enabled host if hostID is
+// -1
+func (s *Server) deploy(vm *vm, hostID int) bool {
+	if hostID < 0 {
+		for _, id := range s.hostIDs() {
+			if s.hosts[id].state == hostMonitored {
+				hostID = id
+				break
+			}
+		}
+	}
+	h, ok := s.hosts[hostID]
+	if !ok {
+		vm.userTemplate.set("SCHED_MESSAGE", time.Now().Format("Mon Jan 2 15:04:05 2006")+" : No hosts enabled to run VMs")
+		return false
+	}
+
+	vm.userTemplate.del("SCHED_MESSAGE")
+	vm.hostID = h.id
+	vm.history = append(vm.history, history{hostID: h.id, hostname: h.name, stime: time.Now().Unix()})
+	vm.setState(goca.Active, goca.Prolog)
+	return true
+}
+
+func (s *Server) leaveHost(vm *vm) {
+	if n := len(vm.history); n > 0 && vm.history[n-1].etime == 0 {
+		vm.history[n-1].etime = time.Now().Unix()
+	}
+}
+
+// advance moves a VM in a transient state to the next state
+func (s *Server) advance(vm *vm) {
+	switch vm.state {
+	case goca.Pending:
+		s.deploy(vm, -1)
+		return
+	case goca.Active:
+	default:
+		return
+	}
+
+	switch vm.lcm {
+	case goca.Prolog, goca.PrologResume, goca.PrologUndeploy:
+		vm.setState(goca.Active, goca.Boot)
+	case goca.Boot, goca.BootPoweroff, goca.BootSuspended, goca.BootStopped, goca.BootUndeploy, goca.BootUnknown:
+		vm.setState(goca.Active, goca.Running)
+	case goca.Shutdown, goca.CleanupDelete:
+		vm.setState(goca.Active, goca.Epilog)
+	case goca.Epilog:
+		s.done(vm)
+	case goca.ShutdownPoweroff:
+		vm.setState(goca.Poweroff, goca.LcmInit)
+	case goca.ShutdownUndeploy:
+		vm.setState(goca.Active, goca.EpilogUndeploy)
+	case goca.EpilogUndeploy:
+		s.leaveHost(vm)
+		vm.hostID = -1
+		vm.setState(goca.Undeployed, goca.LcmInit)
+	case goca.SaveStop:
+		vm.setState(goca.Active, goca.EpilogStop)
+	case goca.EpilogStop:
+		s.leaveHost(vm)
+		vm.hostID = -1
+		vm.setState(goca.Stopped, goca.LcmInit)
+	case goca.SaveSuspend:
+		vm.setState(goca.Suspended, goca.LcmInit)
+	case goca.Hotplug, goca.HotplugNic, goca.HotplugSnapshot, goca.HotplugSaveas, goca.DiskSnapshot:
+		vm.setState(goca.Active, goca.Running)
+	}
+}
+
+// action performs a one.vm.action
+func (s *Server) action(vm *vm, action string) error {
+	state, lcm := vm.state, vm.lcm
+	running := state == goca.Active && lcm == goca.Running
+	failed := state == goca.Active && lcm.IsFailure()
+
+	switch action {
+	case "terminate", "terminate-hard":
+		switch {
+		case state == goca.Pending, state == goca.Hold, state == goca.Poweroff,
+			state == goca.Stopped, state == goca.Undeployed, state == goca.Suspended,
+			failed, state == goca.Active && lcm == goca.Unknown:
+			s.done(vm)
+		case running:
+			vm.setState(goca.Active, goca.Shutdown)
+		default:
+			return errWrongState
+		}
+	case "poweroff", "poweroff-hard":
+		if !running && !(state == goca.Active && lcm == goca.Unknown) {
+			return errWrongState
+		}
+		vm.setState(goca.Active, goca.ShutdownPoweroff)
+	case "undeploy", "undeploy-hard":
+		switch {
+		case running:
+			vm.setState(goca.Active, goca.ShutdownUndeploy)
+		case state == goca.Poweroff:
+			vm.setState(goca.Active, goca.EpilogUndeploy)
+		default:
+			return errWrongState
+		}
+	case "stop":
+		switch {
+		case running:
+			vm.setState(goca.Active, goca.SaveStop)
+		case state == goca.Suspended:
+			vm.setState(goca.Active, goca.EpilogStop)
+		default:
+			return errWrongState
+		}
+	case "suspend":
+		if !running {
+			return errWrongState
+		}
+		vm.setState(goca.Active, goca.SaveSuspend)
+	case "resume":
+		switch {
+		case state == goca.Poweroff:
+			vm.setState(goca.Active, goca.BootPoweroff)
+		case state == goca.Suspended:
+			vm.setState(goca.Active, goca.BootSuspended)
+		case state == goca.Stopped, state == goca.Undeployed:
+			vm.setState(goca.Pending, goca.LcmInit)
+		case state == goca.Active && lcm == goca.Unknown:
+			vm.setState(goca.Active, goca.BootUnknown)
+		default:
+			return errWrongState
+		}
+	case "reboot", "reboot-hard":
+		if !running {
+			return errWrongState
+		}
+	case "hold":
+		if state != goca.Pending {
+			return errWrongState
+		}
+		vm.setState(goca.Hold, goca.LcmInit)
+	case "release":
+		if state != goca.Hold {
+			return errWrongState
+		}
+		vm.setState(goca.Pending, goca.LcmInit)
+	case "resched", "unresched":
+		if !running {
+			return errWrongState
+		}
+		vm.resched = action == "resched"
+	default:
+		return fmt.Errorf("Unknown action %q", action)
+	}
+
+	return nil
+}
+
+var errWrongState = fmt.Errorf("This action is not available for the state of the VM")
+
+func (s *Server) writeVM(w *xmlWriter, vm *vm) {
+	w.open("VM")
+	w.elem("ID", vm.id)
+	s.writeOwner(w, vm.uid, vm.gid)
+	w.elem("NAME", vm.name)
+	writePermissions(w)
+	w.elem("LAST_POLL", 0)
+	w.elem("STATE", int(vm.state))
+	w.elem("LCM_STATE", int(vm.lcm))
+	w.elem("PREV_STATE", int(vm.prevState))
+	w.elem("PREV_LCM_STATE", int(vm.prevLCM))
+	if vm.resched {
+		w.elem("RESCHED", 1)
+	} else {
+		w.elem("RESCHED", 0)
+	}
+	w.elem("STIME", vm.stime)
+	w.elem("ETIME", vm.etime)
+	if vm.hostID >= 0 {
+		w.elem("DEPLOY_ID", fmt.Sprintf("one-%d", vm.id))
+	} else {
+		w.elem("DEPLOY_ID", "")
+	}
+	w.open("MONITORING")
+	w.close("MONITORING")
+	vm.template.writeXML(w, "TEMPLATE")
+	vm.userTemplate.writeXML(w, "USER_TEMPLATE")
+	w.open("HISTORY_RECORDS")
+	for seq, h := range vm.history {
+		w.open("HISTORY")
+		w.elem("OID", vm.id)
+		w.elem("SEQ", seq)
+		w.elem("HOSTNAME", h.hostname)
+		w.elem("HID", h.hostID)
+		w.elem("CID", 0)
+		w.elem("DS_ID", 0)
+		w.elem("STIME", h.stime)
+		w.elem("ETIME", h.etime)
+		w.elem("VM_MAD", "kvm")
+		w.elem("TM_MAD", "ssh")
+		w.close("HISTORY")
+	}
+	w.close("HISTORY_RECORDS")
+	w.close("VM")
+}
+
+// vm returns the VM id of a call
+func (s *Server) vm(req *request, id int) (*vm, error) {
+	vm, ok := s.vms[id]
+	if !ok || req.err != nil {
+		return nil, notFound(req.Method, "virtual machine", id)
+	}
+	return vm, nil
+}
+
+func init() {
+	methods["one.vm.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		t, hold := req.template(0), req.bool(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		vm, err := s.allocateVM(req, t, hold)
+		if err != nil {
+			return nil, err
+		}
+		return vm.id, nil
+	}
+
+	// The transient states last until the next call retrieving the VM
+	methods["one.vm.info"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		var w xmlWriter
+		s.writeVM(&w, vm)
+		s.advance(vm)
+		return w.String(), nil
+	}
+
+	methods["one.vm.action"] = func(s *Server, req *request) (interface{}, error) {
+		action := req.string(0)
+		vm, err := s.vm(req, req.int(1))
+		if err != nil {
+			return nil, err
+		}
+		if err := s.action(vm, action); err != nil {
+			if err == errWrongState {
+				return nil, wrongState(req.Method, fmt.Sprintf(
+					"Error performing action \"%s\": This action is not available for state %s", action, stateName(vm)))
+			}
+			return nil, failure(req.Method, err.Error())
+		}
+		return vm.id, nil
+	}
+
+	methods["one.vm.update"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		req.updateTemplate(&vm.userTemplate, 1)
+		return vm.id, nil
+	}
+
+	methods["one.vm.rename"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		vm.name = req.string(1)
+		return vm.id, nil
+	}
+
+	methods["one.vm.deploy"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		hostID := req.int(1)
+		if vm.state != goca.Pending && vm.state != goca.Hold {
+			return nil, wrongState(req.Method, "Deploy action is not available for state "+stateName(vm))
+		}
+		if _, ok := s.hosts[hostID]; !ok {
+			return nil, notFound(req.Method, "host", hostID)
+		}
+		s.deploy(vm, hostID)
+		return vm.id, nil
+	}
+
+	methods["one.vm.resize"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		t := req.template(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		switch vm.state {
+		case goca.Poweroff, goca.Undeployed, goca.Pending, goca.Hold, goca.Cloning:
+		default:
+			return nil, wrongState(req.Method, "Resize action is not available for state "+stateName(vm))
+		}
+		for _, key := range []string{"CPU", "VCPU", "MEMORY"} {
+			if value, ok := t.get(key); ok {
+				vm.template.set(key, value)
+			}
+		}
+		return vm.id, nil
+	}
+
+	methods["one.vm.diskresize"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		diskID, size := req.int(1), req.string(2)
+		if req.err != nil {
+			return nil, nil
+		}
+		switch {
+		case vm.state == goca.Poweroff, vm.state == goca.Undeployed,
+			vm.state == goca.Active && vm.lcm == goca.Running:
+		default:
+			return nil, wrongState(req.Method, "Resize disk action is not available for state "+stateName(vm))
+		}
+		for _, disk := range vm.template.vectors("DISK") {
+			if id, _ := disk.get("DISK_ID"); id != strconv.Itoa(diskID) {
+				continue
+			}
+			current, _ := disk.get("SIZE")
+			currentSize, _ := strconv.Atoi(current)
+			newSize, err := strconv.Atoi(size)
+			if err != nil || newSize <= currentSize {
+				return nil, failure(req.Method, "New disk size has to be greater than current one")
+			}
+			disk.set("SIZE", size)
+			return vm.id, nil
+		}
+		return nil, failure(req.Method, fmt.Sprintf("VM disk does not exist: %d", diskID))
+	}
+
+	methods["one.vm.recover"] = func(s *Server, req *request) (interface{}, error) {
+		vm, err := s.vm(req, req.int(0))
+		if err != nil {
+			return nil, err
+		}
+		switch op := req.int(1); op {
+		case 1, 2:
+			if vm.state != goca.Active || vm.lcm == goca.Running {
+				return nil, wrongState(req.Method, "Recover action is not available for state "+stateName(vm))
+			}
+			if op == 1 {
+				vm.setState(goca.Active, goca.Running)
+			} else {
+				vm.setState(goca.Active, goca.Boot)
+			}
+		case 3:
+			s.done(vm)
+		default:
+			return nil, failure(req.Method, fmt.Sprintf("Unsupported recover operation %d", op))
+		}
+		return vm.id, nil
+	}
+
+	methods["one.vmpool.info"] = func(s *Server, req *request) (interface{}, error) {
+		filter := req.poolFilter(0, func(id int) (int, int) {
+			return s.vms[id].uid, s.vms[id].gid
+		})
+		state := req.optInt(3, -1)
+		if req.err != nil {
+			return nil, nil
+		}
+
+		var w xmlWriter
+		var listed []*vm
+		w.open("VM_POOL")
+		for _, id := range filter(s.vmIDs()) {
+			vm := s.vms[id]
+			switch {
+			case state == -1 && vm.state == goca.Done,
+				state >= 0 && int(vm.state) != state:
+				continue
+			}
+			s.writeVM(&w, vm)
+			listed = append(listed, vm)
+		}
+		w.close("VM_POOL")
+
+		for _, vm := range listed {
+			s.advance(vm)
+		}
+		return w.String(), nil
+	}
+}
+
+func stateName(vm *vm) string {
+	if vm.state == goca.Active {
+		return vm.lcm.String()
+	}
+	return vm.state.String()
+}
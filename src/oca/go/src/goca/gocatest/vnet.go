@@ -0,0 +1,544 @@
+package gocatest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type vnet struct {
+	id       int
+	uid, gid int
+	name     string
+	bridge   string
+	vnMad    string
+	ars      []*addressRange
+	nextAR   int
+	template *template
+}
+
+// addressRange is an AR of a virtual network. The leases are identified by
+// their index in the range.
+type addressRange struct {
+	id           int
+	arType       string
+	ip           uint32
+	mac          uint64
+	size         int
+	globalPrefix string
+	ulaPrefix    string
+
+	// leases maps the indexes of the used addresses to their VM, -1 for the
+	// held ones
+	leases map[int]int
+}
+
+// lease is an address given to a NIC
+type lease struct {
+	ar    *addressRange
+	index int
+}
+
+func (s *Server) vnetIDs() []int {
+	return sortedIDs(len(s.vnets), func(add func(int)) {
+		for id := range s.vnets {
+			add(id)
+		}
+	})
+}
+
+func parseIPv4(value string) (uint32, bool) {
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+func formatIPv4(ip uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, ip)
+	return net.IP(b).String()
+}
+
+func parseMAC(value string) (uint64, bool) {
+	hw, err := net.ParseMAC(value)
+	if err != nil || len(hw) != 6 {
+		return 0, false
+	}
+	var mac uint64
+	for _, b := range hw {
+		mac = mac<<8 | uint64(b)
+	}
+	return mac, true
+}
+
+func formatMAC(mac uint64) string {
+	hw := make(net.HardwareAddr, 6)
+	for i := 5; i >= 0; i-- {
+		hw[i] = byte(mac)
+		mac >>= 8
+	}
+	return hw.String()
+}
+
+// newAddressRange builds an AR from its vector
+func (n *vnet) newAddressRange(attr *attribute) (*addressRange, error) {
+	ar := &addressRange{id: n.nextAR, leases: map[int]int{}}
+
+	ar.arType, _ = attr.get("TYPE")
+	switch ar.arType {
+	case "IP4", "IP4_6", "IP6", "ETHER":
+	default:
+		return nil, fmt.Errorf("Unknown or missing TYPE for Address Range")
+	}
+
+	size, _ := attr.get("SIZE")
+	var err error
+	if ar.size, err = strconv.Atoi(size); err != nil || ar.size <= 0 {
+		return nil, fmt.Errorf("Wrong SIZE for Address Range")
+	}
+
+	if strings.HasPrefix(ar.arType, "IP4") {
+		value, _ := attr.get("IP")
+		var ok bool
+		if ar.ip, ok = parseIPv4(value); !ok {
+			return nil, fmt.Errorf("Wrong or missing IP for Address Range")
+		}
+	}
+
+	if value, ok := attr.get("MAC"); ok {
+		if ar.mac, ok = parseMAC(value); !ok {
+			return nil, fmt.Errorf("Wrong MAC for Address Range")
+		}
+	} else if ar.ip != 0 {
+		// 02:00 followed by the IP, like OpenNebula
+		ar.mac = 0x020000000000 | uint64(ar.ip)
+	} else {
+		ar.mac = 0x020000000000 | uint64(n.id)<<16 | uint64(ar.id)<<8
+	}
+
+	ar.globalPrefix, _ = attr.get("GLOBAL_PREFIX")
+	ar.ulaPrefix, _ = attr.get("ULA_PREFIX")
+
+	n.nextAR++
+	return ar, nil
+}
+
+func (ar *addressRange) hasIPv4() bool {
+	return strings.HasPrefix(ar.arType, "IP4")
+}
+
+func (ar *addressRange) ipAt(index int) string {
+	if !ar.hasIPv4() {
+		return ""
+	}
+	return formatIPv4(ar.ip + uint32(index))
+}
+
+func (ar *addressRange) macAt(index int) string {
+	return formatMAC(ar.mac + uint64(index))
+}
+
+// ip6At returns the IPv6 address of index with prefix, from the EUI-64 of its
+// MAC
+func (ar *addressRange) ip6At(prefix string, index int) string {
+	if prefix == "" || (ar.arType != "IP6" && ar.arType != "IP4_6") {
+		return ""
+	}
+	ip := net.ParseIP(prefix)
+	if ip == nil {
+		return ""
+	}
+	mac := ar.mac + uint64(index)
+	eui := []byte{byte(mac>>40) ^ 0x02, byte(mac >> 32), byte(mac >> 24), 0xff, 0xfe, byte(mac >> 16), byte(mac >> 8), byte(mac)}
+	ip6 := make(net.IP, 16)
+	copy(ip6, ip.To16()[:8])
+	copy(ip6[8:], eui)
+	return ip6.String()
+}
+
+// indexOf returns the index of an IP or a MAC in the AR, -1 if it's not in
+// the AR
+func (ar *addressRange) indexOf(ip, mac string) int {
+	index := -1
+	if ip != "" {
+		value, ok := parseIPv4(ip)
+		if !ok || !ar.hasIPv4() || value < ar.ip {
+			return -1
+		}
+		index = int(value - ar.ip)
+	} else {
+		value, ok := parseMAC(mac)
+		if !ok || value < ar.mac {
+			return -1
+		}
+		index = int(value - ar.mac)
+	}
+	if index >= ar.size {
+		return -1
+	}
+	return index
+}
+
+// allocate gives an address to vmID, the one of ip or mac if they're not
+// empty
+func (n *vnet) allocate(vmID int, ip, mac string) (lease, error) {
+	if ip != "" || mac != "" {
+		for _, ar := range n.ars {
+			index := ar.indexOf(ip, mac)
+			if index < 0 {
+				continue
+			}
+			if _, used := ar.leases[index]; used {
+				return lease{}, fmt.Errorf("Address %s%s is already in use in network %s", ip, mac, n.name)
+			}
+			ar.leases[index] = vmID
+			return lease{ar, index}, nil
+		}
+		return lease{}, fmt.Errorf("Address %s%s is not part of network %s", ip, mac, n.name)
+	}
+
+	for _, ar := range n.ars {
+		for index := 0; index < ar.size; index++ {
+			if _, used := ar.leases[index]; !used {
+				ar.leases[index] = vmID
+				return lease{ar, index}, nil
+			}
+		}
+	}
+	return lease{}, fmt.Errorf("Not enough free addresses in virtual network %d", n.id)
+}
+
+func (n *vnet) usedLeases() int {
+	used := 0
+	for _, ar := range n.ars {
+		used += len(ar.leases)
+	}
+	return used
+}
+
+// findVNet returns the network of a NIC, from NETWORK_ID, or NETWORK and
+// NETWORK_UNAME or NETWORK_UID
+func (s *Server) findVNet(nic *attribute, uid int) (*vnet, error) {
+	if value, ok := nic.get("NETWORK_ID"); ok {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong NETWORK_ID %q", value)
+		}
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, fmt.Errorf("Error getting virtual network [%d]", id)
+		}
+		return n, nil
+	}
+
+	name, ok := nic.get("NETWORK")
+	if !ok {
+		return nil, fmt.Errorf("No NETWORK or NETWORK_ID in NIC")
+	}
+	owner := uid
+	if uname, ok := nic.get("NETWORK_UNAME"); ok {
+		owner = -1
+		for _, u := range s.users {
+			if u.name == uname {
+				owner = u.id
+			}
+		}
+	} else if value, ok := nic.get("NETWORK_UID"); ok {
+		owner, _ = strconv.Atoi(value)
+	}
+
+	for _, id := range s.vnetIDs() {
+		n := s.vnets[id]
+		if n.name == name && n.uid == owner {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("User %d does not own a network with name: %s", owner, name)
+}
+
+// release frees the addresses of vmID
+func (n *vnet) release(vmID int) {
+	for _, ar := range n.ars {
+		for index, id := range ar.leases {
+			if id == vmID {
+				delete(ar.leases, index)
+			}
+		}
+	}
+}
+
+func (s *Server) writeVNet(w *xmlWriter, n *vnet, extended bool) {
+	w.open("VNET")
+	w.elem("ID", n.id)
+	s.writeOwner(w, n.uid, n.gid)
+	w.elem("NAME", n.name)
+	writePermissions(w)
+	w.ids("CLUSTERS", []int{0})
+	w.elem("BRIDGE", n.bridge)
+	w.elem("PARENT_NETWORK_ID", "")
+	w.elem("VN_MAD", n.vnMad)
+	w.elem("PHYDEV", "")
+	w.elem("VLAN_ID", "")
+	w.elem("OUTER_VLAN_ID", "")
+	w.elem("VLAN_ID_AUTOMATIC", 0)
+	w.elem("OUTER_VLAN_ID_AUTOMATIC", 0)
+	w.elem("USED_LEASES", n.usedLeases())
+	w.ids("VROUTERS", nil)
+	n.template.writeXML(w, "TEMPLATE")
+
+	w.open("AR_POOL")
+	for _, ar := range n.ars {
+		w.open("AR")
+		w.elem("AR_ID", ar.id)
+		if ar.globalPrefix != "" {
+			w.elem("GLOBAL_PREFIX", ar.globalPrefix)
+		}
+		if ar.hasIPv4() {
+			w.elem("IP", ar.ipAt(0))
+			w.elem("IP_END", ar.ipAt(ar.size-1))
+		}
+		w.elem("MAC", ar.macAt(0))
+		w.elem("MAC_END", ar.macAt(ar.size-1))
+		if ar.globalPrefix != "" {
+			w.elem("IP6_GLOBAL", ar.ip6At(ar.globalPrefix, 0))
+			w.elem("IP6_GLOBAL_END", ar.ip6At(ar.globalPrefix, ar.size-1))
+		}
+		w.elem("SIZE", ar.size)
+		w.elem("TYPE", ar.arType)
+		w.elem("USED_LEASES", len(ar.leases))
+		if extended {
+			w.open("LEASES")
+			for index := 0; index < ar.size; index++ {
+				vmID, used := ar.leases[index]
+				if !used {
+					continue
+				}
+				w.open("LEASE")
+				if ar.hasIPv4() {
+					w.elem("IP", ar.ipAt(index))
+				}
+				if ar.globalPrefix != "" {
+					w.elem("IP6_GLOBAL", ar.ip6At(ar.globalPrefix, index))
+				}
+				w.elem("MAC", ar.macAt(index))
+				w.elem("VM", vmID)
+				w.close("LEASE")
+			}
+			w.close("LEASES")
+		}
+		w.close("AR")
+	}
+	w.close("AR_POOL")
+	w.close("VNET")
+}
+
+// vnetAR returns the network id and its AR arID
+func (s *Server) vnetAR(method string, id, arID int) (*vnet, int, error) {
+	n, ok := s.vnets[id]
+	if !ok {
+		return nil, 0, notFound(method, "virtual network", id)
+	}
+	for i, ar := range n.ars {
+		if ar.id == arID {
+			return n, i, nil
+		}
+	}
+	return nil, 0, failure(method, fmt.Sprintf("Address Range %d does not exist", arID))
+}
+
+// leaseTemplate returns the IP or MAC of a LEASES vector, for hold and
+// release
+func leaseTemplate(t *template) (ip, mac string) {
+	for _, leases := range t.vectors("LEASES") {
+		ip, _ = leases.get("IP")
+		mac, _ = leases.get("MAC")
+	}
+	return ip, mac
+}
+
+func init() {
+	methods["one.vn.allocate"] = func(s *Server, req *request) (interface{}, error) {
+		t := req.template(0)
+		if req.err != nil {
+			return nil, nil
+		}
+
+		name, _ := t.get("NAME")
+		if name == "" {
+			return nil, failure(req.Method, "No NAME in template for Virtual Network.")
+		}
+		for _, n := range s.vnets {
+			if n.name == name && n.uid == req.user.id {
+				return nil, failure(req.Method, fmt.Sprintf("NAME is already taken by NET %d.", n.id))
+			}
+		}
+
+		n := &vnet{id: s.nextID["vnet"], uid: req.user.id, gid: req.user.gid, name: name}
+		n.bridge, _ = t.get("BRIDGE")
+		n.vnMad, _ = t.get("VN_MAD")
+		if n.vnMad == "" {
+			n.vnMad = "bridge"
+		}
+		if n.bridge == "" {
+			n.bridge = fmt.Sprintf("onebr%d", n.id)
+		}
+
+		for _, attr := range t.take("AR") {
+			ar, err := n.newAddressRange(attr)
+			if err != nil {
+				return nil, failure(req.Method, err.Error())
+			}
+			n.ars = append(n.ars, ar)
+		}
+		t.del("NAME")
+		n.template = t
+
+		s.id("vnet")
+		s.vnets[n.id] = n
+		return n.id, nil
+	}
+
+	methods["one.vn.info"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		var w xmlWriter
+		s.writeVNet(&w, n, true)
+		return w.String(), nil
+	}
+
+	methods["one.vn.delete"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		if n.usedLeases() > 0 {
+			return nil, wrongState(req.Method, "Can not remove a virtual network with leases in use")
+		}
+		delete(s.vnets, id)
+		return id, nil
+	}
+
+	methods["one.vn.add_ar"] = func(s *Server, req *request) (interface{}, error) {
+		id, t := req.int(0), req.template(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		for _, attr := range t.vectors("AR") {
+			ar, err := n.newAddressRange(attr)
+			if err != nil {
+				return nil, failure(req.Method, err.Error())
+			}
+			n.ars = append(n.ars, ar)
+		}
+		return id, nil
+	}
+
+	methods["one.vn.rm_ar"] = func(s *Server, req *request) (interface{}, error) {
+		id, arID := req.int(0), req.int(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		n, i, err := s.vnetAR(req.Method, id, arID)
+		if err != nil {
+			return nil, err
+		}
+		if len(n.ars[i].leases) > 0 {
+			return nil, wrongState(req.Method, "Address Range has leases in use")
+		}
+		n.ars = append(n.ars[:i], n.ars[i+1:]...)
+		return id, nil
+	}
+
+	methods["one.vn.hold"] = func(s *Server, req *request) (interface{}, error) {
+		id, t := req.int(0), req.template(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		ip, mac := leaseTemplate(t)
+		if _, err := n.allocate(-1, ip, mac); err != nil {
+			return nil, failure(req.Method, err.Error())
+		}
+		return id, nil
+	}
+
+	methods["one.vn.release"] = func(s *Server, req *request) (interface{}, error) {
+		id, t := req.int(0), req.template(1)
+		if req.err != nil {
+			return nil, nil
+		}
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		ip, mac := leaseTemplate(t)
+		for _, ar := range n.ars {
+			index := ar.indexOf(ip, mac)
+			if vmID, used := ar.leases[index]; index >= 0 && used && vmID == -1 {
+				delete(ar.leases, index)
+				return id, nil
+			}
+		}
+		return nil, failure(req.Method, "Address is not on hold")
+	}
+
+	methods["one.vn.update"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		req.updateTemplate(&n.template, 1)
+		return id, nil
+	}
+
+	methods["one.vn.chown"] = func(s *Server, req *request) (interface{}, error) {
+		id := req.int(0)
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		if err := s.chown(req, &n.uid, &n.gid); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+
+	methods["one.vn.rename"] = func(s *Server, req *request) (interface{}, error) {
+		id, name := req.int(0), req.string(1)
+		n, ok := s.vnets[id]
+		if !ok {
+			return nil, notFound(req.Method, "virtual network", id)
+		}
+		n.name = name
+		return id, nil
+	}
+
+	methods["one.vnpool.info"] = func(s *Server, req *request) (interface{}, error) {
+		filter := req.poolFilter(0, func(id int) (int, int) {
+			return s.vnets[id].uid, s.vnets[id].gid
+		})
+		var w xmlWriter
+		w.open("VNET_POOL")
+		for _, id := range filter(s.vnetIDs()) {
+			s.writeVNet(&w, s.vnets[id], false)
+		}
+		w.close("VNET_POOL")
+		return w.String(), nil
+	}
+}
@@ -2,7 +2,6 @@ package goca
 
 import (
 	"encoding/xml"
-	"errors"
 )
 
 // GroupPool represents an OpenNebula GroupPool
@@ -14,6 +13,8 @@ type GroupPool struct {
 
 // Group represents an OpenNebula Group
 type Group struct {
+	XMLResource
+
 	ID       uint          `xml:"ID"`
 	Name     string        `xml:"NAME"`
 	Users    []int         `xml:"USERS>ID"`
@@ -55,28 +56,11 @@ func NewGroup(id uint) *Group {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the group.
 func NewGroupFromName(name string) (*Group, error) {
-	var id uint
-
-	groupPool, err := NewGroupPool()
+	id, err := resolveName(resolveGroup, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(groupPool.Groups); i++ {
-		if groupPool.Groups[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = groupPool.Groups[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewGroup(id), nil
 }
 
@@ -103,6 +87,7 @@ func (group *Group) Info() error {
 		return err
 	}
 	*group = Group{}
+	group.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), group)
 }
 
@@ -0,0 +1,19 @@
+package goca_test
+
+import (
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// newTestServer starts a gocatest server and points the client to it, with
+// the oneadmin credentials. The returned function restores the client and
+// stops the server.
+func newTestServer() (*gocatest.Server, func()) {
+	server := gocatest.NewServer()
+	restore := goca.SetTestClient(server.Config())
+
+	return server, func() {
+		restore()
+		server.Close()
+	}
+}
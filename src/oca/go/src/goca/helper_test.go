@@ -1,30 +1,98 @@
 package goca
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
+	"os"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/cassette"
 )
 
+// defaultCassette is the file of the recorded calls, when GOCA_CASSETTE is
+// record or replay. GOCA_CASSETTE_PATH overrides it.
+const defaultCassette = "testdata/goca.json"
+
+// nameSeq makes the names generated by GenName reproducible when the calls
+// are recorded or replayed, -1 otherwise
+var nameSeq = -1
+
+// waitInterval is the interval of WaitResource, shortened when the calls are
+// replayed
+var waitInterval = 2 * time.Second
+
+// Runs the tests against the server of ONE_XMLRPC, or records or replays the
+// calls depending on GOCA_CASSETTE
+func TestMain(m *testing.M) {
+	mode, err := cassette.ModeFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if mode == cassette.Live {
+		os.Exit(m.Run())
+	}
+
+	path := os.Getenv("GOCA_CASSETTE_PATH")
+	if path == "" {
+		path = defaultCassette
+	}
+
+	c, err := cassette.New(path, mode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	conf := NewConfig("", "", "")
+	if mode == cassette.Replay {
+		// The session string isn't matched, but some tests use the user
+		conf = OneConfig{Token: c.User + ":replay", XmlrpcURL: conf.XmlrpcURL}
+		waitInterval = time.Millisecond
+	}
+	conf.Transport = c
+	SetClient(conf)
+	nameSeq = 0
+
+	code := m.Run()
+
+	if err := c.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
 // Appends a random string to a name
 func GenName(name string) string {
 	t := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if nameSeq >= 0 {
+		nameSeq++
+		t = strconv.Itoa(nameSeq)
+	}
 
 	d := []byte(t)
 	h := fmt.Sprintf("%x", md5.Sum(d))[:6]
 	return name + "-" + h
 }
 
+// clientSession returns the session string of the client, empty if the
+// credentials can't be provided
+func clientSession() string {
+	session, _, _ := client.session(context.Background())
+	return session
+}
+
 func WaitResource(f func() bool) bool {
-	for i := 0; i < 20; i++ {
-		if f() {
-			return true
-		}
-		time.Sleep(2 * time.Second)
-	}
-	return false
+	opts := WaitOptions{Interval: waitInterval, Timeout: 40 * time.Second}
+	err := poll(context.Background(), []WaitOptions{opts}, func() (bool, error) {
+		return f(), nil
+	})
+	return err == nil
 }
 
 // Get User Main Group name
@@ -2,7 +2,6 @@ package goca
 
 import (
 	"encoding/xml"
-	"errors"
 	"fmt"
 )
 
@@ -13,6 +12,8 @@ type HostPool struct {
 
 // Host represents an OpenNebula Host
 type Host struct {
+	XMLResource
+
 	ID          uint         `xml:"ID"`
 	Name        string       `xml:"NAME"`
 	StateRaw    int          `xml:"STATE"`
@@ -107,18 +108,70 @@ func (st HostState) isValid() bool {
 	return false
 }
 
+var hostStateNames = [...]string{
+	"INIT",
+	"MONITORING_MONITORED",
+	"MONITORED",
+	"ERROR",
+	"DISABLED",
+	"MONITORING_ERROR",
+	"MONITORING_INIT",
+	"MONITORING_DISABLED",
+	"OFFLINE",
+}
+
+// String returns the string version of the HostState
 func (st HostState) String() string {
-	return [...]string{
-		"INIT",
-		"MONITORING_MONITORED",
-		"MONITORED",
-		"ERROR",
-		"DISABLED",
-		"MONITORING_ERROR",
-		"MONITORING_INIT",
-		"MONITORING_DISABLED",
-		"OFFLINE",
-	}[st]
+	name := ""
+	if st.isValid() {
+		name = hostStateNames[st]
+	}
+	return stateString("HostState", int(st), name)
+}
+
+// ParseHostState returns the HostState named s, e.g. "MONITORED". The numeric
+// value of the state is also accepted.
+func ParseHostState(s string) (HostState, error) {
+	st, err := parseState("HostState", s, len(hostStateNames)-1, func(i int) string {
+		return hostStateNames[i]
+	})
+	return HostState(st), err
+}
+
+// MarshalText encodes the HostState as its name
+func (st HostState) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+// UnmarshalText decodes a HostState from its name or its value
+func (st *HostState) UnmarshalText(text []byte) error {
+	state, err := ParseHostState(string(text))
+	if err != nil {
+		return err
+	}
+	*st = state
+	return nil
+}
+
+// UnmarshalJSON decodes a HostState from a JSON string or number
+func (st *HostState) UnmarshalJSON(data []byte) error {
+	return st.UnmarshalText(jsonStateString(data))
+}
+
+// IsFailure returns true if the host is in error, or being monitored from the
+// error state
+func (st HostState) IsFailure() bool {
+	return st == HostError || st == HostMonitoringError
+}
+
+// IsTransient returns true if the host is being monitored
+func (st HostState) IsTransient() bool {
+	switch st {
+	case HostInit, HostMonitoringMonitored, HostMonitoringError, HostMonitoringInit, HostMonitoringDisabled:
+		return true
+	default:
+		return false
+	}
 }
 
 // NewHostPool returns a host pool. A connection to OpenNebula is
@@ -146,28 +199,11 @@ func NewHost(id uint) *Host {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the host.
 func NewHostFromName(name string) (*Host, error) {
-	var id uint
-
-	hostPool, err := NewHostPool()
+	id, err := resolveName(resolveHost, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(hostPool.Hosts); i++ {
-		if hostPool.Hosts[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = hostPool.Hosts[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewHost(id), nil
 }
 
@@ -220,6 +256,7 @@ func (host *Host) Info() error {
 		return err
 	}
 	*host = Host{}
+	host.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), host)
 }
 
@@ -229,20 +266,20 @@ func (host *Host) Monitoring() error {
 	return err
 }
 
-// State looks up the state of the image and returns the ImageState
+// State looks up the state of the host and returns the HostState. The state
+// values unknown to goca are returned as is.
 func (host *Host) State() (HostState, error) {
-	state := HostState(host.StateRaw)
-	if !state.isValid() {
-		return -1, fmt.Errorf("Host State: this state value is not currently handled: %d\n", host.StateRaw)
+	if host.StateRaw < 0 {
+		return -1, fmt.Errorf("Host State: invalid state value: %d", host.StateRaw)
 	}
-	return state, nil
+	return HostState(host.StateRaw), nil
 }
 
 // StateString returns the state in string format
 func (host *Host) StateString() (string, error) {
-	state := HostState(host.StateRaw)
-	if !state.isValid() {
-		return "", fmt.Errorf("Host StateString: this state value is not currently handled: %d\n", host.StateRaw)
+	state, err := host.State()
+	if err != nil {
+		return "", err
 	}
 	return state.String(), nil
 }
@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 	"fmt"
 )
 
@@ -13,6 +13,8 @@ type ImagePool struct {
 
 // Image represents an OpenNebula Image
 type Image struct {
+	XMLResource
+
 	ID              uint          `xml:"ID"`
 	UID             int           `xml:"UID"`
 	GID             int           `xml:"GID"`
@@ -92,21 +94,71 @@ func (st ImageState) isValid() bool {
 	return false
 }
 
+var imageStateNames = [...]string{
+	"INIT",
+	"READY",
+	"USED",
+	"DISABLED",
+	"LOCKED",
+	"ERROR",
+	"CLONE",
+	"DELETE",
+	"USED_PERS",
+	"LOCKED_USED",
+	"LOCKED_USED_PERS",
+}
+
 // String returns the string version of the ImageState
 func (s ImageState) String() string {
-	return [...]string{
-		"INIT",
-		"READY",
-		"USED",
-		"DISABLED",
-		"LOCKED",
-		"ERROR",
-		"CLONE",
-		"DELETE",
-		"USED_PERS",
-		"LOCKED_USED",
-		"LOCKED_USED_PERS",
-	}[s]
+	name := ""
+	if s.isValid() {
+		name = imageStateNames[s]
+	}
+	return stateString("ImageState", int(s), name)
+}
+
+// ParseImageState returns the ImageState named s, e.g. "READY". The numeric
+// value of the state is also accepted.
+func ParseImageState(s string) (ImageState, error) {
+	st, err := parseState("ImageState", s, len(imageStateNames)-1, func(i int) string {
+		return imageStateNames[i]
+	})
+	return ImageState(st), err
+}
+
+// MarshalText encodes the ImageState as its name
+func (s ImageState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes an ImageState from its name or its value
+func (s *ImageState) UnmarshalText(text []byte) error {
+	st, err := ParseImageState(string(text))
+	if err != nil {
+		return err
+	}
+	*s = st
+	return nil
+}
+
+// UnmarshalJSON decodes an ImageState from a JSON string or number
+func (s *ImageState) UnmarshalJSON(data []byte) error {
+	return s.UnmarshalText(jsonStateString(data))
+}
+
+// IsFailure returns true if the image is in error state
+func (s ImageState) IsFailure() bool {
+	return s == ImageError
+}
+
+// IsTransient returns true if an operation is in progress on the image
+func (s ImageState) IsTransient() bool {
+	switch s {
+	case ImageInit, ImageLocked, ImageClone, ImageDelete, ImageLockUsed, ImageLockUsedPers:
+		return true
+	default:
+		return false
+	}
 }
 
 // CreateImage allocates a new image based on the template string provided. It
@@ -123,22 +175,18 @@ func CreateImage(template string, dsid uint) (uint, error) {
 // NewImagePool returns a new image pool. It accepts the scope of the query. It
 // performs an OpenNebula connection to fetch the information.
 func NewImagePool(args ...int) (*ImagePool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, false)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Call("one.imagepool.info", who, start, end)
+	return NewImagePoolWithOptions(opts)
+}
+
+// NewImagePoolWithOptions returns an image pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewImagePoolWithOptions(opts PoolOptions) (*ImagePool, error) {
+	response, err := client.Call("one.imagepool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -152,6 +200,12 @@ func NewImagePool(args ...int) (*ImagePool, error) {
 	return imagePool, nil
 }
 
+// NewImagePoolIterator returns an iterator over the image pool, retrieving
+// pageSize IDs at a time
+func NewImagePoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.imagepool.info", "IMAGE", opts, pageSize)
+}
+
 // NewImage finds an image by ID returns a new Image object. At this stage no
 // connection to OpenNebula is performed.
 func NewImage(id uint) *Image {
@@ -162,55 +216,43 @@ func NewImage(id uint) *Image {
 // to OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the image.
 func NewImageFromName(name string) (*Image, error) {
-	var id uint
-
-	imagePool, err := NewImagePool()
+	id, err := resolveName(resolveImage, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(imagePool.Images); i++ {
-		if imagePool.Images[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = imagePool.Images[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewImage(id), nil
 }
 
 // Info connects to OpenNebula and fetches the information of the Image
 func (image *Image) Info() error {
-	response, err := client.Call("one.image.info", image.ID)
+	return image.infoContext(context.Background())
+}
+
+func (image *Image) infoContext(ctx context.Context) error {
+	response, err := client.CallContext(ctx, "one.image.info", image.ID)
 	if err != nil {
 		return err
 	}
 	*image = Image{}
+	image.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), image)
 }
 
-// State looks up the state of the image and returns the ImageState
+// State looks up the state of the image and returns the ImageState. The state
+// values unknown to goca are returned as is.
 func (image *Image) State() (ImageState, error) {
-	state := ImageState(image.StateRaw)
-	if !state.isValid() {
-		return -1, fmt.Errorf("Image State: this state value is not currently handled: %d\n", image.StateRaw)
+	if image.StateRaw < 0 {
+		return -1, fmt.Errorf("Image State: invalid state value: %d", image.StateRaw)
 	}
-	return state, nil
+	return ImageState(image.StateRaw), nil
 }
 
 // StateString returns the state in string format
 func (image *Image) StateString() (string, error) {
-	state := ImageState(image.StateRaw)
-	if !state.isValid() {
-		return "", fmt.Errorf("Image State: this state value is not currently handled: %d\n", image.StateRaw)
+	state, err := image.State()
+	if err != nil {
+		return "", err
 	}
 	return state.String(), nil
 }
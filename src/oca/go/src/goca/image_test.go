@@ -100,7 +100,7 @@ func TestImage(t *testing.T) {
 	gname := image.GName
 
     // Compare with caller username
-    caller := strings.Split(client.token, ":")[0]
+    caller := strings.Split(clientSession(), ":")[0]
     if caller != uname {
         t.Error("Caller user and image owner user mismatch")
     }
@@ -0,0 +1,223 @@
+package goca
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLoginLifetime is the lifetime of the login tokens when
+// LoginConfig.Lifetime is not set
+const DefaultLoginLifetime = time.Hour
+
+// loginRetryDelay is the delay before a new login attempt once a login
+// failed. The client uses the credentials meanwhile.
+const loginRetryDelay = time.Minute
+
+// LoginConfig enables the login tokens: the client exchanges the credentials
+// of a PasswordAuth for a token with one.user.login, and sends this token
+// instead of the password. The other AuthProviders and OneConfig.Token, which
+// may already hold a token, send their session strings as is. The token is
+// renewed before its expiration. Use NewLoginConfig to get the default values.
+type LoginConfig struct {
+	// Lifetime of the tokens. Defaults to DefaultLoginLifetime.
+	Lifetime time.Duration
+
+	// EffectiveGroup is the ID of the group the token is restricted to, -1
+	// for all the groups of the user
+	EffectiveGroup int
+
+	// RefreshMargin is the remaining lifetime under which the token is
+	// renewed. Defaults to a tenth of Lifetime.
+	RefreshMargin time.Duration
+}
+
+// NewLoginConfig returns a configuration for tokens valid for all the groups
+// of the user, with the default lifetime
+func NewLoginConfig() *LoginConfig {
+	return &LoginConfig{
+		Lifetime:       DefaultLoginLifetime,
+		EffectiveGroup: -1,
+	}
+}
+
+// loginSession holds the login token of a client
+type loginSession struct {
+	conf LoginConfig
+
+	mu         sync.Mutex
+	session    string
+	expiration time.Time
+	retryAfter time.Time
+
+	// login is closed at the end of the login in progress, nil without
+	// login in progress
+	login chan struct{}
+}
+
+func newLoginSession(conf *LoginConfig) *loginSession {
+	if conf == nil {
+		return nil
+	}
+
+	s := &loginSession{conf: *conf}
+	if s.conf.Lifetime <= 0 {
+		s.conf.Lifetime = DefaultLoginLifetime
+	}
+	if s.conf.RefreshMargin <= 0 {
+		s.conf.RefreshMargin = s.conf.Lifetime / 10
+	}
+
+	return s
+}
+
+// session returns the session string sent with the calls: the login token
+// when it's enabled and available, the credentials otherwise. token tells if
+// it's a login token.
+// A single call logs in at a time, without holding the lock of the session:
+// the other calls use the current token until its expiration, or wait for the
+// login until ctx is done.
+func (c *oneClient) session(ctx context.Context) (session string, token bool, err error) {
+	s := c.login
+
+	// Only the user:password credentials can be exchanged
+	if _, password := c.auth.(passwordCredentials); s == nil || !password {
+		credentials, err := c.credentials(ctx)
+		return credentials, false, err
+	}
+
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		if s.session != "" && now.Before(s.expiration.Add(-s.conf.RefreshMargin)) {
+			session := s.session
+			s.mu.Unlock()
+			return session, true, nil
+		}
+		if s.login == nil {
+			if now.Before(s.retryAfter) {
+				s.mu.Unlock()
+				credentials, err := c.credentials(ctx)
+				return credentials, false, err
+			}
+			break
+		}
+		if s.session != "" && now.Before(s.expiration) {
+			session := s.session
+			s.mu.Unlock()
+			return session, true, nil
+		}
+		login := s.login
+		s.mu.Unlock()
+
+		select {
+		case <-login:
+		case <-ctx.Done():
+			return "", false, &ClientError{ClientReqAuth, "authentication", nil, ctx.Err()}
+		}
+	}
+
+	done := make(chan struct{})
+	s.login = done
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.login = nil
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	credentials, err := c.credentials(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	i := strings.Index(credentials, ":")
+	if i <= 0 {
+		return credentials, false, nil
+	}
+	user := credentials[:i]
+
+	loginToken, expiration, err := c.loginToken(ctx, credentials, user)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		// The login is tried again at the next call if it was interrupted
+		if ctx.Err() == nil {
+			s.session = ""
+			s.retryAfter = time.Now().Add(loginRetryDelay)
+		}
+		return credentials, false, nil
+	}
+
+	s.session = user + ":" + loginToken
+	s.expiration = expiration
+
+	return s.session, true, nil
+}
+
+// credentials returns the session string of the AuthProvider
+func (c *oneClient) credentials(ctx context.Context) (string, error) {
+	credentials, err := c.auth.Session(ctx)
+	if err != nil {
+		return "", &ClientError{ClientReqAuth, "authentication", nil, err}
+	}
+	return credentials, nil
+}
+
+// loginRejected tells if err is the rejection of the login token session, in
+// which case the token is dropped so that the call can be retried with a new
+// one
+func (c *oneClient) loginRejected(session string, err error) bool {
+	s := c.login
+	if s == nil {
+		return false
+	}
+
+	respErr, ok := err.(*ResponseError)
+	if !ok || respErr.Code != OneAuthenticationError {
+		return false
+	}
+
+	s.mu.Lock()
+	if s.session == session {
+		s.session = ""
+	}
+	s.mu.Unlock()
+
+	return true
+}
+
+// loginToken creates a login token with credentials, and returns it with its
+// expiration time
+func (c *oneClient) loginToken(ctx context.Context, credentials, user string) (string, time.Time, error) {
+	s := c.login
+	lifetime := int(s.conf.Lifetime / time.Second)
+	expiration := time.Now().Add(s.conf.Lifetime)
+
+	response, err := c.sessionCall(ctx, c.url, credentials, "one.user.login",
+		user, "", lifetime, s.conf.EffectiveGroup)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := response.Body()
+
+	// Prefer the expiration time computed by OpenNebula
+	response, err = c.sessionCall(ctx, c.url, credentials, "one.user.info", -1)
+	if err == nil {
+		user := &User{}
+		if xml.Unmarshal([]byte(response.Body()), user) == nil {
+			for _, t := range user.LoginTokens {
+				if t.Token == token && t.ExpirationTime > 0 {
+					expiration = time.Unix(int64(t.ExpirationTime), 0)
+				}
+			}
+		}
+	}
+
+	return token, expiration, nil
+}
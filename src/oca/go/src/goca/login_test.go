@@ -0,0 +1,268 @@
+package goca_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// newLoginServer starts a server with the user alice, whose password is pass
+func newLoginServer(t *testing.T) (*gocatest.Server, func()) {
+	server, restore := newTestServer()
+	if _, err := goca.CreateUser("alice", "pass", "core", []uint{1}); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return server, restore
+}
+
+// callSessions returns the session strings of the calls of method received
+// by server, from the call first
+func callSessions(server *gocatest.Server, first int, method string) []string {
+	var sessions []string
+	for _, call := range server.Calls()[first:] {
+		if call.Method == method {
+			sessions = append(sessions, call.Session)
+		}
+	}
+	return sessions
+}
+
+func TestLoginToken(t *testing.T) {
+	server, restore := newLoginServer(t)
+	defer restore()
+
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := goca.NewLoginConfig()
+	login.Lifetime = 10 * time.Minute
+	goca.SetClient(goca.OneConfig{Auth: &goca.PasswordAuth{User: "alice", Password: "pass"}, XmlrpcURL: server.URL, Login: login})
+
+	first := len(server.Calls())
+	vm := goca.NewVM(id)
+	for i := 0; i < 2; i++ {
+		if err := vm.Info(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var logins []gocatest.Call
+	for _, call := range server.Calls()[first:] {
+		if call.Method == "one.user.login" {
+			logins = append(logins, call)
+		}
+	}
+	expected := []interface{}{"alice", "", 600, -1}
+	if len(logins) != 1 || logins[0].Session != "alice:pass" || !reflect.DeepEqual(logins[0].Params, expected) {
+		t.Fatalf("expected a login with %v, got %v", expected, logins)
+	}
+	sessions := callSessions(server, first, "one.vm.info")
+	token1 := sessions[0]
+	if len(sessions) != 2 || sessions[1] != token1 || token1 == "alice:pass" {
+		t.Errorf("expected the cached token, got %v", sessions)
+	}
+	if exp := goca.LoginExpiration(); time.Until(exp) < 9*time.Minute {
+		t.Errorf("unexpected expiration time %s", exp)
+	}
+
+	// A rejected token is renewed
+	rejected := &gocatest.Error{Code: goca.OneAuthenticationError,
+		Message: "[one.vm.info] User couldn't be authenticated, aborting call."}
+	first = len(server.Calls())
+	server.FailNext("one.vm.info", rejected)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	sessions = callSessions(server, first, "one.vm.info")
+	if len(sessions) != 2 || sessions[0] != token1 || sessions[1] == token1 || sessions[1] == "alice:pass" {
+		t.Errorf("expected a new token, got %v", sessions)
+	}
+	token2 := sessions[1]
+
+	// The credentials are used when the login fails
+	first = len(server.Calls())
+	server.FailNext("one.vm.info", rejected)
+	server.FailNext("one.user.login", &gocatest.Error{Code: goca.OneAuthorizationError, Message: "not authorized"})
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	sessions = callSessions(server, first, "one.vm.info")
+	if !reflect.DeepEqual(sessions, []string{token2, "alice:pass"}) {
+		t.Errorf("expected the credentials, got %v", sessions)
+	}
+}
+
+func TestLoginUser(t *testing.T) {
+	var mu sync.Mutex
+	var logins, sessions []string
+
+	server, restore := newLoginServer(t)
+	defer restore()
+	server.Handle("one.user.login", func(call *gocatest.Call) (interface{}, error) {
+		mu.Lock()
+		logins = append(logins, call.Params[0].(string))
+		mu.Unlock()
+		return "token", nil
+	})
+	server.Handle("one.vm.info", func(call *gocatest.Call) (interface{}, error) {
+		mu.Lock()
+		sessions = append(sessions, call.Session)
+		mu.Unlock()
+		return "<VM><ID>1</ID></VM>", nil
+	})
+
+	url := server.URL
+
+	// The token is issued for the user of the password
+	logins, sessions = nil, nil
+	goca.SetClient(goca.OneConfig{Auth: &goca.PasswordAuth{User: "alice", Password: "pass"}, XmlrpcURL: url, Login: goca.NewLoginConfig()})
+	if err := goca.NewVM(1).Info(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(logins, []string{"alice"}) || !reflect.DeepEqual(sessions, []string{"alice:token"}) {
+		t.Errorf("unexpected logins %v, sessions %v", logins, sessions)
+	}
+
+	// Nor the token of OneConfig.Token, e.g. read from ONE_AUTH after
+	// oneuser login
+	logins, sessions = nil, nil
+	goca.SetClient(goca.OneConfig{Token: "alice:token", XmlrpcURL: url, Login: goca.NewLoginConfig()})
+	if err := goca.NewVM(1).Info(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 0 || !reflect.DeepEqual(sessions, []string{"alice:token"}) {
+		t.Errorf("unexpected logins %v, sessions %v", logins, sessions)
+	}
+
+	// The server_cipher credentials aren't exchanged: the token would be
+	// issued for the server user instead of the target user
+	logins, sessions = nil, nil
+	goca.SetClient(goca.OneConfig{
+		Auth:      &goca.ServerCipherAuth{ServerUser: "serveradmin", ServerPassword: "secret", TargetUser: "alice"},
+		XmlrpcURL: url,
+		Login:     goca.NewLoginConfig(),
+	})
+	if err := goca.NewVM(1).Info(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 0 || len(sessions) != 1 || !strings.HasPrefix(sessions[0], "serveradmin:alice:") {
+		t.Errorf("unexpected logins %v, sessions %v", logins, sessions)
+	}
+
+	// Nor the ones of the other providers
+	logins, sessions = nil, nil
+	goca.SetClient(goca.OneConfig{
+		Auth:      goca.AuthProviderFunc(func(ctx context.Context) (string, error) { return "bob:x509token", nil }),
+		XmlrpcURL: url,
+		Login:     goca.NewLoginConfig(),
+	})
+	if err := goca.NewVM(1).Info(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 0 || !reflect.DeepEqual(sessions, []string{"bob:x509token"}) {
+		t.Errorf("unexpected logins %v, sessions %v", logins, sessions)
+	}
+}
+
+func TestLoginConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	var sessions []string
+	logins := 0
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	server, restore := newLoginServer(t)
+	defer restore()
+	server.Handle("one.user.login", func(*gocatest.Call) (interface{}, error) {
+		mu.Lock()
+		logins++
+		token := fmt.Sprintf("token%d", logins)
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		return token, nil
+	})
+	server.Handle("one.vm.info", func(call *gocatest.Call) (interface{}, error) {
+		mu.Lock()
+		sessions = append(sessions, call.Session)
+		mu.Unlock()
+		return "<VM><ID>1</ID></VM>", nil
+	})
+
+	login := goca.NewLoginConfig()
+	login.Lifetime = 10 * time.Minute
+	goca.SetClient(goca.OneConfig{Auth: &goca.PasswordAuth{User: "alice", Password: "pass"}, XmlrpcURL: server.URL, Login: login})
+
+	// info calls goca.NewVM(1).Info in the background
+	info := func() chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- goca.NewVM(1).Info()
+		}()
+		return result
+	}
+	wait := func(result chan error) error {
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Second):
+			return errors.New("call blocked by the login")
+		}
+	}
+
+	// The calls wait for a single login
+	var results []chan error
+	for i := 0; i < 3; i++ {
+		results = append(results, info())
+	}
+	<-started
+
+	// A call whose context is done stops waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	canceled := make(chan error, 1)
+	go func() {
+		canceled <- goca.NewVM(1).InfoContext(ctx)
+	}()
+	if err := wait(canceled); err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Errorf("expected the deadline error, got %v", err)
+	}
+
+	close(release)
+	for _, result := range results {
+		if err := wait(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if logins != 1 || !reflect.DeepEqual(sessions, []string{"alice:token1", "alice:token1", "alice:token1"}) {
+		t.Errorf("expected 1 login, got %d and sessions %v", logins, sessions)
+	}
+
+	// During the renewal of the token, the other calls use the current one
+	release = make(chan struct{})
+	goca.SetLoginExpiration(time.Now().Add(30 * time.Second))
+	sessions = nil
+
+	renewal := info()
+	<-started
+	if err := wait(info()); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := wait(renewal); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sessions, []string{"alice:token1", "alice:token2"}) {
+		t.Errorf("expected the current token during the renewal, got %v", sessions)
+	}
+}
@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // MarketPlacePool represents an OpenNebula MarketPlacePool
@@ -12,6 +12,8 @@ type MarketPlacePool struct {
 
 // MarketPlace represents an OpenNebula MarketPlace
 type MarketPlace struct {
+	XMLResource
+
 	ID                 uint                `xml:"ID"`
 	UID                int                 `xml:"UID"`
 	GID                int                 `xml:"GID"`
@@ -36,26 +38,18 @@ type marketPlaceTemplate struct {
 // NewMarketPlacePool returns a marketplace pool. A connection to OpenNebula is
 // performed.
 func NewMarketPlacePool(args ...int) (*MarketPlacePool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 1:
-		who = args[0]
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, true)
+	if err != nil {
+		return nil, err
 	}
 
-    response, err := client.Call("one.marketpool.info", who, start, end)
+	return NewMarketPlacePoolWithOptions(opts)
+}
+
+// NewMarketPlacePoolWithOptions returns a marketplace pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewMarketPlacePoolWithOptions(opts PoolOptions) (*MarketPlacePool, error) {
+	response, err := client.Call("one.marketpool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +63,12 @@ func NewMarketPlacePool(args ...int) (*MarketPlacePool, error) {
 	return marketPool, nil
 }
 
+// NewMarketPlacePoolIterator returns an iterator over the marketplace pool, retrieving
+// pageSize IDs at a time
+func NewMarketPlacePoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.marketpool.info", "MARKETPLACE", opts, pageSize)
+}
+
 // NewMarketPlace finds a marketplace object by ID. No connection to OpenNebula.
 func NewMarketPlace(id uint) *MarketPlace {
 	return &MarketPlace{ID: id}
@@ -78,28 +78,11 @@ func NewMarketPlace(id uint) *MarketPlace {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the marketplace.
 func NewMarketPlaceFromName(name string) (*MarketPlace, error) {
-	var id uint
-
-	marketPool, err := NewMarketPlacePool()
+	id, err := resolveName(resolveMarketPlace, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(marketPool.MarketPlaces); i++ {
-		if marketPool.MarketPlaces[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = marketPool.MarketPlaces[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewMarketPlace(id), nil
 }
 
@@ -165,5 +148,6 @@ func (market *MarketPlace) Info() error {
 		return err
 	}
 	*market = MarketPlace{}
+	market.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), market)
 }
@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // MarketPlaceAppPool represents an OpenNebula MarketPlaceAppPool
@@ -12,6 +12,8 @@ type MarketPlaceAppPool struct {
 
 // MarketPlaceApp represents an OpenNebula MarketPlaceApp
 type MarketPlaceApp struct {
+	XMLResource
+
 	ID            uint                   `xml:"ID"`
 	UID           int                    `xml:"UID"`
 	GID           int                    `xml:"GID"`
@@ -44,26 +46,18 @@ type marketPlaceAppTemplate struct {
 // NewMarketPlaceAppPool returns a marketplace app pool. A connection to OpenNebula is
 // performed.
 func NewMarketPlaceAppPool(args ...int) (*MarketPlaceAppPool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 1:
-		who = args[0]
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, true)
+	if err != nil {
+		return nil, err
 	}
 
-    response, err := client.Call("one.marketapppool.info", who, start, end)
+	return NewMarketPlaceAppPoolWithOptions(opts)
+}
+
+// NewMarketPlaceAppPoolWithOptions returns a marketplace app pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewMarketPlaceAppPoolWithOptions(opts PoolOptions) (*MarketPlaceAppPool, error) {
+	response, err := client.Call("one.marketapppool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +71,12 @@ func NewMarketPlaceAppPool(args ...int) (*MarketPlaceAppPool, error) {
 	return marketappPool, nil
 }
 
+// NewMarketPlaceAppPoolIterator returns an iterator over the marketplace app pool, retrieving
+// pageSize IDs at a time
+func NewMarketPlaceAppPoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.marketapppool.info", "MARKETPLACEAPP", opts, pageSize)
+}
+
 // NewMarketPlaceApp finds a marketplace app object by ID. No connection to OpenNebula.
 func NewMarketPlaceApp(id uint) *MarketPlaceApp {
 	return &MarketPlaceApp{ID: id}
@@ -86,28 +86,11 @@ func NewMarketPlaceApp(id uint) *MarketPlaceApp {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the marketplace app.
 func NewMarketPlaceAppFromName(name string) (*MarketPlaceApp, error) {
-	var id uint
-
-	marketAppPool, err := NewMarketPlaceAppPool()
+	id, err := resolveName(resolveMarketPlaceApp, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(marketAppPool.MarketPlaceApps); i++ {
-		if marketAppPool.MarketPlaceApps[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = marketAppPool.MarketPlaceApps[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewMarketPlaceApp(id), nil
 }
 
@@ -181,6 +164,7 @@ func (marketApp *MarketPlaceApp) Info() error {
 		return err
 	}
 	*marketApp = MarketPlaceApp{}
+	marketApp.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), marketApp)
 }
 
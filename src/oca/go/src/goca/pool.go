@@ -0,0 +1,322 @@
+package goca
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+)
+
+// PoolOptions selects the resources returned by the pool retrieval calls.
+// Use NewPoolOptions to get the default values: the zero value selects the
+// resource 0 of the user 0.
+type PoolOptions struct {
+	// Who is one of the PoolWho* filter flags, or a user ID
+	Who int
+
+	// Start is the lowest ID of the range, -1 for the smallest ID
+	Start int
+
+	// End is the highest ID of the range, -1 for the largest ID
+	End int
+}
+
+// NewPoolOptions returns the options selecting all the resources of the user
+// performing the query
+func NewPoolOptions() PoolOptions {
+	return PoolOptions{
+		Who:   PoolWhoMine,
+		Start: -1,
+		End:   -1,
+	}
+}
+
+// poolOptions converts the variadic arguments of the NewXPool functions:
+// none, who, or who, start and end. whoOnly tells if the function accepts
+// the who argument alone.
+func poolOptions(args []int, whoOnly bool) (PoolOptions, error) {
+	opts := NewPoolOptions()
+
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && whoOnly:
+		opts.Who = args[0]
+	case len(args) == 3:
+		opts.Who = args[0]
+		opts.Start = args[1]
+		opts.End = args[2]
+	default:
+		return opts, errors.New("Wrong number of arguments")
+	}
+
+	return opts, nil
+}
+
+// PoolIterator pages through a pool by ranges of IDs, so that large pools are
+// never retrieved at once. Each page is decoded one resource at a time, while
+// it's received:
+//
+//	iter := goca.NewVMPoolIterator(ctx, goca.NewPoolOptions(), 100)
+//	defer iter.Close()
+//	for iter.Next() {
+//		var vm goca.VM
+//		err := iter.Decode(&vm)
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+//
+// The pages are retrieved by ascending IDs, the resources of a page are
+// sorted according to the API_LIST_ORDER setting of oned. When
+// PoolOptions.End is -1, the highest ID is looked up when the iteration
+// starts: the resources created afterwards are not returned.
+type PoolIterator struct {
+	ctx      context.Context
+	method   string
+	element  string
+	opts     PoolOptions
+	extra    []interface{}
+	pageSize int
+
+	started bool
+	next    int
+	last    int
+
+	body    io.ReadCloser
+	decoder *xml.Decoder
+	depth   int
+	current *xml.StartElement
+	err     error
+}
+
+func newPoolIterator(ctx context.Context, method, element string, opts PoolOptions, pageSize int, extra ...interface{}) *PoolIterator {
+	if pageSize <= 0 {
+		pageSize = 1
+	}
+
+	return &PoolIterator{
+		ctx:      ctx,
+		method:   method,
+		element:  element,
+		opts:     opts,
+		extra:    extra,
+		pageSize: pageSize,
+	}
+}
+
+// Next moves to the next resource of the pool. It returns false when the
+// iteration ends, either because all the resources were read or because of
+// an error returned by Err.
+func (it *PoolIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if !it.started {
+		it.started = true
+		if !it.init() {
+			return false
+		}
+	}
+
+	// Skip the resource if it hasn't been decoded
+	if it.current != nil {
+		it.current = nil
+		if it.err = it.decoder.Skip(); it.err != nil {
+			it.closePage()
+			return false
+		}
+	}
+
+	for {
+		if it.decoder != nil {
+			it.current, it.err = nextPoolElement(it.decoder, it.element, &it.depth)
+			if it.err != nil {
+				it.closePage()
+				return false
+			}
+			if it.current != nil {
+				return true
+			}
+			it.closePage()
+		}
+
+		if it.next > it.last {
+			return false
+		}
+
+		if it.err = it.ctx.Err(); it.err != nil {
+			return false
+		}
+
+		end := it.next + it.pageSize - 1
+		if end > it.last || end < it.next {
+			end = it.last
+		}
+
+		body, err := it.call(it.next, end)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.next = end + 1
+		it.body = body
+		it.decoder = xml.NewDecoder(body)
+		it.depth = 0
+	}
+}
+
+// Decode decodes the current resource into v, e.g. a *VM for an iterator
+// returned by NewVMPoolIterator.
+func (it *PoolIterator) Decode(v interface{}) error {
+	if it.current == nil {
+		return errors.New("Decode has to be called after a successful Next")
+	}
+
+	start := it.current
+	it.current = nil
+
+	return it.decoder.DecodeElement(v, start)
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *PoolIterator) Err() error {
+	return it.err
+}
+
+// Close ends the iteration and releases the response of the page being read.
+// It's only needed when the iteration is stopped before Next returns false.
+func (it *PoolIterator) Close() error {
+	it.started = true
+	it.next, it.last = 0, -1
+
+	return it.closePage()
+}
+
+// closePage releases the response of the page being read
+func (it *PoolIterator) closePage() error {
+	it.current = nil
+	it.decoder = nil
+	if it.body == nil {
+		return nil
+	}
+
+	body := it.body
+	it.body = nil
+	return body.Close()
+}
+
+// init computes the range of IDs to iterate over
+func (it *PoolIterator) init() bool {
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+
+	it.next = it.opts.Start
+	if it.next < 0 {
+		it.next = 0
+	}
+
+	it.last = it.opts.End
+	if it.last < 0 {
+		it.last, it.err = it.lastID()
+		if it.err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// call returns the body of the pool of the resources in [start, end], read
+// while it's received
+func (it *PoolIterator) call(start, end int) (io.ReadCloser, error) {
+	args := []interface{}{it.opts.Who, start, end}
+	args = append(args, it.extra...)
+
+	return client.openStream(it.ctx, it.method, args...)
+}
+
+// lastID returns the highest ID of the pool, or -1 if it's empty. With an end
+// argument lower than -1, oned uses start as an offset and -end as a limit,
+// so each call returns at most two resources. The order of the resources
+// depends on the API_LIST_ORDER setting of oned.
+func (it *PoolIterator) lastID() (int, error) {
+	ids, err := it.idsAt(0)
+	if err != nil || len(ids) == 0 {
+		return -1, err
+	}
+	if len(ids) == 1 || ids[0] > ids[1] {
+		// Single resource or descending order
+		return ids[0], nil
+	}
+
+	// Ascending order: look for the offset of the last resource, keeping the
+	// highest ID seen
+	last := ids[1]
+	lo, hi := 0, 1
+	for {
+		ids, err = it.idsAt(hi)
+		if err != nil {
+			return -1, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		last = maxID(last, ids)
+		lo, hi = hi, hi*2
+	}
+
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ids, err = it.idsAt(mid)
+		if err != nil {
+			return -1, err
+		}
+		if len(ids) > 0 {
+			last = maxID(last, ids)
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return last, nil
+}
+
+func maxID(max int, ids []int) int {
+	for _, id := range ids {
+		if id > max {
+			max = id
+		}
+	}
+	return max
+}
+
+// idsAt returns the IDs of the resources at offset and offset+1
+func (it *PoolIterator) idsAt(offset int) ([]int, error) {
+	body, err := it.call(offset, -2)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	pool := struct {
+		Resources []struct {
+			ID int `xml:"ID"`
+		} `xml:",any"`
+	}{}
+	err = xml.NewDecoder(body).Decode(&pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(pool.Resources))
+	for i, r := range pool.Resources {
+		ids[i] = r.ID
+	}
+
+	return ids, nil
+}
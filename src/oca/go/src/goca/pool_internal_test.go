@@ -0,0 +1,20 @@
+package goca
+
+import "testing"
+
+func TestPoolOptions(t *testing.T) {
+	opts, err := poolOptions([]int{PoolWhoAll}, true)
+	if err != nil || opts != (PoolOptions{Who: PoolWhoAll, Start: -1, End: -1}) {
+		t.Errorf("unexpected options %+v, %v", opts, err)
+	}
+
+	opts, err = poolOptions([]int{3, 10, 20}, false)
+	if err != nil || opts != (PoolOptions{Who: 3, Start: 10, End: 20}) {
+		t.Errorf("unexpected options %+v, %v", opts, err)
+	}
+
+	_, err = poolOptions([]int{PoolWhoAll}, false)
+	if err == nil {
+		t.Error("an error is expected for a single argument")
+	}
+}
@@ -0,0 +1,145 @@
+package goca_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// fakeVMPool starts a server answering the one.vmpool.info calls for the VMs
+// of ids, listed in descending order if desc is true
+func fakeVMPool(t *testing.T, ids []int, desc bool, pageSize int) func() {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	if desc {
+		sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	}
+
+	server, restore := newTestServer()
+	server.Handle("one.vmpool.info", func(call *gocatest.Call) (interface{}, error) {
+		start, end := call.Params[1].(int), call.Params[2].(int)
+
+		var selected []int
+		switch {
+		case end < -1:
+			for i := start; i < start-end && i < len(sorted); i++ {
+				selected = append(selected, sorted[i])
+			}
+		default:
+			if end-start+1 > pageSize {
+				t.Errorf("range [%d, %d] larger than the page size", start, end)
+			}
+			for _, id := range sorted {
+				if id >= start && (end == -1 || id <= end) {
+					selected = append(selected, id)
+				}
+			}
+		}
+
+		var body bytes.Buffer
+		body.WriteString("<VM_POOL>")
+		for _, id := range selected {
+			fmt.Fprintf(&body, "<VM><ID>%d</ID><NAME>vm-%d</NAME><TEMPLATE><NIC><IP>10.0.0.%d</IP></NIC></TEMPLATE></VM>", id, id, id)
+		}
+		body.WriteString("</VM_POOL>")
+
+		return body.String(), nil
+	})
+	return restore
+}
+
+func TestPoolIterator(t *testing.T) {
+	ids := []int{0, 1, 2, 5, 9, 10, 11, 20, 47}
+
+	for _, desc := range []bool{false, true} {
+		restore := fakeVMPool(t, ids, desc, 4)
+
+		var got []int
+		iter := goca.NewVMPoolIterator(context.Background(), goca.NewPoolOptions(), 4)
+		for iter.Next() {
+			var vm goca.VM
+			err := iter.Decode(&vm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vm.Name != fmt.Sprintf("vm-%d", vm.ID) || len(vm.Template.NIC) != 1 {
+				t.Errorf("VM %d not fully decoded: %+v", vm.ID, vm)
+			}
+			got = append(got, int(vm.ID))
+		}
+		if iter.Err() != nil {
+			t.Fatal(iter.Err())
+		}
+		// The order inside a page depends on the API_LIST_ORDER of oned
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("desc %t: expected %v, got %v", desc, ids, got)
+		}
+
+		restore()
+	}
+}
+
+func TestPoolIteratorRange(t *testing.T) {
+	restore := fakeVMPool(t, []int{1, 2, 3, 4, 5, 6, 7}, false, 2)
+	defer restore()
+
+	opts := goca.NewPoolOptions()
+	opts.Start = 2
+	opts.End = 6
+
+	// Resources not decoded are skipped
+	count := 0
+	iter := goca.NewVMPoolIterator(context.Background(), opts, 2)
+	for iter.Next() {
+		count++
+	}
+	if iter.Err() != nil {
+		t.Fatal(iter.Err())
+	}
+	if count != 5 {
+		t.Errorf("expected 5 VMs, got %d", count)
+	}
+
+	// Close ends the iteration in the middle of a page
+	iter = goca.NewVMPoolIterator(context.Background(), opts, 2)
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var vm goca.VM
+	if iter.Next() || iter.Err() != nil || iter.Decode(&vm) == nil {
+		t.Errorf("iteration ended expected, got %v", iter.Err())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	iter = goca.NewVMPoolIterator(ctx, opts, 2)
+	if iter.Next() || iter.Err() != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, iter.Err())
+	}
+}
+
+func TestVMPoolArgs(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+
+	_, err := goca.NewVMPool(goca.PoolWhoAll, 1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := server.Calls()
+	expected := []interface{}{-2, 1, 2, 3}
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0].Params, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
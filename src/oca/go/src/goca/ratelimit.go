@@ -0,0 +1,177 @@
+package goca
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the requests sent to OpenNebula. The zero value doesn't
+// limit anything.
+type RateLimit struct {
+	// Rate is the maximum number of requests per second. 0 means no limit.
+	Rate float64
+
+	// Burst is the number of requests that can be sent at once, above Rate.
+	// Defaults to 1.
+	Burst int
+
+	// MaxInFlight is the maximum number of requests waiting for their
+	// response. 0 means no limit.
+	MaxInFlight int
+}
+
+// limiter enforces a RateLimit
+type limiter struct {
+	bucket   *tokenBucket
+	inFlight chan struct{}
+}
+
+// newLimiter returns nil if limit doesn't limit anything
+func newLimiter(limit RateLimit) *limiter {
+	if limit.Rate <= 0 && limit.MaxInFlight <= 0 {
+		return nil
+	}
+
+	l := &limiter{}
+	if limit.Rate > 0 {
+		l.bucket = newTokenBucket(limit.Rate, limit.Burst)
+	}
+	if limit.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, limit.MaxInFlight)
+	}
+
+	return l
+}
+
+// acquire waits until a request can be sent. release has to be called once
+// its response is read.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l.bucket != nil {
+		if err := l.bucket.wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (l *limiter) release() {
+	if l.inFlight != nil {
+		<-l.inFlight
+	}
+}
+
+// acquire waits for the limits of method, then for the global ones. The
+// returned function releases both. The global limits are acquired last so
+// that the calls waiting for a saturated method don't hold global slots,
+// which would block the calls of the other methods.
+func (c *oneClient) acquire(ctx context.Context, method string) (func(), error) {
+	var acquired []*limiter
+	release := func() {
+		for _, l := range acquired {
+			l.release()
+		}
+	}
+
+	for _, l := range []*limiter{c.methodLimiters[method], c.limiter} {
+		if l == nil {
+			continue
+		}
+		if err := l.acquire(ctx); err != nil {
+			release()
+			return nil, err
+		}
+		acquired = append(acquired, l)
+	}
+
+	return release, nil
+}
+
+// releaseBody releases the in-flight request when the response body is
+// closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// tokenBucket is a token bucket rate limiter: tokens are added at rate per
+// second, up to burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket. burst is at least 1.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, waiting until one is available or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// Reserve the token, the bucket may become negative
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the reserved token back
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
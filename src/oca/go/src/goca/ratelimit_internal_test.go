@@ -0,0 +1,32 @@
+package goca
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(100, 2)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := bucket.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The burst is consumed at once, the next tokens come every 10ms
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("4 tokens with a burst of 2 at 100/s took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	bucket = newTokenBucket(0.1, 1)
+	bucket.wait(ctx)
+	if err := bucket.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
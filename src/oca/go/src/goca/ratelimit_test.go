@@ -0,0 +1,127 @@
+package goca_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+func TestClientRateLimit(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+
+	server, restore := newTestServer()
+	defer restore()
+	server.Hook("one.vmpool.info", func(*gocatest.Call) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		return nil
+	})
+
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := server.Config()
+	conf.MethodRateLimits = map[string]goca.RateLimit{
+		"one.vmpool.info": {MaxInFlight: 2},
+	}
+	goca.SetClient(conf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := goca.NewVMPool(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("expected 2 requests in flight, got %d", maxRunning)
+	}
+
+	// Waiting for the limits stops with the context
+	conf = server.Config()
+	conf.RateLimit = goca.RateLimit{Rate: 0.1}
+	goca.SetClient(conf)
+
+	vm := goca.NewVM(id)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = vm.InfoContext(ctx)
+	clientErr, ok := err.(*goca.ClientError)
+	if !ok || clientErr.Cause() != context.DeadlineExceeded {
+		t.Errorf("expected a rate limit error, got %v", err)
+	}
+}
+
+func TestClientRateLimitOrder(t *testing.T) {
+	slow := make(chan struct{})
+
+	server, restore := newTestServer()
+	defer restore()
+	server.Hook("one.vmpool.info", func(*gocatest.Call) error {
+		<-slow
+		return nil
+	})
+
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := server.Config()
+	conf.RateLimit = goca.RateLimit{MaxInFlight: 2}
+	conf.MethodRateLimits = map[string]goca.RateLimit{
+		"one.vmpool.info": {MaxInFlight: 1},
+	}
+	goca.SetClient(conf)
+
+	// One slow call is in flight, the others wait for the method limit
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := goca.NewVMPool(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// The waiting calls don't hold the global slots of the other methods
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := goca.NewVM(id).InfoContext(ctx); err != nil {
+		t.Errorf("fast call blocked by the slow ones: %s", err)
+	}
+
+	close(slow)
+	wg.Wait()
+}
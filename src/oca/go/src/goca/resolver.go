@@ -0,0 +1,366 @@
+package goca
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no resource has the looked up name
+	ErrNotFound = errors.New("resource not found")
+
+	// ErrAmbiguous is returned when several resources have the looked up
+	// name
+	ErrAmbiguous = errors.New("multiple resources with that name")
+)
+
+// NotFoundError is returned by a Resolver when no resource has the looked up
+// name. It matches ErrNotFound with errors.Is.
+type NotFoundError struct {
+	Resource string
+	Name     string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.Resource, e.Name)
+}
+
+// Is reports whether target is ErrNotFound
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// AmbiguousError is returned by a Resolver when several resources have the
+// looked up name. It matches ErrAmbiguous with errors.Is.
+type AmbiguousError struct {
+	Resource string
+	Name     string
+
+	// IDs of the matching resources
+	IDs []uint
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("%s %q is ambiguous, matching IDs: %v", e.Resource, e.Name, e.IDs)
+}
+
+// Is reports whether target is ErrAmbiguous
+func (e *AmbiguousError) Is(target error) bool {
+	return target == ErrAmbiguous
+}
+
+// Resolver finds the IDs of resources from their names. The pools are
+// retrieved once per TTL, and only the ID, name and owner of their resources
+// are kept.
+//
+// Names may be qualified by the name of their owner, e.g. "oneadmin/ubuntu".
+// Qualified names are looked up among all the resources the user can see,
+// unless Who is a user ID.
+type Resolver struct {
+	// Who is the scope of the lookups: one of the PoolWho* filter flags, or a
+	// user ID. It doesn't apply to the pools without owner, e.g. hosts.
+	Who int
+
+	// TTL is the lifetime of the retrieved pools. 0 disables the cache.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	pools map[resolverKey]*resolverPool
+
+	// fetching serializes the retrievals of each pool, guarded by mu
+	fetching map[resolverKey]*sync.Mutex
+}
+
+// NewResolver returns a resolver looking up the resources of the who scope,
+// and caching the pools for ttl
+func NewResolver(who int, ttl time.Duration) *Resolver {
+	return &Resolver{Who: who, TTL: ttl}
+}
+
+// resolverKind describes how to retrieve the pool of a kind of resource
+type resolverKind struct {
+	resource string
+	element  string
+	method   string
+
+	// filtered is true if the pool call accepts the who, start and end
+	// arguments, followed by extra
+	filtered bool
+	extra    []interface{}
+}
+
+var (
+	resolveVM             = resolverKind{"VM", "VM", "one.vmpool.info", true, []interface{}{-1}}
+	resolveImage          = resolverKind{"image", "IMAGE", "one.imagepool.info", true, nil}
+	resolveTemplate       = resolverKind{"template", "VMTEMPLATE", "one.templatepool.info", true, nil}
+	resolveVirtualNetwork = resolverKind{"virtual network", "VNET", "one.vnpool.info", true, nil}
+	resolveSecurityGroup  = resolverKind{"security group", "SECURITY_GROUP", "one.secgrouppool.info", true, nil}
+	resolveVNTemplate     = resolverKind{"vntemplate", "VNTEMPLATE", "one.vntemplatepool.info", true, nil}
+	resolveVirtualRouter  = resolverKind{"virtual router", "VROUTER", "one.vrouterpool.info", true, nil}
+	resolveMarketPlaceApp = resolverKind{"marketplace app", "MARKETPLACEAPP", "one.marketapppool.info", true, nil}
+	resolveHost           = resolverKind{"host", "HOST", "one.hostpool.info", false, nil}
+	resolveCluster        = resolverKind{"cluster", "CLUSTER", "one.clusterpool.info", false, nil}
+	resolveDatastore      = resolverKind{"datastore", "DATASTORE", "one.datastorepool.info", false, nil}
+	resolveUser           = resolverKind{"user", "USER", "one.userpool.info", false, nil}
+	resolveGroup          = resolverKind{"group", "GROUP", "one.grouppool.info", false, nil}
+	resolveMarketPlace    = resolverKind{"marketplace", "MARKETPLACE", "one.marketpool.info", true, nil}
+	resolveVdc            = resolverKind{"VDC", "VDC", "one.vdcpool.info", false, nil}
+)
+
+// resolveDocument returns the kind of the documents of type documentType
+func resolveDocument(documentType int) resolverKind {
+	return resolverKind{"document", "DOCUMENT", "one.documentpool.info", true, []interface{}{documentType}}
+}
+
+type resolverKey struct {
+	method string
+	who    int
+}
+
+type resolverPool struct {
+	fetched   time.Time
+	resources []resolverResource
+}
+
+type resolverResource struct {
+	ID    uint   `xml:"ID"`
+	Name  string `xml:"NAME"`
+	UName string `xml:"UNAME"`
+}
+
+// VMID returns the ID of the VM named name
+func (r *Resolver) VMID(name string) (uint, error) {
+	return r.resolve(resolveVM, name)
+}
+
+// ImageID returns the ID of the image named name
+func (r *Resolver) ImageID(name string) (uint, error) {
+	return r.resolve(resolveImage, name)
+}
+
+// TemplateID returns the ID of the template named name
+func (r *Resolver) TemplateID(name string) (uint, error) {
+	return r.resolve(resolveTemplate, name)
+}
+
+// VirtualNetworkID returns the ID of the virtual network named name
+func (r *Resolver) VirtualNetworkID(name string) (uint, error) {
+	return r.resolve(resolveVirtualNetwork, name)
+}
+
+// SecurityGroupID returns the ID of the security group named name
+func (r *Resolver) SecurityGroupID(name string) (uint, error) {
+	return r.resolve(resolveSecurityGroup, name)
+}
+
+// VNTemplateID returns the ID of the vntemplate named name
+func (r *Resolver) VNTemplateID(name string) (uint, error) {
+	return r.resolve(resolveVNTemplate, name)
+}
+
+// VirtualRouterID returns the ID of the virtual router named name
+func (r *Resolver) VirtualRouterID(name string) (uint, error) {
+	return r.resolve(resolveVirtualRouter, name)
+}
+
+// MarketPlaceAppID returns the ID of the marketplace app named name
+func (r *Resolver) MarketPlaceAppID(name string) (uint, error) {
+	return r.resolve(resolveMarketPlaceApp, name)
+}
+
+// HostID returns the ID of the host named name
+func (r *Resolver) HostID(name string) (uint, error) {
+	return r.resolve(resolveHost, name)
+}
+
+// ClusterID returns the ID of the cluster named name
+func (r *Resolver) ClusterID(name string) (uint, error) {
+	return r.resolve(resolveCluster, name)
+}
+
+// DatastoreID returns the ID of the datastore named name
+func (r *Resolver) DatastoreID(name string) (uint, error) {
+	return r.resolve(resolveDatastore, name)
+}
+
+// UserID returns the ID of the user named name
+func (r *Resolver) UserID(name string) (uint, error) {
+	return r.resolve(resolveUser, name)
+}
+
+// GroupID returns the ID of the group named name
+func (r *Resolver) GroupID(name string) (uint, error) {
+	return r.resolve(resolveGroup, name)
+}
+
+// Invalidate drops the cached pools
+func (r *Resolver) Invalidate() {
+	r.mu.Lock()
+	r.pools = nil
+	r.mu.Unlock()
+}
+
+func (r *Resolver) resolve(kind resolverKind, name string) (uint, error) {
+	owner := ""
+	// Resource names can't contain a '/', user names can
+	if i := strings.LastIndex(name, "/"); i >= 0 && kind.filtered {
+		owner, name = name[:i], name[i+1:]
+	}
+
+	who := r.Who
+	if owner != "" && who < 0 {
+		who = PoolWhoAll
+	}
+
+	resources, fresh, err := r.pool(kind, who, false)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := matchResources(resources, owner, name)
+
+	// The resource may have been created since the pool was cached
+	if len(ids) == 0 && !fresh {
+		resources, _, err = r.pool(kind, who, true)
+		if err != nil {
+			return 0, err
+		}
+		ids = matchResources(resources, owner, name)
+	}
+
+	qualifiedName := name
+	if owner != "" {
+		qualifiedName = owner + "/" + name
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, &NotFoundError{Resource: kind.resource, Name: qualifiedName}
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, &AmbiguousError{Resource: kind.resource, Name: qualifiedName, IDs: ids}
+	}
+}
+
+func matchResources(resources []resolverResource, owner, name string) []uint {
+	var ids []uint
+	for _, res := range resources {
+		if res.Name == name && (owner == "" || res.UName == owner) {
+			ids = append(ids, res.ID)
+		}
+	}
+	return ids
+}
+
+// resolveName returns the ID of the resource of kind named name, among the
+// resources of the user, for the New*FromName functions. Unlike a Resolver,
+// it doesn't split the owner from the name and returns ErrNotFound or
+// ErrAmbiguous as is. The pool is streamed and not cached.
+func resolveName(kind resolverKind, name string) (uint, error) {
+	resources, err := fetchPool(kind, PoolWhoMine)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := matchResources(resources, "", name)
+	switch len(ids) {
+	case 0:
+		return 0, ErrNotFound
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, ErrAmbiguous
+	}
+}
+
+// pool returns the resources of a pool, from the cache if it's still valid
+// and refresh is false. fresh is true if the pool has been retrieved during the
+// call. Each pool is retrieved by one lookup at a time, without holding mu, so
+// the lookups of the other pools aren't blocked, and the concurrent lookups of
+// the same pool share its retrieval.
+func (r *Resolver) pool(kind resolverKind, who int, refresh bool) (resources []resolverResource, fresh bool, err error) {
+	if r.TTL <= 0 {
+		resources, err = fetchPool(kind, who)
+		return resources, err == nil, err
+	}
+
+	key := resolverKey{method: kind.method}
+	if kind.filtered {
+		key.who = who
+	}
+
+	called := time.Now()
+
+	r.mu.Lock()
+	if cached, ok := r.pools[key]; ok && !refresh && time.Since(cached.fetched) < r.TTL {
+		r.mu.Unlock()
+		return cached.resources, false, nil
+	}
+	if r.fetching == nil {
+		r.fetching = map[resolverKey]*sync.Mutex{}
+	}
+	fetching, ok := r.fetching[key]
+	if !ok {
+		fetching = &sync.Mutex{}
+		r.fetching[key] = fetching
+	}
+	r.mu.Unlock()
+
+	fetching.Lock()
+	defer fetching.Unlock()
+
+	// The pool may have been retrieved by another lookup in the meantime
+	r.mu.Lock()
+	cached, ok := r.pools[key]
+	r.mu.Unlock()
+	if ok && !cached.fetched.Before(called) {
+		return cached.resources, true, nil
+	}
+	if ok && !refresh && time.Since(cached.fetched) < r.TTL {
+		return cached.resources, false, nil
+	}
+
+	fetched := time.Now()
+	resources, err = fetchPool(kind, who)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.mu.Lock()
+	if r.pools == nil {
+		r.pools = map[resolverKey]*resolverPool{}
+	}
+	r.pools[key] = &resolverPool{fetched: fetched, resources: resources}
+	r.mu.Unlock()
+
+	return resources, true, nil
+}
+
+// fetchPool retrieves the ID, name and owner of the resources of a pool
+func fetchPool(kind resolverKind, who int) ([]resolverResource, error) {
+	var args []interface{}
+	if kind.filtered {
+		args = append([]interface{}{who, -1, -1}, kind.extra...)
+	}
+
+	var resources []resolverResource
+	err := streamPool(kind.element, func(start *xml.StartElement, d *xml.Decoder) error {
+		var res resolverResource
+		err := d.DecodeElement(&res, start)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, res)
+		return nil
+	}, kind.method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
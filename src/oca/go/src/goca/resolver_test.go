@@ -0,0 +1,192 @@
+package goca_test
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// createImage creates an image of the datastore 1
+func createImage(t *testing.T, name string) uint {
+	id, err := goca.CreateImage("NAME = "+name+"\nPATH = /tmp/"+name+".qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestResolver(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+
+	// An image of oneadmin in the users group, and the ones of alice
+	if _, err := goca.CreateUser("alice", "pass", "core", []uint{1}); err != nil {
+		t.Fatal(err)
+	}
+	shared := createImage(t, "ubuntu")
+	if err := goca.NewImage(shared).Chown(-1, 1); err != nil {
+		t.Fatal(err)
+	}
+	goca.SetClient(goca.NewConfig("alice", "pass", server.URL))
+	ubuntu, debian := createImage(t, "ubuntu"), createImage(t, "debian")
+
+	calls := 0
+	var who interface{}
+	server.Hook("one.imagepool.info", func(call *gocatest.Call) error {
+		calls++
+		who = call.Params[0]
+		return nil
+	})
+
+	r := goca.NewResolver(goca.PoolWhoGroup, time.Minute)
+
+	id, err := r.ImageID("debian")
+	if err != nil || id != debian {
+		t.Errorf("expected %d, got %d, %v", debian, id, err)
+	}
+	id, err = r.ImageID("debian")
+	if err != nil || id != debian || calls != 1 {
+		t.Errorf("cached pool expected, got %d, %v after %d calls", id, err, calls)
+	}
+
+	_, err = r.ImageID("ubuntu")
+	ambiguous, ok := err.(*goca.AmbiguousError)
+	if !ok || !ambiguous.Is(goca.ErrAmbiguous) || !reflect.DeepEqual(ambiguous.IDs, []uint{shared, ubuntu}) {
+		t.Errorf("AmbiguousError expected, got %v", err)
+	}
+
+	// Qualified names are looked up in all the pool
+	id, err = r.ImageID("oneadmin/ubuntu")
+	if err != nil || id != shared || who != goca.PoolWhoAll {
+		t.Errorf("expected %d in the whole pool, got %d, %v, who: %v", shared, id, err, who)
+	}
+
+	// A missing name triggers a refresh of the cached pool
+	calls = 0
+	centos := createImage(t, "centos")
+	id, err = r.ImageID("centos")
+	if err != nil || id != centos || calls != 1 {
+		t.Errorf("expected %d after a refresh, got %d, %v after %d calls", centos, id, err, calls)
+	}
+
+	_, err = r.ImageID("alice/fedora")
+	notFound, ok := err.(*goca.NotFoundError)
+	if !ok || !notFound.Is(goca.ErrNotFound) || notFound.Name != "alice/fedora" {
+		t.Errorf("NotFoundError expected, got %v", err)
+	}
+
+	// Without TTL, each lookup retrieves the pool
+	calls = 0
+	r = goca.NewResolver(goca.PoolWhoGroup, 0)
+	r.ImageID("centos")
+	r.ImageID("centos")
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestResolverConcurrentPools(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+
+	ubuntu := createImage(t, "ubuntu")
+
+	var imageCalls int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server.Hook("one.imagepool.info", func(*gocatest.Call) error {
+		atomic.AddInt32(&imageCalls, 1)
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	r := goca.NewResolver(goca.PoolWhoMine, time.Minute)
+
+	images := make(chan uint, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			id, err := r.ImageID("ubuntu")
+			if err != nil {
+				t.Error(err)
+			}
+			images <- id
+		}()
+	}
+	<-started
+
+	// The slow image pool doesn't block the lookups of the hosts
+	hosts := make(chan uint)
+	go func() {
+		id, err := r.HostID("localhost")
+		if err != nil {
+			t.Error(err)
+		}
+		hosts <- id
+	}()
+	select {
+	case id := <-hosts:
+		if id != 0 {
+			t.Errorf("expected 0, got %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("host lookup blocked by the image pool")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if id := <-images; id != ubuntu {
+			t.Errorf("expected %d, got %d", ubuntu, id)
+		}
+	}
+	// The concurrent lookups share the retrieval of the pool
+	if calls := atomic.LoadInt32(&imageCalls); calls != 1 {
+		t.Errorf("expected 1 image pool call, got %d", calls)
+	}
+}
+
+func TestNewFromName(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+
+	// The VMs of alice, and a VM of oneadmin named like one of them
+	if _, err := goca.CreateUser("alice", "pass", "core", []uint{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := goca.CreateVM("NAME = db\nCPU = 1\nMEMORY = 64", false); err != nil {
+		t.Fatal(err)
+	}
+	goca.SetClient(goca.NewConfig("alice", "pass", server.URL))
+	ids := map[string]uint{}
+	for _, name := range []string{"web", "web", "db", "alice/db"} {
+		id, err := goca.CreateVM("NAME = \""+name+"\"\nCPU = 1\nMEMORY = 64", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	before := len(server.Calls())
+	vm, err := goca.NewVMFromName("db")
+	calls := server.Calls()[before:]
+	if err != nil || vm.ID != ids["db"] || len(calls) != 1 || !reflect.DeepEqual(calls[0].Params, []interface{}{-3, -1, -1, -1}) {
+		t.Errorf("expected %d among the VMs of the user, got %v, %v, calls: %v", ids["db"], vm, err, calls)
+	}
+
+	// The names aren't qualified by their owner
+	vm, err = goca.NewVMFromName("alice/db")
+	if err != nil || vm.ID != ids["alice/db"] {
+		t.Errorf("expected %d, got %v, %v", ids["alice/db"], vm, err)
+	}
+	if _, err = goca.NewVMFromName("alice/web"); err != goca.ErrNotFound {
+		t.Errorf("expected %v, got %v", goca.ErrNotFound, err)
+	}
+
+	if _, err = goca.NewVMFromName("web"); err != goca.ErrAmbiguous {
+		t.Errorf("expected %v, got %v", goca.ErrAmbiguous, err)
+	}
+}
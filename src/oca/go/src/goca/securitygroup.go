@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // SecurityGroupPool represents an OpenNebula SecurityGroupPool
@@ -12,6 +12,8 @@ type SecurityGroupPool struct {
 
 // SecurityGroup represents an OpenNebula SecurityGroup
 type SecurityGroup struct {
+	XMLResource
+
 	ID          uint                  `xml:"ID"`
 	UID         int                   `xml:"UID"`
 	GID         int                   `xml:"GID"`
@@ -41,26 +43,18 @@ type securityGroupRule struct {
 // NewSecurityGroupPool returns a security group pool. A connection to OpenNebula is
 // performed.
 func NewSecurityGroupPool(args ...int) (*SecurityGroupPool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 1:
-		who = args[0]
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, true)
+	if err != nil {
+		return nil, err
 	}
 
-    response, err := client.Call("one.secgrouppool.info", who, start, end)
+	return NewSecurityGroupPoolWithOptions(opts)
+}
+
+// NewSecurityGroupPoolWithOptions returns a security group pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewSecurityGroupPoolWithOptions(opts PoolOptions) (*SecurityGroupPool, error) {
+	response, err := client.Call("one.secgrouppool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +68,12 @@ func NewSecurityGroupPool(args ...int) (*SecurityGroupPool, error) {
 	return secgroupPool, nil
 }
 
+// NewSecurityGroupPoolIterator returns an iterator over the security group pool, retrieving
+// pageSize IDs at a time
+func NewSecurityGroupPoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.secgrouppool.info", "SECURITY_GROUP", opts, pageSize)
+}
+
 // NewSecurityGroup finds a security group object by ID. No connection to OpenNebula.
 func NewSecurityGroup(id uint) *SecurityGroup {
 	return &SecurityGroup{ID: id}
@@ -83,28 +83,11 @@ func NewSecurityGroup(id uint) *SecurityGroup {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the security group.
 func NewSecurityGroupFromName(name string) (*SecurityGroup, error) {
-	var id uint
-
-	secgroupPool, err := NewSecurityGroupPool()
+	id, err := resolveName(resolveSecurityGroup, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(secgroupPool.SecurityGroups); i++ {
-		if secgroupPool.SecurityGroups[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = secgroupPool.SecurityGroups[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewSecurityGroup(id), nil
 }
 
@@ -187,5 +170,6 @@ func (sg *SecurityGroup) Info() error {
 		return err
 	}
 	*sg = SecurityGroup{}
+	sg.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), sg)
 }
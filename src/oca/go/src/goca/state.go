@@ -0,0 +1,57 @@
+package goca
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Helpers shared by the state types (VMState, LCMState, ImageState,
+// HostState) to parse and print their values.
+// A state value unknown to goca, e.g. sent by a newer version of OpenNebula,
+// is printed as "<type>(<value>)" and parsed back from this form or from its
+// numeric value.
+
+// stateString returns name if the state is known, or the generic form of the
+// value otherwise
+func stateString(typeName string, value int, name string) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s(%d)", typeName, value)
+}
+
+// parseState returns the value of the state s. name returns the name of each
+// known value, from 0 to last, or "" for a hole in the values.
+func parseState(typeName, s string, last int, name func(int) string) (int, error) {
+	s = strings.TrimSpace(s)
+
+	for i := 0; i <= last; i++ {
+		if n := name(i); n != "" && strings.EqualFold(n, s) {
+			return i, nil
+		}
+	}
+
+	raw := s
+	if strings.HasPrefix(s, typeName+"(") && strings.HasSuffix(s, ")") {
+		raw = s[len(typeName)+1 : len(s)-1]
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		return -1, fmt.Errorf("%s: unknown state %q", typeName, s)
+	}
+
+	return value, nil
+}
+
+// jsonStateString returns the content of a JSON string or the JSON number as
+// is, so that states can be unmarshalled from both their name and value
+func jsonStateString(data []byte) []byte {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		return []byte(s)
+	}
+	return data
+}
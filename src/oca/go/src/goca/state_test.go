@@ -0,0 +1,150 @@
+package goca
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseVMState(t *testing.T) {
+	for st := Init; st <= CloningFailure; st++ {
+		if !st.isValid() {
+			continue
+		}
+
+		parsed, err := ParseVMState(st.String())
+		if err != nil || parsed != st {
+			t.Errorf("%s: parsed as %d, err: %v", st, parsed, err)
+		}
+	}
+
+	if CloningFailure.String() != "CLONINGFAILURE" {
+		t.Errorf("CloningFailure: unexpected name %s", CloningFailure)
+	}
+	st, err := ParseVMState("CLONING_FAILURE")
+	if err != nil || st != CloningFailure {
+		t.Errorf("CLONING_FAILURE name of oned not parsed: %d, %v", st, err)
+	}
+
+	_, err = ParseVMState("NOT_A_STATE")
+	if err == nil {
+		t.Error("an error is expected for an unknown name")
+	}
+}
+
+func TestParseLCMState(t *testing.T) {
+	for st := LcmInit; st <= BackupPoweroff; st++ {
+		if !st.isValid() {
+			continue
+		}
+
+		parsed, err := ParseLCMState(st.String())
+		if err != nil || parsed != st {
+			t.Errorf("%s: parsed as %d, err: %v", st, parsed, err)
+		}
+	}
+
+	st, err := ParseLCMState("running")
+	if err != nil || st != Running {
+		t.Errorf("names should be case insensitive: %d, %v", st, err)
+	}
+}
+
+func TestParseImageHostState(t *testing.T) {
+	for st := ImageInit; st <= ImageLockUsedPers; st++ {
+		parsed, err := ParseImageState(st.String())
+		if err != nil || parsed != st {
+			t.Errorf("%s: parsed as %d, err: %v", st, parsed, err)
+		}
+	}
+
+	for st := HostState(HostInit); st <= HostOffline; st++ {
+		parsed, err := ParseHostState(st.String())
+		if err != nil || parsed != st {
+			t.Errorf("%s: parsed as %d, err: %v", st, parsed, err)
+		}
+	}
+}
+
+func TestUnknownState(t *testing.T) {
+	// Values sent by a newer OpenNebula version
+	vm := &VM{StateRaw: 12, LCMStateRaw: 99}
+
+	state, lcmState, err := vm.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.String() != "VMState(12)" || lcmState.String() != "LCMState(99)" {
+		t.Errorf("unexpected names: %s, %s", state, lcmState)
+	}
+
+	if vm.IsFailure() || vm.IsTransient() || vm.IsRunning() {
+		t.Error("an unknown state should not be classified")
+	}
+
+	parsed, err := ParseLCMState(lcmState.String())
+	if err != nil || parsed != lcmState {
+		t.Errorf("%s: parsed as %d, err: %v", lcmState, parsed, err)
+	}
+
+	image := &Image{StateRaw: 42}
+	if s, err := image.StateString(); err != nil || s != "ImageState(42)" {
+		t.Errorf("unexpected image state: %s, %v", s, err)
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	type states struct {
+		State    VMState
+		LCMState LCMState
+		Image    ImageState
+		Host     HostState
+	}
+
+	in := states{Active, Running, ImageReady, HostMonitored}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"State":"ACTIVE","LCMState":"RUNNING","Image":"READY","Host":"MONITORED"}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+
+	var out states
+	err = json.Unmarshal([]byte(`{"State":3,"LCMState":"RUNNING","Image":1,"Host":"MONITORED"}`), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("expected %v, got %v", in, out)
+	}
+}
+
+func TestVMStateClassification(t *testing.T) {
+	vm := &VM{StateRaw: int(Active), LCMStateRaw: int(PrologMigrateUnknownFailure)}
+	if !vm.IsFailure() || vm.IsTransient() || vm.IsRunning() {
+		t.Error("PROLOG_MIGRATE_UNKNOWN_FAILURE should only be a failure")
+	}
+
+	vm = &VM{StateRaw: int(Active), LCMStateRaw: int(HotplugNic)}
+	if vm.IsFailure() || !vm.IsTransient() || !vm.IsRunning() {
+		t.Error("HOTPLUG_NIC should be transient and running")
+	}
+
+	vm = &VM{StateRaw: int(Active), LCMStateRaw: int(Unknown)}
+	if vm.IsFailure() || vm.IsTransient() || vm.IsRunning() {
+		t.Error("UNKNOWN should not be classified")
+	}
+
+	vm = &VM{StateRaw: int(CloningFailure)}
+	if !vm.IsFailure() {
+		t.Error("CLONING_FAILURE should be a failure")
+	}
+
+	vm = &VM{StateRaw: int(Pending)}
+	if !vm.IsTransient() || vm.IsRunning() {
+		t.Error("PENDING should be transient")
+	}
+}
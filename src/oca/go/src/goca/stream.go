@@ -0,0 +1,417 @@
+package goca
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kolo/xmlrpc"
+)
+
+// StreamVMPool retrieves the VM pool filtered by opts, without the VMs in the
+// DONE state, and calls fn for each VM as soon as it's decoded from the
+// response. The pool is never held in memory. The retrieval stops at the
+// first error returned by fn.
+func StreamVMPool(opts PoolOptions, fn func(vm *VM) error) error {
+	return streamPool("VM", func(start *xml.StartElement, d *xml.Decoder) error {
+		vm := &VM{}
+		err := d.DecodeElement(vm, start)
+		if err != nil {
+			return err
+		}
+		return fn(vm)
+	}, "one.vmpool.info", opts.Who, opts.Start, opts.End, -1)
+}
+
+// StreamImagePool retrieves the image pool filtered by opts and calls fn for
+// each image as soon as it's decoded from the response. The pool is never
+// held in memory. The retrieval stops at the first error returned by fn.
+func StreamImagePool(opts PoolOptions, fn func(image *Image) error) error {
+	return streamPool("IMAGE", func(start *xml.StartElement, d *xml.Decoder) error {
+		image := &Image{}
+		err := d.DecodeElement(image, start)
+		if err != nil {
+			return err
+		}
+		return fn(image)
+	}, "one.imagepool.info", opts.Who, opts.Start, opts.End)
+}
+
+// StreamHostPool retrieves the host pool and calls fn for each host as soon
+// as it's decoded from the response. The pool is never held in memory. The
+// retrieval stops at the first error returned by fn.
+func StreamHostPool(fn func(host *Host) error) error {
+	return streamPool("HOST", func(start *xml.StartElement, d *xml.Decoder) error {
+		host := &Host{}
+		err := d.DecodeElement(host, start)
+		if err != nil {
+			return err
+		}
+		return fn(host)
+	}, "one.hostpool.info")
+}
+
+// streamPool calls method and decodes each element of the returned pool with
+// decode
+func streamPool(element string, decode func(start *xml.StartElement, d *xml.Decoder) error, method string, args ...interface{}) error {
+	return client.streamCall(method, func(body io.Reader) error {
+		d := xml.NewDecoder(body)
+		depth := 0
+		for {
+			start, err := nextPoolElement(d, element, &depth)
+			if err != nil || start == nil {
+				return err
+			}
+
+			err = decode(start, d)
+			if err != nil {
+				return err
+			}
+		}
+	}, args...)
+}
+
+// nextPoolElement reads the tokens of a pool until the start of the next
+// element. depth tracks the level of the decoder between two calls. It
+// returns nil at the end of the pool.
+func nextPoolElement(d *xml.Decoder, element string, depth *int) (*xml.StartElement, error) {
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if *depth == 0 {
+				// Pool element, e.g. VM_POOL
+				*depth++
+				continue
+			}
+			if t.Name.Local == element {
+				return &t, nil
+			}
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+		case xml.EndElement:
+			*depth--
+		}
+	}
+}
+
+// streamCall calls method and passes the unescaped body of a successful
+// response to fn while it's received, see openStream. The error returned by fn
+// is returned as is.
+func (c *oneClient) streamCall(method string, fn func(body io.Reader) error, args ...interface{}) error {
+	body, err := c.openStream(context.Background(), method, args...)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return fn(body)
+}
+
+// openStream is the streaming counterpart of CallContext: instead of reading
+// the whole response, it returns the unescaped body of a successful response,
+// which is read while it's received. The body has to be a string. Closing the
+// returned body releases the response.
+func (c *oneClient) openStream(ctx context.Context, method string, args ...interface{}) (io.ReadCloser, error) {
+	session, token, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.sessionOpenStream(ctx, session, method, args...)
+	if token && c.loginRejected(session, err) {
+		session, _, err = c.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		body, err = c.sessionOpenStream(ctx, session, method, args...)
+	}
+
+	return body, err
+}
+
+// streamBody is the body of a streamed response, closing it closes the
+// response
+type streamBody struct {
+	io.Reader
+	io.Closer
+}
+
+func (c *oneClient) sessionOpenStream(ctx context.Context, session string, method string, args ...interface{}) (io.ReadCloser, error) {
+	resp, err := c.post(ctx, c.url, session, method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := responseBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return &streamBody{Reader: body, Closer: resp.Body}, nil
+}
+
+// responseBody reads resp until its body, and returns a reader of the body if
+// the call succeeded, or the error of the response
+func responseBody(resp *http.Response) (io.Reader, error) {
+	s := &xmlrpcScanner{r: bufio.NewReader(resp.Body)}
+
+	tag, err := s.skipTo("params", "fault")
+	if err != nil {
+		return nil, &ClientError{ClientRespXMLRPCParse, "unmarshal xmlrpc", resp, err}
+	}
+	if tag == "fault" {
+		rest, _ := ioutil.ReadAll(s.r)
+		fault := xmlrpc.NewResponse(append([]byte("<methodResponse><fault>"), rest...))
+		return nil, &ClientError{ClientRespXMLRPCFault, "server response", resp, fault.Err()}
+	}
+
+	// Parse according the XML-RPC OpenNebula API documentation
+	_, err = s.skipTo("boolean")
+	if err != nil {
+		return nil, &ClientError{ClientRespONeParse, "index 0: boolean expected", resp, err}
+	}
+	status, err := s.text()
+	if err != nil {
+		return nil, &ClientError{ClientRespONeParse, "index 0: boolean expected", resp, err}
+	}
+
+	body, err := s.stringValue()
+	if err != nil {
+		return nil, &ClientError{ClientRespONeParse, "index 1: string expected", resp, err}
+	}
+
+	if status != "1" {
+		msg, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, &ClientError{ClientRespHTTP, "read http response body", resp, err}
+		}
+
+		_, err = s.skipTo("i4", "int")
+		if err != nil {
+			return nil, &ClientError{ClientRespONeParse, "index 2: integer expected", resp, err}
+		}
+		code, err := s.text()
+		if err != nil {
+			return nil, &ClientError{ClientRespONeParse, "index 2: integer expected", resp, err}
+		}
+		errCode, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, &ClientError{ClientRespONeParse, "index 2: integer expected", resp, err}
+		}
+
+		return nil, &ResponseError{
+			Code: OneErrCode(errCode),
+			msg:  string(msg),
+		}
+	}
+
+	return body, nil
+}
+
+// xmlrpcScanner reads the parts of an XML-RPC response needed to stream its
+// body, without building the tree of the response
+type xmlrpcScanner struct {
+	r *bufio.Reader
+}
+
+// nextTag skips the text until the next tag, and returns its name. End tags
+// start with a '/', empty element tags end with a '/'.
+func (s *xmlrpcScanner) nextTag() (string, error) {
+	_, err := s.r.ReadString('<')
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := s.r.ReadString('>')
+	if err != nil {
+		return "", err
+	}
+	tag = strings.TrimSuffix(tag, ">")
+
+	// Remove the attributes
+	if i := strings.IndexAny(tag, " \t\r\n"); i >= 0 {
+		empty := strings.HasSuffix(tag, "/")
+		tag = tag[:i]
+		if empty {
+			tag += "/"
+		}
+	}
+
+	return tag, nil
+}
+
+// skipTo skips the response until one of the tags, and returns the matching
+// tag
+func (s *xmlrpcScanner) skipTo(tags ...string) (string, error) {
+	for {
+		tag, err := s.nextTag()
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+
+		for _, t := range tags {
+			if tag == t {
+				return tag, nil
+			}
+		}
+	}
+}
+
+// text returns the unescaped text until the next tag
+func (s *xmlrpcScanner) text() (string, error) {
+	text, err := ioutil.ReadAll(&xmlTextReader{r: s.r})
+	return string(text), err
+}
+
+// stringValue skips the response until the next value, which has to be a
+// string, and returns a reader of its unescaped content
+func (s *xmlrpcScanner) stringValue() (io.Reader, error) {
+	_, err := s.skipTo("value")
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := s.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if next[0] != '<' {
+		// Value without type: a string
+		return &xmlTextReader{r: s.r}, nil
+	}
+
+	tag, err := s.nextTag()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case "string":
+		return &xmlTextReader{r: s.r}, nil
+	case "string/", "/value":
+		return strings.NewReader(""), nil
+	default:
+		return nil, errors.New("unexpected value type " + tag)
+	}
+}
+
+// xmlTextReader reads the text of an XML element until the next tag, and
+// replaces the entities by the characters they stand for
+type xmlTextReader struct {
+	r       *bufio.Reader
+	pending []byte
+	done    bool
+}
+
+func (t *xmlTextReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(t.pending) > 0 {
+			c := copy(p[n:], t.pending)
+			t.pending = t.pending[c:]
+			n += c
+			continue
+		}
+
+		if t.done {
+			break
+		}
+
+		b, err := t.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		switch b {
+		case '<':
+			t.done = true
+			t.r.UnreadByte()
+		case '&':
+			t.pending, err = t.entity()
+			if err != nil {
+				return n, err
+			}
+		default:
+			p[n] = b
+			n++
+
+			// Copy the following characters up to the next markup at once
+			buffered, _ := t.r.Peek(t.r.Buffered())
+			if len(buffered) > len(p)-n {
+				buffered = buffered[:len(p)-n]
+			}
+			if i := bytes.IndexAny(buffered, "<&"); i >= 0 {
+				buffered = buffered[:i]
+			}
+			n += copy(p[n:], buffered)
+			t.r.Discard(len(buffered))
+		}
+	}
+
+	if n == 0 && t.done {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
+// entity reads an entity once its '&' has been read
+func (t *xmlTextReader) entity() ([]byte, error) {
+	name, err := t.r.ReadString(';')
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSuffix(name, ";")
+
+	switch name {
+	case "lt":
+		return []byte("<"), nil
+	case "gt":
+		return []byte(">"), nil
+	case "amp":
+		return []byte("&"), nil
+	case "quot":
+		return []byte(`"`), nil
+	case "apos":
+		return []byte("'"), nil
+	}
+
+	if strings.HasPrefix(name, "#") {
+		var code uint64
+		if strings.HasPrefix(name, "#x") {
+			code, err = strconv.ParseUint(name[2:], 16, 32)
+		} else {
+			code, err = strconv.ParseUint(name[1:], 10, 32)
+		}
+		if err == nil {
+			buf := make([]byte, utf8.UTFMax)
+			return buf[:utf8.EncodeRune(buf, rune(code))], nil
+		}
+	}
+
+	return nil, errors.New("invalid XML entity &" + name + ";")
+}
@@ -0,0 +1,161 @@
+package goca_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// fakeVMPoolBody returns a VM pool of count VMs with history records
+func fakeVMPoolBody(count int) string {
+	var body bytes.Buffer
+	body.WriteString("<VM_POOL>")
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&body, "<VM><ID>%d</ID><NAME>vm &amp; &lt;%d&gt;</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>", i, i)
+		body.WriteString("<TEMPLATE><NIC><IP>10.0.0.1</IP><NETWORK>public</NETWORK></NIC></TEMPLATE>")
+		body.WriteString("<HISTORY_RECORDS>")
+		for seq := 0; seq < 10; seq++ {
+			fmt.Fprintf(&body, "<HISTORY><SEQ>%d</SEQ><HOSTNAME>host-%d</HOSTNAME><ACTION>0</ACTION></HISTORY>", seq, seq)
+		}
+		body.WriteString("</HISTORY_RECORDS></VM>")
+	}
+	body.WriteString("</VM_POOL>")
+
+	return body.String()
+}
+
+func TestStreamVMPool(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+	server.Handle("one.vmpool.info", func(*gocatest.Call) (interface{}, error) {
+		return fakeVMPoolBody(50), nil
+	})
+
+	count := 0
+	err := goca.StreamVMPool(goca.NewPoolOptions(), func(vm *goca.VM) error {
+		expected := fmt.Sprintf("vm & <%d>", count)
+		if vm.ID != uint(count) || vm.Name != expected || len(vm.HistoryRecords) != 10 {
+			t.Errorf("VM %d not decoded: %q, %d records", vm.ID, vm.Name, len(vm.HistoryRecords))
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 50 {
+		t.Errorf("expected 50 VMs, got %d", count)
+	}
+
+	// The error of the callback stops the stream
+	stop := errors.New("stop")
+	count = 0
+	err = goca.StreamVMPool(goca.NewPoolOptions(), func(vm *goca.VM) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("expected %v after 1 VM, got %v after %d", stop, err, count)
+	}
+}
+
+func TestStreamCallError(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+	server.FailNext("one.hostpool.info", &gocatest.Error{Code: goca.OneAuthorizationError, Message: "[one.hostpool.info] not authorized"})
+
+	err := goca.StreamHostPool(func(host *goca.Host) error {
+		t.Error("no host expected")
+		return nil
+	})
+
+	respErr, ok := err.(*goca.ResponseError)
+	if !ok {
+		t.Fatalf("ResponseError expected, got %v", err)
+	}
+	if respErr.Code != goca.OneAuthorizationError || !strings.HasSuffix(err.Error(), ": [one.hostpool.info] not authorized") {
+		t.Errorf("unexpected error %d: %s", respErr.Code, err)
+	}
+}
+
+func benchmarkVMPool(b *testing.B, stream bool) {
+	body := fakeVMPoolBody(2000)
+	server, restore := newTestServer()
+	defer restore()
+	server.Handle("one.vmpool.info", func(*gocatest.Call) (interface{}, error) {
+		return body, nil
+	})
+
+	// Peak of the heap during the retrievals, above the heap of the fake
+	// server. Both paths are sampled the same way, by a goroutine reading the
+	// heap size while the pool is received and processed.
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		count := 0
+		var err error
+		if stream {
+			err = goca.StreamVMPool(goca.NewPoolOptions(), func(vm *goca.VM) error {
+				count++
+				return nil
+			})
+		} else {
+			var pool *goca.VMPool
+			pool, err = goca.NewVMPool()
+			if err == nil {
+				count = len(pool.VMs)
+			}
+		}
+		if err != nil || count != 2000 {
+			b.Fatalf("%d VMs: %v", count, err)
+		}
+	}
+
+	b.StopTimer()
+	close(done)
+	<-sampled
+
+	b.ReportMetric(float64(peak-base), "peak-heap-B")
+}
+
+func BenchmarkVMPoolUnmarshal(b *testing.B) {
+	benchmarkVMPool(b, false)
+}
+
+func BenchmarkVMPoolStream(b *testing.B) {
+	benchmarkVMPool(b, true)
+}
@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // TemplatePool represents an OpenNebula TemplatePool
@@ -12,6 +12,8 @@ type TemplatePool struct {
 
 // Template represents an OpenNebula Template
 type Template struct {
+	XMLResource
+
 	ID          uint             `xml:"ID"`
 	UID         int              `xml:"UID"`
 	GID         int              `xml:"GID"`
@@ -65,22 +67,18 @@ type templateOS struct {
 // NewTemplatePool returns a template pool. A connection to OpenNebula is
 // performed.
 func NewTemplatePool(args ...int) (*TemplatePool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, false)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Call("one.templatepool.info", who, start, end)
+	return NewTemplatePoolWithOptions(opts)
+}
+
+// NewTemplatePoolWithOptions returns a template pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewTemplatePoolWithOptions(opts PoolOptions) (*TemplatePool, error) {
+	response, err := client.Call("one.templatepool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -94,6 +92,12 @@ func NewTemplatePool(args ...int) (*TemplatePool, error) {
 	return templatePool, nil
 }
 
+// NewTemplatePoolIterator returns an iterator over the template pool, retrieving
+// pageSize IDs at a time
+func NewTemplatePoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.templatepool.info", "VMTEMPLATE", opts, pageSize)
+}
+
 // NewTemplate finds a template object by ID. No connection to OpenNebula.
 func NewTemplate(id uint) *Template {
 	return &Template{ID: id}
@@ -103,28 +107,11 @@ func NewTemplate(id uint) *Template {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the template.
 func NewTemplateFromName(name string) (*Template, error) {
-	var id uint
-
-	templatePool, err := NewTemplatePool()
+	id, err := resolveName(resolveTemplate, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(templatePool.Templates); i++ {
-		if templatePool.Templates[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = templatePool.Templates[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewTemplate(id), nil
 }
 
@@ -145,6 +132,7 @@ func (template *Template) Info() error {
 		return err
 	}
 	*template = Template{}
+	template.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), template)
 }
 
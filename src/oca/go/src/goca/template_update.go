@@ -0,0 +1,511 @@
+package goca
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	// UpdateReplace replaces the whole template when passed as appendTemplate
+	// to any Update method
+	UpdateReplace = 0
+
+	// UpdateMerge merges the new template with the existing one when passed as
+	// appendTemplate to any Update method
+	UpdateMerge = 1
+)
+
+// ErrConcurrentUpdate is returned by SafeUpdate when the template has been
+// modified by someone else during the read-modify-write cycle
+var ErrConcurrentUpdate = errors.New("template modified concurrently")
+
+// safeUpdateRetries is the number of read-modify-write cycles tried by
+// SafeUpdate before giving up on a template that keeps changing
+const safeUpdateRetries = 3
+
+// TemplateUpdater is implemented by every resource which exposes an Update
+// method: VM, Image, Template, VirtualNetwork, Host, User...
+type TemplateUpdater interface {
+	Update(tpl string, appendTemplate int) error
+
+	templateRef() templateRef
+}
+
+// templateRef locates the updatable template of a resource: the info method
+// to call and the element holding the template in its response
+type templateRef struct {
+	method  string
+	id      uint
+	element string
+}
+
+// SafeUpdate fetches the current template of the resource, applies mutate on
+// it and sends the minimal difference to OpenNebula. A merge update is sent
+// when attributes are only added or modified, a replace update with the whole
+// template when some attributes are removed, and nothing at all when mutate
+// didn't change anything.
+// The template is fetched again before and after the update to detect
+// concurrent modifications: mutate is applied again on a fresh template when
+// the template changed before the write, and ErrConcurrentUpdate is returned
+// if it keeps changing or if the result differs from the expected one: the
+// modified attributes after a merge, the whole template after a replace.
+func SafeUpdate(r TemplateUpdater, mutate func(tpl *TemplateAttributes) error) error {
+	ref := r.templateRef()
+
+	for i := 0; i < safeUpdateRetries; i++ {
+		before, err := fetchTemplate(ref)
+		if err != nil {
+			return err
+		}
+
+		after := before.Clone()
+		err = mutate(after)
+		if err != nil {
+			return err
+		}
+
+		tpl, appendTemplate, changed := updateFromDiff(before, after)
+		if !changed {
+			return nil
+		}
+
+		current, err := fetchTemplate(ref)
+		if err != nil {
+			return err
+		}
+		if !current.Equal(before) {
+			continue
+		}
+
+		err = r.Update(tpl, appendTemplate)
+		if err != nil {
+			return err
+		}
+
+		final, err := fetchTemplate(ref)
+		if err != nil {
+			return err
+		}
+		// A replace erases the attributes added by someone else, the whole
+		// template has to be the expected one
+		if appendTemplate == UpdateReplace && !final.Equal(after) {
+			return ErrConcurrentUpdate
+		}
+		for _, key := range mergeKeys(before.Keys(), after.Keys()) {
+			if !equalValues(final.values(key), after.values(key)) {
+				return ErrConcurrentUpdate
+			}
+		}
+
+		return nil
+	}
+
+	return ErrConcurrentUpdate
+}
+
+// updateFromDiff computes the template and the update mode to send in order
+// to turn before into after. changed is false if there is nothing to send.
+func updateFromDiff(before, after *TemplateAttributes) (tpl string, appendTemplate int, changed bool) {
+	diff := NewTemplateAttributes()
+	removed := false
+
+	for _, key := range mergeKeys(before.Keys(), after.Keys()) {
+		newValues := after.values(key)
+		if equalValues(before.values(key), newValues) {
+			continue
+		}
+		if len(newValues) == 0 {
+			removed = true
+		}
+		for _, attr := range after.attrs {
+			if attr.key == key {
+				diff.attrs = append(diff.attrs, attr.clone())
+			}
+		}
+	}
+
+	if removed {
+		return after.xmlString(), UpdateReplace, true
+	}
+	if len(diff.attrs) == 0 {
+		return "", 0, false
+	}
+
+	return diff.xmlString(), UpdateMerge, true
+}
+
+// fetchTemplate retrieves the updatable template of a resource
+func fetchTemplate(ref templateRef) (*TemplateAttributes, error) {
+	response, err := client.Call(ref.method, ref.id)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &xmlNode{}
+	err = xml.Unmarshal([]byte(response.Body()), root)
+	if err != nil {
+		return nil, err
+	}
+
+	node := root.child(ref.element)
+	if node == nil {
+		return NewTemplateAttributes(), nil
+	}
+
+	return templateFromXML(node), nil
+}
+
+// xmlNode is a generic representation of an XML element
+type xmlNode struct {
+	XMLName xml.Name
+	Content string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// child returns the first child element with the given name
+func (n *xmlNode) child(name string) *xmlNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// TemplateAttributes is an editable representation of a resource template,
+// made of single attributes (KEY=VALUE) and vector attributes
+// (KEY=[ K1=V1, K2=V2 ]). Attribute names are upper cased like OpenNebula
+// does.
+type TemplateAttributes struct {
+	attrs []*templateAttribute
+}
+
+type templateAttribute struct {
+	key   string
+	value string
+
+	// vector is nil for single attributes
+	vector *TemplateVector
+}
+
+// TemplateVector is a vector attribute of a TemplateAttributes
+type TemplateVector struct {
+	key   string
+	pairs []TemplateBuilderPair
+}
+
+// NewTemplateAttributes returns an empty TemplateAttributes
+func NewTemplateAttributes() *TemplateAttributes {
+	return &TemplateAttributes{}
+}
+
+// templateFromXML builds a TemplateAttributes from the children of node
+func templateFromXML(node *xmlNode) *TemplateAttributes {
+	t := NewTemplateAttributes()
+
+	for _, n := range node.Nodes {
+		if len(n.Nodes) == 0 {
+			t.attrs = append(t.attrs, &templateAttribute{key: n.XMLName.Local, value: n.Content})
+			continue
+		}
+
+		vector := &TemplateVector{key: n.XMLName.Local}
+		for _, p := range n.Nodes {
+			vector.pairs = append(vector.pairs, TemplateBuilderPair{p.XMLName.Local, p.Content})
+		}
+		t.attrs = append(t.attrs, &templateAttribute{key: vector.key, vector: vector})
+	}
+
+	return t
+}
+
+// Keys returns the names of the attributes, in order of first appearance
+func (t *TemplateAttributes) Keys() []string {
+	keys := make([]string, 0, len(t.attrs))
+	for _, attr := range t.attrs {
+		keys = mergeKeys(keys, []string{attr.key})
+	}
+	return keys
+}
+
+// Get returns the value of the single attribute key
+func (t *TemplateAttributes) Get(key string) (string, bool) {
+	key = strings.ToUpper(key)
+	for _, attr := range t.attrs {
+		if attr.key == key && attr.vector == nil {
+			return attr.value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces all the attributes named key by a single attribute
+func (t *TemplateAttributes) Set(key, value string) {
+	key = strings.ToUpper(key)
+	attr := &templateAttribute{key: key, value: value}
+
+	for i, a := range t.attrs {
+		if a.key == key {
+			t.Del(key)
+			t.attrs = append(t.attrs[:i], append([]*templateAttribute{attr}, t.attrs[i:]...)...)
+			return
+		}
+	}
+	t.attrs = append(t.attrs, attr)
+}
+
+// Del removes all the attributes, single or vector, named key
+func (t *TemplateAttributes) Del(key string) {
+	key = strings.ToUpper(key)
+	attrs := t.attrs[:0]
+	for _, attr := range t.attrs {
+		if attr.key != key {
+			attrs = append(attrs, attr)
+		}
+	}
+	t.attrs = attrs
+}
+
+// Vectors returns the vector attributes named key
+func (t *TemplateAttributes) Vectors(key string) []*TemplateVector {
+	key = strings.ToUpper(key)
+	var vectors []*TemplateVector
+	for _, attr := range t.attrs {
+		if attr.key == key && attr.vector != nil {
+			vectors = append(vectors, attr.vector)
+		}
+	}
+	return vectors
+}
+
+// AddVector appends a new empty vector attribute named key
+func (t *TemplateAttributes) AddVector(key string) *TemplateVector {
+	vector := &TemplateVector{key: strings.ToUpper(key)}
+	t.attrs = append(t.attrs, &templateAttribute{key: vector.key, vector: vector})
+	return vector
+}
+
+// Clone returns a deep copy of the template
+func (t *TemplateAttributes) Clone() *TemplateAttributes {
+	c := NewTemplateAttributes()
+	for _, attr := range t.attrs {
+		c.attrs = append(c.attrs, attr.clone())
+	}
+	return c
+}
+
+// Equal returns true if both templates contain the same attributes. The order
+// of different attributes and of the pairs inside a vector doesn't matter.
+func (t *TemplateAttributes) Equal(other *TemplateAttributes) bool {
+	for _, key := range mergeKeys(t.Keys(), other.Keys()) {
+		if !equalValues(t.values(key), other.values(key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the template in XML syntax, accepted by every Update method
+func (t *TemplateAttributes) String() string {
+	return t.xmlString()
+}
+
+// values returns a comparable representation of the attributes named key
+func (t *TemplateAttributes) values(key string) []string {
+	var values []string
+	for _, attr := range t.attrs {
+		if attr.key != key {
+			continue
+		}
+		if attr.vector == nil {
+			values = append(values, "S:"+attr.value)
+			continue
+		}
+
+		pairs := make([]string, 0, len(attr.vector.pairs))
+		for _, p := range attr.vector.pairs {
+			pairs = append(pairs, p.key+"="+p.value)
+		}
+		sort.Strings(pairs)
+		values = append(values, "V:"+strings.Join(pairs, "\x00"))
+	}
+	return values
+}
+
+func (t *TemplateAttributes) xmlString() string {
+	var buf bytes.Buffer
+
+	buf.WriteString("<TEMPLATE>")
+	for _, attr := range t.attrs {
+		if attr.vector == nil {
+			writeXMLElement(&buf, attr.key, attr.value)
+			continue
+		}
+
+		buf.WriteString("<" + attr.key + ">")
+		for _, p := range attr.vector.pairs {
+			writeXMLElement(&buf, p.key, p.value)
+		}
+		buf.WriteString("</" + attr.key + ">")
+	}
+	buf.WriteString("</TEMPLATE>")
+
+	return buf.String()
+}
+
+func (a *templateAttribute) clone() *templateAttribute {
+	c := &templateAttribute{key: a.key, value: a.value}
+	if a.vector != nil {
+		c.vector = &TemplateVector{key: a.vector.key}
+		c.vector.pairs = append(c.vector.pairs, a.vector.pairs...)
+	}
+	return c
+}
+
+// Key returns the name of the vector
+func (v *TemplateVector) Key() string {
+	return v.key
+}
+
+// Get returns the value of the pair key of the vector
+func (v *TemplateVector) Get(key string) (string, bool) {
+	key = strings.ToUpper(key)
+	for _, p := range v.pairs {
+		if p.key == key {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// Set adds or replaces the pair key of the vector
+func (v *TemplateVector) Set(key, value string) {
+	key = strings.ToUpper(key)
+	for i := range v.pairs {
+		if v.pairs[i].key == key {
+			v.pairs[i].value = value
+			return
+		}
+	}
+	v.pairs = append(v.pairs, TemplateBuilderPair{key, value})
+}
+
+// Del removes the pair key from the vector
+func (v *TemplateVector) Del(key string) {
+	key = strings.ToUpper(key)
+	pairs := v.pairs[:0]
+	for _, p := range v.pairs {
+		if p.key != key {
+			pairs = append(pairs, p)
+		}
+	}
+	v.pairs = pairs
+}
+
+func writeXMLElement(buf *bytes.Buffer, key, value string) {
+	buf.WriteString("<" + key + ">")
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteString("</" + key + ">")
+}
+
+// mergeKeys appends to a the keys of b which are not already in a
+func mergeKeys(a, b []string) []string {
+	for _, key := range b {
+		found := false
+		for _, k := range a {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, key)
+		}
+	}
+	return a
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Template location of each resource exposing an Update method
+
+func (cluster *Cluster) templateRef() templateRef {
+	return templateRef{"one.cluster.info", cluster.ID, "TEMPLATE"}
+}
+
+func (datastore *Datastore) templateRef() templateRef {
+	return templateRef{"one.datastore.info", datastore.ID, "TEMPLATE"}
+}
+
+func (document *Document) templateRef() templateRef {
+	return templateRef{"one.document.info", document.ID, "TEMPLATE"}
+}
+
+func (group *Group) templateRef() templateRef {
+	return templateRef{"one.group.info", group.ID, "TEMPLATE"}
+}
+
+func (host *Host) templateRef() templateRef {
+	return templateRef{"one.host.info", host.ID, "TEMPLATE"}
+}
+
+func (image *Image) templateRef() templateRef {
+	return templateRef{"one.image.info", image.ID, "TEMPLATE"}
+}
+
+func (market *MarketPlace) templateRef() templateRef {
+	return templateRef{"one.market.info", market.ID, "TEMPLATE"}
+}
+
+func (marketApp *MarketPlaceApp) templateRef() templateRef {
+	return templateRef{"one.marketapp.info", marketApp.ID, "TEMPLATE"}
+}
+
+func (sg *SecurityGroup) templateRef() templateRef {
+	return templateRef{"one.secgroup.info", sg.ID, "TEMPLATE"}
+}
+
+func (template *Template) templateRef() templateRef {
+	return templateRef{"one.template.info", template.ID, "TEMPLATE"}
+}
+
+func (user *User) templateRef() templateRef {
+	return templateRef{"one.user.info", user.ID, "TEMPLATE"}
+}
+
+func (vdc *Vdc) templateRef() templateRef {
+	return templateRef{"one.vdc.info", vdc.ID, "TEMPLATE"}
+}
+
+func (vn *VirtualNetwork) templateRef() templateRef {
+	return templateRef{"one.vn.info", vn.ID, "TEMPLATE"}
+}
+
+func (vr *VirtualRouter) templateRef() templateRef {
+	return templateRef{"one.vrouter.info", vr.ID, "TEMPLATE"}
+}
+
+func (vm *VM) templateRef() templateRef {
+	return templateRef{"one.vm.info", vm.ID, "USER_TEMPLATE"}
+}
+
+func (vntemplate *VNTemplate) templateRef() templateRef {
+	return templateRef{"one.vntemplate.info", vntemplate.ID, "TEMPLATE"}
+}
+
+func (zone *Zone) templateRef() templateRef {
+	return templateRef{"one.zone.info", zone.ID, "TEMPLATE"}
+}
@@ -0,0 +1,91 @@
+package goca
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+var updateTplXML = `<VM><ID>0</ID><USER_TEMPLATE>
+<A><![CDATA[1]]></A>
+<B><![CDATA[2]]></B>
+<DISK><IMAGE_ID><![CDATA[3]]></IMAGE_ID><DEV_PREFIX><![CDATA[vd]]></DEV_PREFIX></DISK>
+</USER_TEMPLATE></VM>`
+
+// Helper to parse the user template of updateTplXML
+func parseUpdateTpl(t *testing.T) *TemplateAttributes {
+	root := &xmlNode{}
+	err := xml.Unmarshal([]byte(updateTplXML), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return templateFromXML(root.child("USER_TEMPLATE"))
+}
+
+func TestTemplateAttributesParse(t *testing.T) {
+	tpl := parseUpdateTpl(t)
+
+	val, ok := tpl.Get("A")
+	if !ok || val != "1" {
+		t.Errorf("A: expected 1, got %q", val)
+	}
+
+	disks := tpl.Vectors("disk")
+	if len(disks) != 1 {
+		t.Fatalf("expected 1 DISK, got %d", len(disks))
+	}
+
+	val, ok = disks[0].Get("IMAGE_ID")
+	if !ok || val != "3" {
+		t.Errorf("DISK/IMAGE_ID: expected 3, got %q", val)
+	}
+}
+
+func TestUpdateFromDiff(t *testing.T) {
+	before := parseUpdateTpl(t)
+
+	// No change
+	after := before.Clone()
+	_, _, changed := updateFromDiff(before, after)
+	if changed {
+		t.Error("no change expected")
+	}
+
+	// Modification and addition: only the changed attributes are merged
+	after = before.Clone()
+	after.Set("a", "10")
+	after.Set("C", "<&>")
+	after.Vectors("DISK")[0].Set("SIZE", "1024")
+
+	tpl, appendTemplate, changed := updateFromDiff(before, after)
+	if !changed || appendTemplate != UpdateMerge {
+		t.Fatalf("merge expected, got changed=%t, append=%d", changed, appendTemplate)
+	}
+
+	expected := "<TEMPLATE><A>10</A>" +
+		"<DISK><IMAGE_ID>3</IMAGE_ID><DEV_PREFIX>vd</DEV_PREFIX><SIZE>1024</SIZE></DISK>" +
+		"<C>&lt;&amp;&gt;</C></TEMPLATE>"
+	if tpl != expected {
+		t.Errorf("expected %s, got %s", expected, tpl)
+	}
+
+	// Removal: the whole template is replaced
+	after = before.Clone()
+	after.Del("B")
+
+	tpl, appendTemplate, changed = updateFromDiff(before, after)
+	if !changed || appendTemplate != UpdateReplace {
+		t.Fatalf("replace expected, got changed=%t, append=%d", changed, appendTemplate)
+	}
+
+	expected = "<TEMPLATE><A>1</A>" +
+		"<DISK><IMAGE_ID>3</IMAGE_ID><DEV_PREFIX>vd</DEV_PREFIX></DISK></TEMPLATE>"
+	if tpl != expected {
+		t.Errorf("expected %s, got %s", expected, tpl)
+	}
+
+	// The original template is left untouched
+	if !before.Equal(parseUpdateTpl(t)) {
+		t.Error("before template has been modified")
+	}
+}
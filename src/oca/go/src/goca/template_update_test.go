@@ -0,0 +1,225 @@
+package goca_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// updateServer is a server with a VM whose user template is A=1 and B=2, for
+// SafeUpdate
+type updateServer struct {
+	*gocatest.Server
+
+	vm *goca.VM
+
+	// onInfo is called before answering the nth one.vm.info, from 1, to
+	// simulate the updates of someone else
+	onInfo func(n int)
+}
+
+// Starts an updateServer
+func newUpdateServer(t *testing.T) (*updateServer, func()) {
+	server, restore := newTestServer()
+
+	id, err := goca.CreateVM("NAME = vm\nCPU = 1\nMEMORY = 64\nA = 1\nB = 2", false)
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	s := &updateServer{Server: server, vm: goca.NewVM(id)}
+
+	infos := 0
+	server.Hook("one.vm.info", func(*gocatest.Call) error {
+		infos++
+		if s.onInfo != nil {
+			s.onInfo(infos)
+		}
+		return nil
+	})
+
+	return s, restore
+}
+
+// set sets an attribute of the user template of the VM
+func (s *updateServer) set(t *testing.T, key, value string) {
+	if err := s.SetVMAttribute(s.vm.ID, key, value); err != nil {
+		t.Error(err)
+	}
+}
+
+// updates returns the one.vm.update calls
+func (s *updateServer) updates() []gocatest.Call {
+	var updates []gocatest.Call
+	for _, call := range s.Calls() {
+		if call.Method == "one.vm.update" {
+			updates = append(updates, call)
+		}
+	}
+	return updates
+}
+
+// get returns an attribute of the user template of the VM
+func (s *updateServer) get(t *testing.T, key string) string {
+	s.onInfo = nil
+	if err := s.vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	return s.vm.UserTemplate.Dynamic.GetContentByName(key)
+}
+
+func TestSafeUpdate(t *testing.T) {
+	setA := func(tpl *goca.TemplateAttributes) error {
+		tpl.Set("A", "10")
+		return nil
+	}
+
+	// Modification: only the modified attribute is merged
+	s, restore := newUpdateServer(t)
+	if err := goca.SafeUpdate(s.vm, setA); err != nil {
+		t.Fatal(err)
+	}
+	updates := s.updates()
+	if len(updates) != 1 || updates[0].Params[1] != "<TEMPLATE><A>10</A></TEMPLATE>" || updates[0].Params[2] != 1 {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	if a := s.get(t, "A"); a != "10" {
+		t.Errorf("expected A=10, got %q", a)
+	}
+	restore()
+
+	// Removal: the whole template is replaced
+	s, restore = newUpdateServer(t)
+	err := goca.SafeUpdate(s.vm, func(tpl *goca.TemplateAttributes) error {
+		tpl.Del("B")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates = s.updates()
+	if len(updates) != 1 || strings.Contains(updates[0].Params[1].(string), "<B>") || updates[0].Params[2] != 0 {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	if b := s.get(t, "B"); b != "" {
+		t.Errorf("B not removed: %q", b)
+	}
+	restore()
+
+	// No change, no update
+	s, restore = newUpdateServer(t)
+	if err := goca.SafeUpdate(s.vm, func(*goca.TemplateAttributes) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if updates := s.updates(); len(updates) != 0 {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	restore()
+}
+
+func TestSafeUpdateErrors(t *testing.T) {
+	// The error of mutate is returned, without update
+	s, restore := newUpdateServer(t)
+	mutateErr := errors.New("mutate error")
+	if err := goca.SafeUpdate(s.vm, func(*goca.TemplateAttributes) error { return mutateErr }); err != mutateErr {
+		t.Errorf("expected %v, got %v", mutateErr, err)
+	}
+	if updates := s.updates(); len(updates) != 0 {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	restore()
+
+	// The error of the update is returned
+	s, restore = newUpdateServer(t)
+	s.FailNext("one.vm.update", &gocatest.Error{Code: goca.OneAuthorizationError, Message: "[one.vm.update] not authorized"})
+	err := goca.SafeUpdate(s.vm, func(tpl *goca.TemplateAttributes) error {
+		tpl.Set("A", "10")
+		return nil
+	})
+	if e, ok := err.(*goca.ResponseError); !ok || e.Code != goca.OneAuthorizationError {
+		t.Errorf("expected an authorization error, got %v", err)
+	}
+	restore()
+}
+
+func TestSafeUpdateConcurrent(t *testing.T) {
+	mutations := 0
+	setA := func(tpl *goca.TemplateAttributes) error {
+		mutations++
+		tpl.Set("A", "10")
+		return nil
+	}
+
+	// B is modified between the fetch and the write: the cycle starts again,
+	// and the modification of B is kept
+	s, restore := newUpdateServer(t)
+	s.onInfo = func(n int) {
+		if n == 2 {
+			s.set(t, "B", "20")
+		}
+	}
+	if err := goca.SafeUpdate(s.vm, setA); err != nil {
+		t.Fatal(err)
+	}
+	if updates := s.updates(); mutations != 2 || len(updates) != 1 {
+		t.Errorf("expected 2 mutations and 1 update, got %d and %v", mutations, updates)
+	}
+	if a := s.get(t, "A"); a != "10" {
+		t.Errorf("expected A=10, got %q", a)
+	}
+	if b := s.get(t, "B"); b != "20" {
+		t.Errorf("expected B=20, got %q", b)
+	}
+	restore()
+
+	// The template keeps changing: no update
+	s, restore = newUpdateServer(t)
+	s.onInfo = func(n int) {
+		s.set(t, "COUNTER", strings.Repeat("I", n))
+	}
+	if err := goca.SafeUpdate(s.vm, setA); err != goca.ErrConcurrentUpdate {
+		t.Errorf("expected %v, got %v", goca.ErrConcurrentUpdate, err)
+	}
+	if updates := s.updates(); len(updates) != 0 {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	restore()
+
+	// A is modified again just after the write
+	s, restore = newUpdateServer(t)
+	s.onInfo = func(n int) {
+		if n == 3 {
+			s.set(t, "A", "11")
+		}
+	}
+	if err := goca.SafeUpdate(s.vm, setA); err != goca.ErrConcurrentUpdate {
+		t.Errorf("expected %v, got %v", goca.ErrConcurrentUpdate, err)
+	}
+	if updates := s.updates(); len(updates) != 1 {
+		t.Errorf("expected 1 update, got %v", updates)
+	}
+	restore()
+
+	// C is added during the removal of B: the replace doesn't leave the
+	// expected template
+	s, restore = newUpdateServer(t)
+	s.onInfo = func(n int) {
+		if n == 3 {
+			s.set(t, "C", "30")
+		}
+	}
+	err := goca.SafeUpdate(s.vm, func(tpl *goca.TemplateAttributes) error {
+		tpl.Del("B")
+		return nil
+	})
+	if err != goca.ErrConcurrentUpdate {
+		t.Errorf("expected %v, got %v", goca.ErrConcurrentUpdate, err)
+	}
+	if updates := s.updates(); len(updates) != 1 || updates[0].Params[2] != 0 {
+		t.Errorf("expected 1 replace update, got %v", updates)
+	}
+	restore()
+}
@@ -2,7 +2,6 @@ package goca
 
 import (
 	"encoding/xml"
-	"errors"
 )
 
 // UserPool represents an OpenNebula UserPool
@@ -14,6 +13,8 @@ type UserPool struct {
 
 // User represents an OpenNebula user
 type User struct {
+	XMLResource
+
 	ID          uint         `xml:"ID"`
 	GID         int          `xml:"GID"`
 	GroupsID    []int        `xml:"GROUPS>ID"`
@@ -66,29 +67,30 @@ func NewUser(id uint) *User {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the user.
 func NewUserFromName(name string) (*User, error) {
-	var id uint
-
-	userPool, err := NewUserPool()
+	id, err := resolveName(resolveUser, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(userPool.Users); i++ {
-		if userPool.Users[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = userPool.Users[i].ID
-		match = true
+	return NewUser(id), nil
+}
+
+// CurrentUser returns the user of the client credentials, with its
+// attributes. It's also the way to check the credentials.
+func CurrentUser() (*User, error) {
+	response, err := client.Call("one.user.info", -1)
+	if err != nil {
+		return nil, err
 	}
-	if !match {
-		return nil, errors.New("resource not found")
+
+	user := &User{}
+	user.body = response.Body()
+	err = xml.Unmarshal([]byte(response.Body()), user)
+	if err != nil {
+		return nil, err
 	}
 
-	return NewUser(id), nil
+	return user, nil
 }
 
 // CreateUser allocates a new user. It returns the new user ID.
@@ -178,5 +180,6 @@ func (user *User) Info() error {
 		return err
 	}
 	*user = User{}
+	user.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), user)
 }
@@ -2,7 +2,6 @@ package goca
 
 import (
 	"encoding/xml"
-	"errors"
 )
 
 // VdcPool represents an OpenNebula VdcPool
@@ -12,6 +11,8 @@ type VdcPool struct {
 
 // Vdc represents an OpenNebula Vdc
 type Vdc struct {
+	XMLResource
+
 	ID         uint           `xml:"ID"`
 	Name       string         `xml:"NAME"`
 	GroupsID   []int          `xml:"GROUPS>ID"`
@@ -72,28 +73,11 @@ func NewVdc(id uint) *Vdc {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the vdc.
 func NewVdcFromName(name string) (*Vdc, error) {
-	var id uint
-
-	vdcPool, err := NewVdcPool()
+	id, err := resolveName(resolveVdc, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(vdcPool.Vdcs); i++ {
-		if vdcPool.Vdcs[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = vdcPool.Vdcs[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewVdc(id), nil
 }
 
@@ -139,6 +123,7 @@ func (vdc *Vdc) Info() error {
 		return err
 	}
 	*vdc = Vdc{}
+	vdc.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), vdc)
 }
 
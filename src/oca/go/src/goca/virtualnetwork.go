@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // VirtualNetworkPool represents an OpenNebula VirtualNetworkPool
@@ -12,6 +12,8 @@ type VirtualNetworkPool struct {
 
 // VirtualNetwork represents an OpenNebula VirtualNetwork
 type VirtualNetwork struct {
+	XMLResource
+
 	ID                   uint                   `xml:"ID"`
 	UID                  int                    `xml:"UID"`
 	GID                  int                    `xml:"GID"`
@@ -82,26 +84,18 @@ type lease struct {
 // NewVirtualNetworkPool returns a virtualnetwork pool. A connection to OpenNebula is
 // performed.
 func NewVirtualNetworkPool(args ...int) (*VirtualNetworkPool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 1:
-		who = args[0]
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, true)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Call("one.vnpool.info", who, start, end)
+	return NewVirtualNetworkPoolWithOptions(opts)
+}
+
+// NewVirtualNetworkPoolWithOptions returns a virtual network pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewVirtualNetworkPoolWithOptions(opts PoolOptions) (*VirtualNetworkPool, error) {
+	response, err := client.Call("one.vnpool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -115,6 +109,12 @@ func NewVirtualNetworkPool(args ...int) (*VirtualNetworkPool, error) {
 	return vnPool, nil
 }
 
+// NewVirtualNetworkPoolIterator returns an iterator over the virtual network pool, retrieving
+// pageSize IDs at a time
+func NewVirtualNetworkPoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.vnpool.info", "VNET", opts, pageSize)
+}
+
 // NewVirtualNetwork finds a virtualnetwork object by ID. No connection to OpenNebula.
 func NewVirtualNetwork(id uint) *VirtualNetwork {
 	return &VirtualNetwork{ID: id}
@@ -124,28 +124,11 @@ func NewVirtualNetwork(id uint) *VirtualNetwork {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the virtualnetwork.
 func NewVirtualNetworkFromName(name string) (*VirtualNetwork, error) {
-	var id uint
-
-	virtualNetworkPool, err := NewVirtualNetworkPool()
+	id, err := resolveName(resolveVirtualNetwork, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(virtualNetworkPool.VirtualNetworks); i++ {
-		if virtualNetworkPool.VirtualNetworks[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = virtualNetworkPool.VirtualNetworks[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewVirtualNetwork(id), nil
 }
 
@@ -261,5 +244,6 @@ func (vn *VirtualNetwork) Info() error {
 		return err
 	}
 	*vn = VirtualNetwork{}
+	vn.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), vn)
 }
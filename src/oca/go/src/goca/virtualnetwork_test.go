@@ -78,7 +78,7 @@ func TestVirtualNetwork(t *testing.T) {
 	gname := vnet.GName
 
     // Compare with caller username
-    caller := strings.Split(client.token, ":")[0]
+    caller := strings.Split(clientSession(), ":")[0]
     if caller != uname {
         t.Error("Caller user and virtual network owner user mismatch")
     }
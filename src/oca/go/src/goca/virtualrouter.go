@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // VirtualRouterPool represents an OpenNebula VirtualRouterPool
@@ -12,6 +12,8 @@ type VirtualRouterPool struct {
 
 // VirtualRouter represents an OpenNebula VirtualRouter
 type VirtualRouter struct {
+	XMLResource
+
 	ID          uint                  `xml:"ID"`
 	UID         int                   `xml:"UID"`
 	GID         int                   `xml:"GID"`
@@ -41,22 +43,18 @@ type virtualRouterNIC struct {
 // NewVirtualRouterPool returns a virtual router pool. A connection to OpenNebula is
 // performed.
 func NewVirtualRouterPool(args ...int) (*VirtualRouterPool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, false)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Call("one.vrouterpool.info", who, start, end)
+	return NewVirtualRouterPoolWithOptions(opts)
+}
+
+// NewVirtualRouterPoolWithOptions returns a virtual router pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewVirtualRouterPoolWithOptions(opts PoolOptions) (*VirtualRouterPool, error) {
+	response, err := client.Call("one.vrouterpool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -71,6 +69,12 @@ func NewVirtualRouterPool(args ...int) (*VirtualRouterPool, error) {
 	return vrouterPool, nil
 }
 
+// NewVirtualRouterPoolIterator returns an iterator over the virtual router pool, retrieving
+// pageSize IDs at a time
+func NewVirtualRouterPoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.vrouterpool.info", "VROUTER", opts, pageSize)
+}
+
 // NewVirtualRouter finds a virtual router object by ID. No connection to OpenNebula.
 func NewVirtualRouter(id uint) *VirtualRouter {
 	return &VirtualRouter{ID: id}
@@ -80,27 +84,11 @@ func NewVirtualRouter(id uint) *VirtualRouter {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the virtual router.
 func NewVirtualRouterFromName(name string) (*VirtualRouter, error) {
-	var id uint
-
-	vrouterPool, err := NewVirtualRouterPool()
+	id, err := resolveName(resolveVirtualRouter, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(vrouterPool.VirtualRouters); i++ {
-		if vrouterPool.VirtualRouters[i].Name == name {
-			if match {
-				return nil, errors.New("multiple resources with that name")
-			}
-			id = vrouterPool.VirtualRouters[i].ID
-			match = true
-		}
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewVirtualRouter(id), nil
 }
 
@@ -122,6 +110,7 @@ func (vr *VirtualRouter) Info() error {
 		return err
 	}
 	*vr = VirtualRouter{}
+	vr.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), vr)
 }
 
@@ -1,9 +1,10 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 	"fmt"
+	"strings"
 )
 
 // VMPool represents an OpenNebula Virtual Machine pool
@@ -13,6 +14,8 @@ type VMPool struct {
 
 // VM represents an OpenNebula Virtual Machine
 type VM struct {
+	XMLResource
+
 	ID              uint              `xml:"ID"`
 	UID             int               `xml:"UID"`
 	GID             int               `xml:"GID"`
@@ -190,7 +193,7 @@ func (st VMState) isValid() bool {
 	return false
 }
 
-func (s VMState) String() string {
+func (s VMState) name() string {
 	switch s {
 	case Init:
 		return "INIT"
@@ -219,6 +222,64 @@ func (s VMState) String() string {
 	}
 }
 
+// String returns the name of the VMState as used by OpenNebula, e.g. "ACTIVE",
+// except CloningFailure which is "CLONINGFAILURE"
+func (s VMState) String() string {
+	return stateString("VMState", int(s), s.name())
+}
+
+// ParseVMState returns the VMState named s, e.g. "ACTIVE". The numeric value
+// of the state is also accepted.
+func ParseVMState(s string) (VMState, error) {
+	// Name used by oned, String keeps the historical one of goca
+	if strings.EqualFold(strings.TrimSpace(s), "CLONING_FAILURE") {
+		return CloningFailure, nil
+	}
+
+	st, err := parseState("VMState", s, int(CloningFailure), func(i int) string {
+		return VMState(i).name()
+	})
+	return VMState(st), err
+}
+
+// MarshalText encodes the VMState as its name
+func (s VMState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a VMState from its name or its value
+func (s *VMState) UnmarshalText(text []byte) error {
+	st, err := ParseVMState(string(text))
+	if err != nil {
+		return err
+	}
+	*s = st
+	return nil
+}
+
+// UnmarshalJSON decodes a VMState from a JSON string or number
+func (s *VMState) UnmarshalJSON(data []byte) error {
+	return s.UnmarshalText(jsonStateString(data))
+}
+
+// IsFailure returns true if the VM is in a failure state. For the Active
+// state, the LCMState has to be checked.
+func (s VMState) IsFailure() bool {
+	return s == CloningFailure
+}
+
+// IsTransient returns true if the VM is waiting for an operation to
+// complete and will change state without user intervention. For the Active
+// state, the LCMState has to be checked.
+func (s VMState) IsTransient() bool {
+	switch s {
+	case Init, Pending, Cloning:
+		return true
+	default:
+		return false
+	}
+}
+
 // LCMState is the life-cycle manager state of the virtual machine. It is used
 // only when the VM's state is active, otherwise it's LcmInit
 type LCMState int
@@ -416,18 +477,36 @@ const (
 
 	// DiskResizeUndeployed lcm state
 	DiskResizeUndeployed LCMState = 64
+
+	// HotplugNicPoweroff lcm state
+	HotplugNicPoweroff LCMState = 65
+
+	// HotplugResize lcm state
+	HotplugResize LCMState = 66
+
+	// HotplugSaveasUndeployed lcm state
+	HotplugSaveasUndeployed LCMState = 67
+
+	// HotplugSaveasStopped lcm state
+	HotplugSaveasStopped LCMState = 68
+
+	// Backup lcm state
+	Backup LCMState = 69
+
+	// BackupPoweroff lcm state
+	BackupPoweroff LCMState = 70
 )
 
 func (st LCMState) isValid() bool {
 	if (st >= LcmInit && st <= Shutdown) ||
 		(st >= CleanupResubmit && st <= DiskSnapshot) ||
-		(st >= DiskSnapshotDelete && st <= DiskResizeUndeployed) {
+		(st >= DiskSnapshotDelete && st <= BackupPoweroff) {
 		return true
 	}
 	return false
 }
 
-func (l LCMState) String() string {
+func (l LCMState) name() string {
 	switch l {
 	case LcmInit:
 		return "LCM_INIT"
@@ -553,41 +632,140 @@ func (l LCMState) String() string {
 		return "DISK_RESIZE_POWEROFF"
 	case DiskResizeUndeployed:
 		return "DISK_RESIZE_UNDEPLOYED"
+	case HotplugNicPoweroff:
+		return "HOTPLUG_NIC_POWEROFF"
+	case HotplugResize:
+		return "HOTPLUG_RESIZE"
+	case HotplugSaveasUndeployed:
+		return "HOTPLUG_SAVEAS_UNDEPLOYED"
+	case HotplugSaveasStopped:
+		return "HOTPLUG_SAVEAS_STOPPED"
+	case Backup:
+		return "BACKUP"
+	case BackupPoweroff:
+		return "BACKUP_POWEROFF"
 	default:
 		return ""
 	}
 }
 
+// String returns the name of the LCMState as used by OpenNebula, e.g.
+// "RUNNING"
+func (l LCMState) String() string {
+	return stateString("LCMState", int(l), l.name())
+}
+
+// ParseLCMState returns the LCMState named s, e.g. "RUNNING". The numeric
+// value of the state is also accepted.
+func ParseLCMState(s string) (LCMState, error) {
+	st, err := parseState("LCMState", s, int(BackupPoweroff), func(i int) string {
+		return LCMState(i).name()
+	})
+	return LCMState(st), err
+}
+
+// MarshalText encodes the LCMState as its name
+func (l LCMState) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText decodes a LCMState from its name or its value
+func (l *LCMState) UnmarshalText(text []byte) error {
+	st, err := ParseLCMState(string(text))
+	if err != nil {
+		return err
+	}
+	*l = st
+	return nil
+}
+
+// UnmarshalJSON decodes a LCMState from a JSON string or number
+func (l *LCMState) UnmarshalJSON(data []byte) error {
+	return l.UnmarshalText(jsonStateString(data))
+}
+
+// IsFailure returns true for the *_FAILURE states, waiting for a recover
+// operation
+func (l LCMState) IsFailure() bool {
+	switch l {
+	case BootFailure,
+		BootMigrateFailure,
+		PrologMigrateFailure,
+		PrologFailure,
+		EpilogFailure,
+		EpilogStopFailure,
+		EpilogUndeployFailure,
+		PrologMigratePoweroffFailure,
+		PrologMigrateSuspendFailure,
+		BootUndeployFailure,
+		BootStoppedFailure,
+		PrologResumeFailure,
+		PrologUndeployFailure,
+		PrologMigrateUnknownFailure:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsTransient returns true if the VM is waiting for a driver operation to
+// complete and will change state without user intervention. LcmInit,
+// Running, Unknown, the failure states and the unknown values are not
+// transient.
+func (l LCMState) IsTransient() bool {
+	switch l {
+	case LcmInit, Running, Unknown:
+		return false
+	default:
+		return l.isValid() && !l.IsFailure()
+	}
+}
+
+// IsRunning returns true if the guest is running, including during the
+// operations performed on a running VM (live migration, hotplug, snapshots...)
+func (l LCMState) IsRunning() bool {
+	switch l {
+	case Running,
+		Migrate,
+		Hotplug,
+		HotplugSnapshot,
+		HotplugNic,
+		HotplugSaveas,
+		HotplugResize,
+		DiskSnapshot,
+		DiskSnapshotDelete,
+		DiskResize,
+		Backup:
+		return true
+	default:
+		return false
+	}
+}
+
 // NewVMPool returns a new image pool. It accepts the scope of the query.
 func NewVMPool(args ...int) (*VMPool, error) {
-	var who, start, end, state int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-		state = -1
-	case 1:
-		who = args[0]
-		start = -1
-		end = -1
-		state = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-		state = -1
-	case 4:
-		who = args[0]
-		start = args[1]
-		end = args[2]
+	state := -1
+	if len(args) == 4 {
 		state = args[3]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+		args = args[:3]
 	}
 
-	response, err := client.Call("one.vmpool.info", who, start, end, state)
+	opts, err := poolOptions(args, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVMPool(opts, state)
+}
+
+// NewVMPoolWithOptions returns a VM pool filtered by opts, without the VMs in
+// the DONE state. A connection to OpenNebula is performed.
+func NewVMPoolWithOptions(opts PoolOptions) (*VMPool, error) {
+	return newVMPool(opts, -1)
+}
+
+func newVMPool(opts PoolOptions, state int) (*VMPool, error) {
+	response, err := client.Call("one.vmpool.info", opts.Who, opts.Start, opts.End, state)
 	if err != nil {
 		return nil, err
 	}
@@ -601,6 +779,12 @@ func NewVMPool(args ...int) (*VMPool, error) {
 	return vmPool, nil
 }
 
+// NewVMPoolIterator returns an iterator over the VM pool, without the VMs in
+// the DONE state, retrieving pageSize IDs at a time
+func NewVMPoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.vmpool.info", "VM", opts, pageSize, -1)
+}
+
 // Monitoring returns all the virtual machine monitoring records
 // filter flag:
 // -4: Resources belonging to the user's primary group
@@ -680,55 +864,57 @@ func NewVM(id uint) *VM {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the VM.
 func NewVMFromName(name string) (*VM, error) {
-	var id uint
-
-	vmPool, err := NewVMPool()
+	id, err := resolveName(resolveVM, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(vmPool.VMs); i++ {
-		if vmPool.VMs[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = vmPool.VMs[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewVM(id), nil
 }
 
-// State returns the VMState and LCMState
+// State returns the VMState and LCMState. The state values unknown to goca
+// are returned as is.
 func (vm *VM) State() (VMState, LCMState, error) {
-	state := VMState(vm.StateRaw)
-	if !state.isValid() {
-		return -1, -1, fmt.Errorf("VM State: this state value is not currently handled: %d\n", vm.StateRaw)
+	if vm.StateRaw < 0 {
+		return -1, -1, fmt.Errorf("VM State: invalid state value: %d", vm.StateRaw)
 	}
-	lcmState := LCMState(vm.LCMStateRaw)
-	if !lcmState.isValid() {
-		return state, -1, fmt.Errorf("VM LCMState: this state value is not currently handled: %d\n", vm.LCMStateRaw)
+	if vm.LCMStateRaw < 0 {
+		return VMState(vm.StateRaw), -1, fmt.Errorf("VM LCMState: invalid state value: %d", vm.LCMStateRaw)
 	}
-	return state, lcmState, nil
+	return VMState(vm.StateRaw), LCMState(vm.LCMStateRaw), nil
 }
 
 // StateString returns the VMState and LCMState as strings
 func (vm *VM) StateString() (string, string, error) {
+	state, lcmState, err := vm.State()
+	if err != nil {
+		return "", "", err
+	}
+	return state.String(), lcmState.String(), nil
+}
+
+// IsFailure returns true if the VM is in a failure state
+func (vm *VM) IsFailure() bool {
 	state := VMState(vm.StateRaw)
-	if !state.isValid() {
-		return "", "", fmt.Errorf("VM State: this state value is not currently handled: %d\n", vm.StateRaw)
+	if state == Active {
+		return LCMState(vm.LCMStateRaw).IsFailure()
 	}
-	lcmState := LCMState(vm.LCMStateRaw)
-	if !lcmState.isValid() {
-		return state.String(), "", fmt.Errorf("VM LCMState: this state value is not currently handled: %d\n", vm.LCMStateRaw)
+	return state.IsFailure()
+}
+
+// IsTransient returns true if the VM is waiting for an operation to complete
+// and will change state without user intervention
+func (vm *VM) IsTransient() bool {
+	state := VMState(vm.StateRaw)
+	if state == Active {
+		return LCMState(vm.LCMStateRaw).IsTransient()
 	}
-	return state.String(), lcmState.String(), nil
+	return state.IsTransient()
+}
+
+// IsRunning returns true if the guest of the VM is running
+func (vm *VM) IsRunning() bool {
+	return VMState(vm.StateRaw) == Active && LCMState(vm.LCMStateRaw).IsRunning()
 }
 
 // Action is the generic method to run any action on the VM
@@ -739,11 +925,16 @@ func (vm *VM) Action(action string) error {
 
 // Info connects to OpenNebula and fetches the information of the VM
 func (vm *VM) Info() error {
-	response, err := client.Call("one.vm.info", vm.ID)
+	return vm.infoContext(context.Background())
+}
+
+func (vm *VM) infoContext(ctx context.Context) error {
+	response, err := client.CallContext(ctx, "one.vm.info", vm.ID)
 	if err != nil {
 		return err
 	}
 	*vm = VM{}
+	vm.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), vm)
 }
 
@@ -0,0 +1,218 @@
+package goca
+
+import (
+	"encoding/xml"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// vmPoolAllStates selects the VMs in any state, DONE included
+	vmPoolAllStates = -2
+
+	// vmPoolNotDone selects the VMs in any state but DONE
+	vmPoolNotDone = -1
+)
+
+// Values of oneClient.vmPoolExtended
+const (
+	extendedUnknown int32 = iota
+	extendedAvailable
+	extendedUnavailable
+)
+
+// VMPoolQuery describes a search in the VM pool. The owner and state filters
+// are applied by OpenNebula, the other ones while the pool is received. Use
+// NewVMPoolQuery to get the default values.
+type VMPoolQuery struct {
+	// Who is one of the PoolWho* filter flags, or a user ID
+	Who int
+
+	// StateFilter selects the VMs in one of these states. Empty selects all
+	// the states but DONE.
+	StateFilter []VMState
+
+	// IncludeDone adds the VMs in the DONE state
+	IncludeDone bool
+
+	// NameRegex selects the VMs whose name matches the regular expression
+	NameRegex string
+
+	// Labels selects the VMs having all these labels, as set in the LABELS
+	// attribute of the user template by Sunstone
+	Labels []string
+
+	// Host selects the VMs deployed on the host with this ID, -1 for all
+	Host int
+
+	// Cluster selects the VMs deployed in the cluster with this ID, -1 for
+	// all
+	Cluster int
+}
+
+// NewVMPoolQuery returns a query selecting all the VMs of the user performing
+// it, but the ones in the DONE state
+func NewVMPoolQuery() VMPoolQuery {
+	return VMPoolQuery{
+		Who:     PoolWhoMine,
+		Host:    -1,
+		Cluster: -1,
+	}
+}
+
+// NewVMPoolFromQuery returns the VMs matching the query. The pool is filtered
+// while it's decoded, so only the matching VMs are held in memory.
+// one.vmpool.infoextended is used when OpenNebula provides it.
+func NewVMPoolFromQuery(q VMPoolQuery) (*VMPool, error) {
+	var nameRegex *regexp.Regexp
+	if q.NameRegex != "" {
+		var err error
+		nameRegex, err = regexp.Compile(q.NameRegex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vmPool := &VMPool{}
+	decode := func(start *xml.StartElement, d *xml.Decoder) error {
+		vm := VM{}
+		err := d.DecodeElement(&vm, start)
+		if err != nil {
+			return err
+		}
+
+		if q.match(&vm, nameRegex) {
+			vmPool.VMs = append(vmPool.VMs, vm)
+		}
+		return nil
+	}
+
+	args := []interface{}{q.Who, -1, -1, q.serverState()}
+
+	if atomic.LoadInt32(&client.vmPoolExtended) != extendedUnavailable {
+		err := streamPool("VM", decode, "one.vmpool.infoextended", args...)
+		if err == nil {
+			atomic.StoreInt32(&client.vmPoolExtended, extendedAvailable)
+			return vmPool, nil
+		}
+
+		// Older versions answer with an XML-RPC fault: method not found
+		clientErr, ok := err.(*ClientError)
+		if !ok || clientErr.Code != ClientRespXMLRPCFault ||
+			atomic.LoadInt32(&client.vmPoolExtended) == extendedAvailable {
+			return nil, err
+		}
+		atomic.StoreInt32(&client.vmPoolExtended, extendedUnavailable)
+	}
+
+	err := streamPool("VM", decode, "one.vmpool.info", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return vmPool, nil
+}
+
+// serverState returns the state filter sent to OpenNebula: a single state
+// when possible, otherwise a wider filter refined by match
+func (q VMPoolQuery) serverState() int {
+	switch {
+	case len(q.StateFilter) == 1 && !q.IncludeDone:
+		return int(q.StateFilter[0])
+	case q.IncludeDone:
+		return vmPoolAllStates
+	}
+
+	for _, state := range q.StateFilter {
+		if state == Done {
+			return vmPoolAllStates
+		}
+	}
+
+	return vmPoolNotDone
+}
+
+// match applies the filters not handled by OpenNebula
+func (q VMPoolQuery) match(vm *VM, nameRegex *regexp.Regexp) bool {
+	state := VMState(vm.StateRaw)
+	if len(q.StateFilter) > 0 && !(q.IncludeDone && state == Done) {
+		found := false
+		for _, s := range q.StateFilter {
+			if s == state {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if nameRegex != nil && !nameRegex.MatchString(vm.Name) {
+		return false
+	}
+
+	if len(q.Labels) > 0 {
+		labels := vm.Labels()
+		for _, label := range q.Labels {
+			found := false
+			for _, l := range labels {
+				if l == label {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	if q.Host >= 0 || q.Cluster >= 0 {
+		record := vm.lastHistoryRecord()
+		if record == nil {
+			return false
+		}
+		if q.Host >= 0 && record.HID != q.Host {
+			return false
+		}
+		if q.Cluster >= 0 && record.CID != q.Cluster {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Labels returns the labels of the VM, as set in the LABELS attribute of the
+// user template by Sunstone
+func (vm *VM) Labels() []string {
+	if vm.UserTemplate == nil {
+		return nil
+	}
+
+	value := vm.UserTemplate.Dynamic.GetContentByName("LABELS")
+
+	var labels []string
+	for _, label := range strings.Split(value, ",") {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	return labels
+}
+
+// lastHistoryRecord returns the record of the current deployment of the VM,
+// or nil if it has never been deployed
+func (vm *VM) lastHistoryRecord() *vmHistoryRecord {
+	var last *vmHistoryRecord
+	for i := range vm.HistoryRecords {
+		if last == nil || vm.HistoryRecords[i].SEQ > last.SEQ {
+			last = &vm.HistoryRecords[i]
+		}
+	}
+	return last
+}
@@ -0,0 +1,95 @@
+package goca_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+const vmPoolQueryBody = `<VM_POOL>
+	<VM><ID>1</ID><NAME>web-1</NAME><STATE>3</STATE>
+		<USER_TEMPLATE><LABELS>prod,web</LABELS></USER_TEMPLATE>
+		<HISTORY_RECORDS><HISTORY><SEQ>0</SEQ><HID>2</HID><CID>0</CID></HISTORY></HISTORY_RECORDS></VM>
+	<VM><ID>2</ID><NAME>web-2</NAME><STATE>8</STATE>
+		<USER_TEMPLATE><LABELS>web</LABELS></USER_TEMPLATE>
+		<HISTORY_RECORDS><HISTORY><SEQ>0</SEQ><HID>2</HID><CID>0</CID></HISTORY>
+		<HISTORY><SEQ>1</SEQ><HID>5</HID><CID>1</CID></HISTORY></HISTORY_RECORDS></VM>
+	<VM><ID>3</ID><NAME>db-1</NAME><STATE>6</STATE>
+		<USER_TEMPLATE><LABELS>prod, db</LABELS></USER_TEMPLATE></VM>
+	<VM><ID>4</ID><NAME>db-2</NAME><STATE>1</STATE></VM>
+</VM_POOL>`
+
+func TestVMPoolQuery(t *testing.T) {
+	// The server doesn't implement one.vmpool.infoextended, like oned 5.8
+	server, restore := newTestServer()
+	defer restore()
+	server.Handle("one.vmpool.info", func(*gocatest.Call) (interface{}, error) {
+		return vmPoolQueryBody, nil
+	})
+
+	var calls []gocatest.Call
+	ids := func(q goca.VMPoolQuery) []uint {
+		before := len(server.Calls())
+		pool, err := goca.NewVMPoolFromQuery(q)
+		calls = server.Calls()[before:]
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint
+		for _, vm := range pool.VMs {
+			ids = append(ids, vm.ID)
+		}
+		return ids
+	}
+
+	q := goca.NewVMPoolQuery()
+	q.Labels = []string{"prod"}
+	if got := ids(q); !reflect.DeepEqual(got, []uint{1, 3}) {
+		t.Errorf("labels: got %v", got)
+	}
+
+	// The extended call is tried once
+	if len(calls) != 2 || calls[0].Method != "one.vmpool.infoextended" {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+	expected := []interface{}{-3, -1, -1, -1}
+	if !reflect.DeepEqual(calls[1].Params, expected) {
+		t.Errorf("expected params %v, got %v", expected, calls[1].Params)
+	}
+
+	q = goca.NewVMPoolQuery()
+	q.StateFilter = []goca.VMState{goca.Active, goca.Poweroff}
+	q.IncludeDone = true
+	q.NameRegex = "^(web|db)-[12]$"
+	if got := ids(q); !reflect.DeepEqual(got, []uint{1, 2, 3}) {
+		t.Errorf("states: got %v", got)
+	}
+	if len(calls) != 1 || calls[0].Method != "one.vmpool.info" || calls[0].Params[3] != -2 {
+		t.Errorf("unexpected calls %v", calls)
+	}
+
+	q = goca.NewVMPoolQuery()
+	q.StateFilter = []goca.VMState{goca.Active}
+	q.Host = 2
+	if got := ids(q); !reflect.DeepEqual(got, []uint{1}) {
+		t.Errorf("host: got %v", got)
+	}
+	if calls[0].Params[3] != 3 {
+		t.Errorf("expected the ACTIVE state filter, got %v", calls[0].Params[3])
+	}
+
+	q = goca.NewVMPoolQuery()
+	q.Cluster = 1
+	if got := ids(q); !reflect.DeepEqual(got, []uint{2}) {
+		t.Errorf("cluster: got %v", got)
+	}
+
+	q = goca.NewVMPoolQuery()
+	q.NameRegex = "("
+	_, err := goca.NewVMPoolFromQuery(q)
+	if err == nil {
+		t.Error("an error is expected for an invalid regular expression")
+	}
+}
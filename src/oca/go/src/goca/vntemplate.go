@@ -3,8 +3,8 @@ package goca
 // Since version 5.8 of OpenNebula
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 )
 
 // VNTemplatePool represents an OpenNebula Virtual Network TemplatePool
@@ -14,6 +14,8 @@ type VNTemplatePool struct {
 
 // VNTemplate represents an OpenNebula Virtual Network Template
 type VNTemplate struct {
+	XMLResource
+
 	ID          uint               `xml:"ID"`
 	UID         int                `xml:"UID"`
 	GID         int                `xml:"GID"`
@@ -34,22 +36,18 @@ type vnTemplateTemplate struct {
 // NewVNTemplatePool returns a vntemplate pool. A connection to OpenNebula is
 // performed.
 func NewVNTemplatePool(args ...int) (*VNTemplatePool, error) {
-	var who, start, end int
-
-	switch len(args) {
-	case 0:
-		who = PoolWhoMine
-		start = -1
-		end = -1
-	case 3:
-		who = args[0]
-		start = args[1]
-		end = args[2]
-	default:
-		return nil, errors.New("Wrong number of arguments")
+	opts, err := poolOptions(args, false)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Call("one.vntemplatepool.info", who, start, end)
+	return NewVNTemplatePoolWithOptions(opts)
+}
+
+// NewVNTemplatePoolWithOptions returns a vntemplate pool filtered by opts. A connection to
+// OpenNebula is performed.
+func NewVNTemplatePoolWithOptions(opts PoolOptions) (*VNTemplatePool, error) {
+	response, err := client.Call("one.vntemplatepool.info", opts.Who, opts.Start, opts.End)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +62,12 @@ func NewVNTemplatePool(args ...int) (*VNTemplatePool, error) {
 
 }
 
+// NewVNTemplatePoolIterator returns an iterator over the vntemplate pool, retrieving
+// pageSize IDs at a time
+func NewVNTemplatePoolIterator(ctx context.Context, opts PoolOptions, pageSize int) *PoolIterator {
+	return newPoolIterator(ctx, "one.vntemplatepool.info", "VNTEMPLATE", opts, pageSize)
+}
+
 // NewVNTemplate finds a vntemplate object by ID. No connection to OpenNebula.
 func NewVNTemplate(id uint) *VNTemplate {
 	return &VNTemplate{ID: id}
@@ -73,28 +77,11 @@ func NewVNTemplate(id uint) *VNTemplate {
 // OpenNebula to retrieve the pool, but doesn't perform the Info() call to
 // retrieve the attributes of the vntemplate.
 func NewVNTemplateFromName(name string) (*VNTemplate, error) {
-	var id uint
-
-	vnTemplatePool, err := NewVNTemplatePool()
+	id, err := resolveName(resolveVNTemplate, name)
 	if err != nil {
 		return nil, err
 	}
 
-	match := false
-	for i := 0; i < len(vnTemplatePool.VNTemplates); i++ {
-		if vnTemplatePool.VNTemplates[i].Name != name {
-			continue
-		}
-		if match {
-			return nil, errors.New("multiple resources with that name")
-		}
-		id = vnTemplatePool.VNTemplates[i].ID
-		match = true
-	}
-	if !match {
-		return nil, errors.New("resource not found")
-	}
-
 	return NewVNTemplate(id), nil
 }
 
@@ -115,6 +102,7 @@ func (vntemplate *VNTemplate) Info() error {
 		return err
 	}
 	*vntemplate = VNTemplate{}
+	vntemplate.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), vntemplate)
 }
 
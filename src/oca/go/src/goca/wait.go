@@ -0,0 +1,227 @@
+package goca
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WaitOptions configures the polling performed by the Wait* methods. The zero
+// fields take the values of DefaultWaitOptions.
+type WaitOptions struct {
+	// Interval is the delay before the first retry
+	Interval time.Duration
+
+	// MaxInterval caps the delay between two retries
+	MaxInterval time.Duration
+
+	// Backoff is the factor applied to the delay after each retry. Values
+	// up to 1 keep a constant delay.
+	Backoff float64
+
+	// Timeout is the maximum waiting time. 0 means that the wait only ends
+	// with the context.
+	Timeout time.Duration
+}
+
+// DefaultWaitOptions are used by the Wait* methods when no options are given
+var DefaultWaitOptions = WaitOptions{
+	Interval:    2 * time.Second,
+	MaxInterval: 30 * time.Second,
+	Backoff:     1.5,
+}
+
+// FailureStateError is returned by the Wait* methods when the resource
+// reaches a state it can't leave without user intervention
+type FailureStateError struct {
+	Resource string
+	ID       uint
+	State    string
+
+	// Message is the ERROR attribute of the resource template, if any
+	Message string
+}
+
+func (e *FailureStateError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s %d reached state %s: %s", e.Resource, e.ID, e.State, e.Message)
+	}
+	return fmt.Sprintf("%s %d reached state %s", e.Resource, e.ID, e.State)
+}
+
+// waitOptions returns the options given to a Wait* method, completed with
+// DefaultWaitOptions
+func waitOptions(opts []WaitOptions) WaitOptions {
+	o := DefaultWaitOptions
+	if len(opts) == 0 {
+		return o
+	}
+
+	if opts[0].Interval > 0 {
+		o.Interval = opts[0].Interval
+	}
+	if opts[0].MaxInterval > 0 {
+		o.MaxInterval = opts[0].MaxInterval
+	}
+	if opts[0].Backoff != 0 {
+		o.Backoff = opts[0].Backoff
+	}
+	if opts[0].Timeout > 0 {
+		o.Timeout = opts[0].Timeout
+	}
+
+	return o
+}
+
+// poll calls check until it returns true or an error, sleeping between two
+// calls according to the options
+func poll(ctx context.Context, opts []WaitOptions, check func() (bool, error)) error {
+	o := waitOptions(opts)
+
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
+	interval := o.Interval
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if o.Backoff > 1 {
+			interval = time.Duration(float64(interval) * o.Backoff)
+		}
+		if o.MaxInterval > 0 && interval > o.MaxInterval {
+			interval = o.MaxInterval
+		}
+	}
+}
+
+// WaitForState refreshes the VM until predicate returns true. It fails early
+// with a FailureStateError when the VM reaches a failure state or the DONE
+// state. The VM holds the last retrieved state when it returns.
+func (vm *VM) WaitForState(ctx context.Context, predicate func(vm *VM) bool, opts ...WaitOptions) error {
+	return poll(ctx, opts, func() (bool, error) {
+		err := vm.infoContext(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if predicate(vm) {
+			return true, nil
+		}
+
+		if vm.IsFailure() || VMState(vm.StateRaw) == Done {
+			return false, vm.failureStateError()
+		}
+
+		return false, nil
+	})
+}
+
+// WaitRunning waits until the VM is ACTIVE/RUNNING
+func (vm *VM) WaitRunning(ctx context.Context, opts ...WaitOptions) error {
+	return vm.WaitForState(ctx, func(vm *VM) bool {
+		return VMState(vm.StateRaw) == Active && LCMState(vm.LCMStateRaw) == Running
+	}, opts...)
+}
+
+// WaitPoweroff waits until the VM is in the POWEROFF state
+func (vm *VM) WaitPoweroff(ctx context.Context, opts ...WaitOptions) error {
+	return vm.WaitForState(ctx, func(vm *VM) bool {
+		return VMState(vm.StateRaw) == Poweroff
+	}, opts...)
+}
+
+// WaitDone waits until the VM is in the DONE state
+func (vm *VM) WaitDone(ctx context.Context, opts ...WaitOptions) error {
+	return vm.WaitForState(ctx, func(vm *VM) bool {
+		return VMState(vm.StateRaw) == Done
+	}, opts...)
+}
+
+// WaitForLeases waits until each NIC of the VM has been leased an address,
+// IPv4 or IPv6
+func (vm *VM) WaitForLeases(ctx context.Context, opts ...WaitOptions) error {
+	return vm.WaitForState(ctx, func(vm *VM) bool {
+		if len(vm.Template.NIC) == 0 {
+			return false
+		}
+		for _, nic := range vm.Template.NIC {
+			if nic.IP != "" {
+				continue
+			}
+			ip6, _ := nic.Dynamic.GetContentByName("IP6_GLOBAL")
+			if ip6 == "" {
+				ip6, _ = nic.Dynamic.GetContentByName("IP6_ULA")
+			}
+			if ip6 == "" {
+				return false
+			}
+		}
+		return true
+	}, opts...)
+}
+
+func (vm *VM) failureStateError() error {
+	state, lcmState, _ := vm.State()
+
+	e := &FailureStateError{Resource: "VM", ID: vm.ID, State: state.String()}
+	if state == Active {
+		e.State = lcmState.String()
+	}
+	if vm.UserTemplate != nil {
+		e.Message = vm.UserTemplate.Error
+	}
+
+	return e
+}
+
+// WaitForState refreshes the image until predicate returns true. It fails
+// early with a FailureStateError when the image reaches the ERROR state. The
+// image holds the last retrieved state when it returns.
+func (image *Image) WaitForState(ctx context.Context, predicate func(image *Image) bool, opts ...WaitOptions) error {
+	return poll(ctx, opts, func() (bool, error) {
+		err := image.infoContext(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if predicate(image) {
+			return true, nil
+		}
+
+		state := ImageState(image.StateRaw)
+		if state.IsFailure() {
+			message, _ := image.Template.Dynamic.GetContentByName("ERROR")
+			return false, &FailureStateError{
+				Resource: "Image",
+				ID:       image.ID,
+				State:    state.String(),
+				Message:  message,
+			}
+		}
+
+		return false, nil
+	})
+}
+
+// WaitReady waits until the image can be used by VMs: READY, or USED for a
+// non persistent image
+func (image *Image) WaitReady(ctx context.Context, opts ...WaitOptions) error {
+	return image.WaitForState(ctx, func(image *Image) bool {
+		state := ImageState(image.StateRaw)
+		return state == ImageReady || state == ImageUsed
+	}, opts...)
+}
@@ -0,0 +1,95 @@
+package goca
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var waitTestOptions = WaitOptions{
+	Interval:    time.Millisecond,
+	MaxInterval: 4 * time.Millisecond,
+	Backoff:     2,
+}
+
+func TestPoll(t *testing.T) {
+	calls := 0
+	err := poll(context.Background(), []WaitOptions{waitTestOptions}, func() (bool, error) {
+		calls++
+		return calls == 5, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 5 {
+		t.Errorf("expected 5 calls, got %d", calls)
+	}
+
+	// An error stops the polling
+	checkErr := errors.New("check error")
+	err = poll(context.Background(), []WaitOptions{waitTestOptions}, func() (bool, error) {
+		return false, checkErr
+	})
+	if err != checkErr {
+		t.Errorf("expected %v, got %v", checkErr, err)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	opts := waitTestOptions
+	opts.Timeout = 20 * time.Millisecond
+
+	err := poll(context.Background(), []WaitOptions{opts}, func() (bool, error) {
+		return false, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = poll(ctx, []WaitOptions{waitTestOptions}, func() (bool, error) {
+		return false, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWaitOptions(t *testing.T) {
+	if o := waitOptions(nil); o != DefaultWaitOptions {
+		t.Errorf("expected the default options, got %+v", o)
+	}
+
+	// The zero fields are defaulted one by one
+	o := waitOptions([]WaitOptions{{Timeout: 5 * time.Minute}})
+	expected := DefaultWaitOptions
+	expected.Timeout = 5 * time.Minute
+	if o != expected {
+		t.Errorf("expected %+v, got %+v", expected, o)
+	}
+
+	o = waitOptions([]WaitOptions{{Interval: time.Second, Backoff: 1}})
+	expected = DefaultWaitOptions
+	expected.Interval, expected.Backoff = time.Second, 1
+	if o != expected {
+		t.Errorf("expected %+v, got %+v", expected, o)
+	}
+}
+
+func TestFailureStateError(t *testing.T) {
+	vm := &VM{
+		ID:           3,
+		StateRaw:     int(Active),
+		LCMStateRaw:  int(BootFailure),
+		UserTemplate: &vmUserTemplate{Error: "driver error"},
+	}
+
+	err := vm.failureStateError()
+	expected := "VM 3 reached state BOOT_FAILURE: driver error"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,99 @@
+package goca_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+// waitServer starts a server answering the info calls of method with the
+// successive bodies, the last one repeated. It returns the number of calls.
+func waitServer(method string, bodies ...string) (calls *int, restore func()) {
+	server, restore := newTestServer()
+
+	calls = new(int)
+	server.Handle(method, func(*gocatest.Call) (interface{}, error) {
+		body := bodies[0]
+		if len(bodies) > 1 {
+			bodies = bodies[1:]
+		}
+		*calls++
+		return body, nil
+	})
+	return calls, restore
+}
+
+func TestWaitRunning(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+
+	// The VM is deployed, and goes through PROLOG and BOOT
+	id, err := goca.CreateVM("CPU = 1\nMEMORY = 64", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := goca.NewVM(id)
+	if err := vm.WaitRunning(context.Background(), goca.WaitTestOptions); err != nil {
+		t.Fatal(err)
+	}
+	if state, lcm, _ := vm.State(); state != goca.Active || lcm != goca.Running {
+		t.Errorf("expected RUNNING, got %s/%s", state, lcm)
+	}
+
+	// A failure state stops the wait
+	server.SetVMState(id, goca.Active, goca.BootFailure)
+	server.SetVMAttribute(id, "ERROR", "driver error")
+
+	err = vm.WaitRunning(context.Background(), goca.WaitTestOptions)
+	if _, ok := err.(*goca.FailureStateError); !ok {
+		t.Errorf("expected a FailureStateError, got %v", err)
+	}
+}
+
+func TestWaitForLeases(t *testing.T) {
+	calls, restore := waitServer("one.vm.info",
+		`<VM><ID>1</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM>`,
+		`<VM><ID>1</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+			<NIC><NIC_ID>0</NIC_ID><IP>10.0.0.1</IP></NIC>
+			<NIC><NIC_ID>1</NIC_ID></NIC></TEMPLATE></VM>`,
+		`<VM><ID>1</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE><TEMPLATE>
+			<NIC><NIC_ID>0</NIC_ID><IP>10.0.0.1</IP></NIC>
+			<NIC><NIC_ID>1</NIC_ID><IP6_GLOBAL>2001:db8::1</IP6_GLOBAL></NIC></TEMPLATE></VM>`)
+	defer restore()
+
+	vm := goca.NewVM(1)
+	if err := vm.WaitForLeases(context.Background(), goca.WaitTestOptions); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 3 {
+		t.Errorf("expected 3 calls, got %d", *calls)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	_, restore := newTestServer()
+	defer restore()
+
+	// The image is LOCKED until it is retrieved once
+	id, err := goca.CreateImage("NAME = os\nPATH = /tmp/os.qcow2\nSIZE = 2048", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := goca.NewImage(id)
+	if err := image.WaitReady(context.Background(), goca.WaitTestOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	_, restore = waitServer("one.image.info",
+		`<IMAGE><ID>1</ID><STATE>4</STATE></IMAGE>`,
+		`<IMAGE><ID>1</ID><STATE>5</STATE><TEMPLATE><ERROR>copy failed</ERROR></TEMPLATE></IMAGE>`)
+	defer restore()
+
+	err = goca.NewImage(1).WaitReady(context.Background(), goca.WaitTestOptions)
+	expected := "Image 1 reached state ERROR: copy failed"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
@@ -0,0 +1,401 @@
+package goca
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// DefaultWatchInterval is the delay between two pool retrievals of a watcher
+// when WatchOptions.Interval is not set
+const DefaultWatchInterval = 10 * time.Second
+
+// EventType is the kind of change reported by a watcher
+type EventType int
+
+const (
+	// EventAdded is sent when a resource appears in the pool, and for each
+	// resource of the first retrieved pool
+	EventAdded EventType = iota
+
+	// EventDeleted is sent when a resource disappears from the pool
+	EventDeleted
+
+	// EventStateChanged is sent when the state of a resource changes
+	EventStateChanged
+
+	// EventTemplateChanged is sent when the template of a resource changes
+	EventTemplateChanged
+
+	// EventSync is sent for each unchanged resource at every resync
+	EventSync
+
+	// EventError is sent when the pool can't be retrieved. The watcher
+	// retries at the next interval.
+	EventError
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "ADDED"
+	case EventDeleted:
+		return "DELETED"
+	case EventStateChanged:
+		return "STATE_CHANGED"
+	case EventTemplateChanged:
+		return "TEMPLATE_CHANGED"
+	case EventSync:
+		return "SYNC"
+	case EventError:
+		return "ERROR"
+	default:
+		return ""
+	}
+}
+
+// WatchOptions configures a watcher
+type WatchOptions struct {
+	// Interval is the delay between two pool retrievals. Defaults to
+	// DefaultWatchInterval.
+	Interval time.Duration
+
+	// Resync is the period at which an EventSync is sent for every
+	// unchanged resource. 0 disables the resync.
+	Resync time.Duration
+
+	// Buffer is the capacity of the events channel
+	Buffer int
+}
+
+// watchEvent is the untyped event built by runWatch
+type watchEvent struct {
+	typ EventType
+	id  uint
+	old interface{}
+	new interface{}
+	err error
+}
+
+// watchSource describes how to retrieve and compare the resources of a pool
+type watchSource struct {
+	// fetch returns the filtered resources, indexed by ID
+	fetch func() (map[uint]interface{}, error)
+
+	// state and template return the comparable parts of a resource
+	state    func(resource interface{}) interface{}
+	template func(resource interface{}) interface{}
+}
+
+// runWatch retrieves the pool at each interval and calls emit for each
+// change, until ctx is done or emit returns false
+func runWatch(ctx context.Context, opts WatchOptions, src watchSource, emit func(watchEvent) bool) {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	known := map[uint]interface{}{}
+	lastSync := time.Now()
+
+	for {
+		current, err := src.fetch()
+		if err != nil {
+			if !emit(watchEvent{typ: EventError, err: err}) {
+				return
+			}
+		} else {
+			resync := opts.Resync > 0 && time.Since(lastSync) >= opts.Resync
+			if resync {
+				lastSync = time.Now()
+			}
+
+			for _, id := range sortedIDs(current) {
+				if !emitChanges(id, known[id], current[id], src, resync, emit) {
+					return
+				}
+			}
+
+			for _, id := range sortedIDs(known) {
+				if _, ok := current[id]; ok {
+					continue
+				}
+				if !emit(watchEvent{typ: EventDeleted, id: id, old: known[id]}) {
+					return
+				}
+			}
+
+			known = current
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// emitChanges emits the events describing the change of a resource from old
+// to cur
+func emitChanges(id uint, old, cur interface{}, src watchSource, resync bool, emit func(watchEvent) bool) bool {
+	if old == nil {
+		return emit(watchEvent{typ: EventAdded, id: id, new: cur})
+	}
+
+	changed := false
+	if !reflect.DeepEqual(src.state(old), src.state(cur)) {
+		changed = true
+		if !emit(watchEvent{typ: EventStateChanged, id: id, old: old, new: cur}) {
+			return false
+		}
+	}
+	if !reflect.DeepEqual(src.template(old), src.template(cur)) {
+		changed = true
+		if !emit(watchEvent{typ: EventTemplateChanged, id: id, old: old, new: cur}) {
+			return false
+		}
+	}
+	if !changed && resync {
+		return emit(watchEvent{typ: EventSync, id: id, old: old, new: cur})
+	}
+
+	return true
+}
+
+func sortedIDs(resources map[uint]interface{}) []uint {
+	ids := make([]uint, 0, len(resources))
+	for id := range resources {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// VMEvent is a change of a VM. Old is nil for EventAdded, New is nil for
+// EventDeleted, and both are nil for EventError.
+type VMEvent struct {
+	Type EventType
+	ID   uint
+	Old  *VM
+	New  *VM
+	Err  error
+}
+
+// VMWatcher watches the changes of the VM pool
+type VMWatcher struct {
+	Options WatchOptions
+
+	// Pool retrieves the VM pool. Defaults to NewVMPool().
+	Pool func() (*VMPool, error)
+
+	// Filter selects the watched VMs. Defaults to all the VMs of the pool.
+	Filter func(vm *VM) bool
+}
+
+// Watch starts the watcher. The returned channel is closed when ctx is done.
+func (w *VMWatcher) Watch(ctx context.Context) <-chan VMEvent {
+	events := make(chan VMEvent, w.Options.Buffer)
+
+	src := watchSource{
+		fetch: func() (map[uint]interface{}, error) {
+			pool, err := w.pool()
+			if err != nil {
+				return nil, err
+			}
+			vms := map[uint]interface{}{}
+			for i := range pool.VMs {
+				vm := &pool.VMs[i]
+				if w.Filter == nil || w.Filter(vm) {
+					vms[vm.ID] = vm
+				}
+			}
+			return vms, nil
+		},
+		state: func(r interface{}) interface{} {
+			vm := r.(*VM)
+			return [2]int{vm.StateRaw, vm.LCMStateRaw}
+		},
+		template: func(r interface{}) interface{} {
+			vm := r.(*VM)
+			return []interface{}{vm.Template, vm.UserTemplate}
+		},
+	}
+
+	go func() {
+		defer close(events)
+		runWatch(ctx, w.Options, src, func(e watchEvent) bool {
+			event := VMEvent{Type: e.typ, ID: e.id, Err: e.err}
+			event.Old, _ = e.old.(*VM)
+			event.New, _ = e.new.(*VM)
+
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return events
+}
+
+func (w *VMWatcher) pool() (*VMPool, error) {
+	if w.Pool != nil {
+		return w.Pool()
+	}
+	return NewVMPool()
+}
+
+// HostEvent is a change of a host. Old is nil for EventAdded, New is nil for
+// EventDeleted, and both are nil for EventError.
+type HostEvent struct {
+	Type EventType
+	ID   uint
+	Old  *Host
+	New  *Host
+	Err  error
+}
+
+// HostWatcher watches the changes of the host pool
+type HostWatcher struct {
+	Options WatchOptions
+
+	// Pool retrieves the host pool. Defaults to NewHostPool().
+	Pool func() (*HostPool, error)
+
+	// Filter selects the watched hosts. Defaults to all the hosts of the pool.
+	Filter func(host *Host) bool
+}
+
+// Watch starts the watcher. The returned channel is closed when ctx is done.
+func (w *HostWatcher) Watch(ctx context.Context) <-chan HostEvent {
+	events := make(chan HostEvent, w.Options.Buffer)
+
+	src := watchSource{
+		fetch: func() (map[uint]interface{}, error) {
+			pool, err := w.pool()
+			if err != nil {
+				return nil, err
+			}
+			hosts := map[uint]interface{}{}
+			for i := range pool.Hosts {
+				host := &pool.Hosts[i]
+				if w.Filter == nil || w.Filter(host) {
+					hosts[host.ID] = host
+				}
+			}
+			return hosts, nil
+		},
+		state: func(r interface{}) interface{} {
+			return r.(*Host).StateRaw
+		},
+		template: func(r interface{}) interface{} {
+			return r.(*Host).Template
+		},
+	}
+
+	go func() {
+		defer close(events)
+		runWatch(ctx, w.Options, src, func(e watchEvent) bool {
+			event := HostEvent{Type: e.typ, ID: e.id, Err: e.err}
+			event.Old, _ = e.old.(*Host)
+			event.New, _ = e.new.(*Host)
+
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return events
+}
+
+func (w *HostWatcher) pool() (*HostPool, error) {
+	if w.Pool != nil {
+		return w.Pool()
+	}
+	return NewHostPool()
+}
+
+// ImageEvent is a change of an image. Old is nil for EventAdded, New is nil
+// for EventDeleted, and both are nil for EventError.
+type ImageEvent struct {
+	Type EventType
+	ID   uint
+	Old  *Image
+	New  *Image
+	Err  error
+}
+
+// ImageWatcher watches the changes of the image pool
+type ImageWatcher struct {
+	Options WatchOptions
+
+	// Pool retrieves the image pool. Defaults to NewImagePool().
+	Pool func() (*ImagePool, error)
+
+	// Filter selects the watched images. Defaults to all the images of the
+	// pool.
+	Filter func(image *Image) bool
+}
+
+// Watch starts the watcher. The returned channel is closed when ctx is done.
+func (w *ImageWatcher) Watch(ctx context.Context) <-chan ImageEvent {
+	events := make(chan ImageEvent, w.Options.Buffer)
+
+	src := watchSource{
+		fetch: func() (map[uint]interface{}, error) {
+			pool, err := w.pool()
+			if err != nil {
+				return nil, err
+			}
+			images := map[uint]interface{}{}
+			for i := range pool.Images {
+				image := &pool.Images[i]
+				if w.Filter == nil || w.Filter(image) {
+					images[image.ID] = image
+				}
+			}
+			return images, nil
+		},
+		state: func(r interface{}) interface{} {
+			return r.(*Image).StateRaw
+		},
+		template: func(r interface{}) interface{} {
+			return r.(*Image).Template
+		},
+	}
+
+	go func() {
+		defer close(events)
+		runWatch(ctx, w.Options, src, func(e watchEvent) bool {
+			event := ImageEvent{Type: e.typ, ID: e.id, Err: e.err}
+			event.Old, _ = e.old.(*Image)
+			event.New, _ = e.new.(*Image)
+
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return events
+}
+
+func (w *ImageWatcher) pool() (*ImagePool, error) {
+	if w.Pool != nil {
+		return w.Pool()
+	}
+	return NewImagePool()
+}
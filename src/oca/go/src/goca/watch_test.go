@@ -0,0 +1,108 @@
+package goca_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/gocatest"
+)
+
+func TestVMWatcher(t *testing.T) {
+	var mu sync.Mutex
+	pools := []string{
+		`<VM_POOL>
+			<VM><ID>1</ID><NAME>a</NAME><STATE>1</STATE><LCM_STATE>0</LCM_STATE></VM>
+			<VM><ID>2</ID><NAME>b</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM>
+			<VM><ID>3</ID><NAME>filtered</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM>
+		</VM_POOL>`,
+		`<VM_POOL>
+			<VM><ID>1</ID><NAME>a</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM>
+			<VM><ID>2</ID><NAME>b</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+				<USER_TEMPLATE><A>B</A></USER_TEMPLATE></VM>
+		</VM_POOL>`,
+		`<VM_POOL>
+			<VM><ID>2</ID><NAME>b</NAME><STATE>3</STATE><LCM_STATE>3</LCM_STATE>
+				<USER_TEMPLATE><A>B</A></USER_TEMPLATE></VM>
+		</VM_POOL>`,
+	}
+
+	server, restore := newTestServer()
+	defer restore()
+	server.Handle("one.vmpool.info", func(*gocatest.Call) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		pool := pools[0]
+		if len(pools) > 1 {
+			pools = pools[1:]
+		}
+		return pool, nil
+	})
+
+	watcher := &goca.VMWatcher{
+		Options: goca.WatchOptions{Interval: time.Millisecond},
+		Filter: func(vm *goca.VM) bool {
+			return vm.Name != "filtered"
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := watcher.Watch(ctx)
+
+	expected := []struct {
+		typ goca.EventType
+		id  uint
+	}{
+		{goca.EventAdded, 1},
+		{goca.EventAdded, 2},
+		{goca.EventStateChanged, 1},
+		{goca.EventTemplateChanged, 2},
+		{goca.EventDeleted, 1},
+	}
+
+	for _, e := range expected {
+		select {
+		case event := <-events:
+			if event.Type != e.typ || event.ID != e.id {
+				t.Fatalf("expected %s %d, got %s %d (%v)", e.typ, e.id, event.Type, event.ID, event.Err)
+			}
+			if event.Type == goca.EventStateChanged && event.Old.StateRaw == event.New.StateRaw {
+				t.Error("old and new states should differ")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s %d", e.typ, e.id)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestVMWatcherResync(t *testing.T) {
+	server, restore := newTestServer()
+	defer restore()
+	server.Handle("one.vmpool.info", func(*gocatest.Call) (interface{}, error) {
+		return `<VM_POOL><VM><ID>1</ID><STATE>3</STATE><LCM_STATE>3</LCM_STATE></VM></VM_POOL>`, nil
+	})
+
+	watcher := &goca.VMWatcher{Options: goca.WatchOptions{Interval: time.Millisecond, Resync: time.Millisecond}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := watcher.Watch(ctx)
+
+	for _, typ := range []goca.EventType{goca.EventAdded, goca.EventSync} {
+		select {
+		case event := <-events:
+			if event.Type != typ {
+				t.Fatalf("expected %s, got %s", typ, event.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", typ)
+		}
+	}
+}
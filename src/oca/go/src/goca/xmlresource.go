@@ -1,5 +1,12 @@
 package goca
 
+import (
+	"bytes"
+	"errors"
+
+	"gopkg.in/xmlpath.v2"
+)
+
 const (
 	// PoolWhoPrimaryGroup resources belonging to the user’s primary group.
 	PoolWhoPrimaryGroup = -4
@@ -16,3 +23,71 @@ const (
 	// the query.
 	PoolWhoGroup = -1
 )
+
+// ErrXPathNoMatch is returned by XPath when the expression doesn't match any
+// node of the resource
+var ErrXPathNoMatch = errors.New("xpath: no matching node")
+
+// XMLResource contains the raw XML body of a resource, as returned by its
+// Info() call. It allows to query the attributes that are not modeled by the
+// resource structures.
+type XMLResource struct {
+	body string
+}
+
+// Body returns the raw XML body of the resource. It's empty until Info() is
+// called.
+func (r *XMLResource) Body() string {
+	return r.body
+}
+
+// XPath returns the content of the first node matched by expr, e.g.
+// vm.XPath("/VM/NAME").
+func (r *XMLResource) XPath(expr string) (string, error) {
+	path, root, err := r.xpathCompile(expr)
+	if err != nil {
+		return "", err
+	}
+
+	content, ok := path.String(root)
+	if !ok {
+		return "", ErrXPathNoMatch
+	}
+
+	return content, nil
+}
+
+// XPathAll returns the content of all the nodes matched by expr, e.g.
+// vm.XPathAll("/VM/TEMPLATE/NIC/IP").
+func (r *XMLResource) XPathAll(expr string) ([]string, error) {
+	path, root, err := r.xpathCompile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []string
+	iter := path.Iter(root)
+	for iter.Next() {
+		content = append(content, iter.Node().String())
+	}
+
+	return content, nil
+}
+
+func (r *XMLResource) xpathCompile(expr string) (*xmlpath.Path, *xmlpath.Node, error) {
+	if r.body == "" {
+		return nil, nil, errors.New("xpath: empty XML body, Info() has to be called first")
+	}
+
+	path, err := xmlpath.Compile(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := xmlpath.Parse(bytes.NewBufferString(r.body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return path, root, nil
+}
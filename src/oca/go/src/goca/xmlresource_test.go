@@ -0,0 +1,42 @@
+package goca
+
+import (
+	"testing"
+)
+
+var xpathVMXML = `<VM><ID>42</ID><NAME>xpath-vm</NAME><TEMPLATE>
+<NIC><IP>10.0.0.1</IP></NIC>
+<NIC><IP>10.0.0.2</IP></NIC>
+</TEMPLATE></VM>`
+
+func TestXPath(t *testing.T) {
+	vm := NewVM(42)
+
+	_, err := vm.XPath("/VM/NAME")
+	if err == nil {
+		t.Error("XPath should fail before Info()")
+	}
+
+	vm.body = xpathVMXML
+
+	name, err := vm.XPath("/VM/NAME")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "xpath-vm" {
+		t.Errorf("expected xpath-vm, got %s", name)
+	}
+
+	_, err = vm.XPath("/VM/MISSING")
+	if err != ErrXPathNoMatch {
+		t.Errorf("expected ErrXPathNoMatch, got %v", err)
+	}
+
+	ips, err := vm.XPathAll("/VM/TEMPLATE/NIC/IP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0] != "10.0.0.1" || ips[1] != "10.0.0.2" {
+		t.Errorf("unexpected NIC IPs: %v", ips)
+	}
+}
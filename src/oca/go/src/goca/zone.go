@@ -1,8 +1,8 @@
 package goca
 
 import (
+	"context"
 	"encoding/xml"
-	"errors"
 	"fmt"
 )
 
@@ -16,6 +16,8 @@ type ZonePool struct {
 
 // Zone represents an OpenNebula Zone
 type Zone struct {
+	XMLResource
+
 	ID         uint         `xml:"ID"`
 	Name       string       `xml:"NAME"`
 	Template   zoneTemplate `xml:"TEMPLATE"`
@@ -110,7 +112,7 @@ func NewZoneFromName(name string) (*Zone, error) {
 	}
 
 	if zonePool.Name != name {
-		return nil, errors.New("resource not found")
+		return nil, ErrNotFound
 	}
 
 	return NewZone(zonePool.ID), nil
@@ -157,12 +159,13 @@ func (zone *Zone) Info() error {
 		return err
 	}
 	*zone = Zone{}
+	zone.body = response.Body()
 	return xml.Unmarshal([]byte(response.Body()), zone)
 }
 
 //GetRaftStatus give the raft status of the server behind the current RPC endpoint. To get endpoints make an info call.
 func GetRaftStatus(serverUrl string) (*ZoneServerRaftStatus, error) {
-	response, err := client.endpointCall(serverUrl, "one.zone.raftstatus")
+	response, err := client.endpointCall(context.Background(), serverUrl, "one.zone.raftstatus")
 	if err != nil {
 		return nil, err
 	}